@@ -4,18 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v3"
 
 	"magnax.ca/VPNManager/internal/version"
 	"magnax.ca/VPNManager/pkg/manager"
 	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wireguard"
 )
 
 const (
@@ -36,11 +41,32 @@ func loadConfig(configFilePath string) (*manager.Config, error) {
 }
 
 func getVpn(cmd *cli.Command) (*pivpn.Vpn, error) {
+	vpn, _, err := getVpnAndConfig(cmd)
+	return vpn, err
+}
+
+func getVpnAndConfig(cmd *cli.Command) (*pivpn.Vpn, *manager.Config, error) {
+	vpn, cfg, err := newVpn(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = vpn.Reload(); err != nil {
+		return nil, nil, err
+	}
+
+	return vpn, cfg, nil
+}
+
+// newVpn returns the configured vpn, without reading the tunnel and its clients.
+func newVpn(cmd *cli.Command) (*pivpn.Vpn, *manager.Config, error) {
 	cfg, err := loadConfig(cmd.String("config"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if cfg, err = cfg.ForPiVPN(cmd.String("tunnel")); err != nil {
+		return nil, nil, err
 	}
-	vpn, err := pivpn.LoadVpnWithLocations(
+	vpn, err := pivpn.NewVpnWithLocations(
 		cfg.PiVPNConfig.Name,
 		cfg.PiVPNConfig.ConfigFilePath,
 		cfg.PiVPNConfig.TunnelDirectory,
@@ -48,12 +74,19 @@ func getVpn(cmd *cli.Command) (*pivpn.Vpn, error) {
 		cfg.PiVPNConfig.KeysDirectory,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	vpn.SetReloadCmds(cfg.PiVPNConfig.ReloadPiholeCmd, cfg.PiVPNConfig.ReloadWgCmd)
+	vpn.SetReloadCmds(cfg.PiVPNConfig.ReloadPiholeCmd, cfg.PiVPNConfig.ReloadCmd())
+	vpn.SetPeerApplier(cfg.PiVPNConfig.PeerApplier())
+	vpn.SetLockTimeout(cfg.Timeouts.Lock())
+	ipam, err := cfg.PiVPNConfig.NewIPAM()
+	if err != nil {
+		return nil, nil, err
+	}
+	vpn.SetIPAM(ipam)
 
-	return vpn, nil
+	return vpn, cfg, nil
 }
 
 func CmdDaemon(ctx context.Context, cmd *cli.Command) error {
@@ -85,10 +118,14 @@ func CmdListClients(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
+	if tag := cmd.String("tag"); tag != "" {
+		vpn.Clients = slices.DeleteFunc(vpn.Clients, func(c pivpn.Client) bool { return !c.Meta.HasTag(tag) })
+	}
+
 	fmt.Printf("%s\n", "::: Clients Summary :::")
 	fmt.Printf("%-20s %-49s %s\n", "Client", "Public key", "Creation date")
 	for _, client := range vpn.Clients {
-		fmt.Printf("%-20s %-49s %s\n", client.Name, client.Interface.PrivateKey.Public().String(), client.CreationDate.String())
+		fmt.Printf("%-20s %-49s %s\n", client.Name, client.PublicKey().String(), client.CreationDate.String())
 	}
 
 	fmt.Printf("%s\n", "::: Disabled clients :::")
@@ -99,6 +136,64 @@ func CmdListClients(ctx context.Context, cmd *cli.Command) error {
 		fmt.Printf("%s\n", client.Name)
 	}
 
+	now := time.Now()
+	var expiring []pivpn.Client
+	for _, client := range vpn.Clients {
+		if !client.Meta.Expires.IsZero() {
+			expiring = append(expiring, client)
+		}
+	}
+	if len(expiring) > 0 {
+		fmt.Printf("%s\n", "::: Client expiries :::")
+		for _, client := range expiring {
+			state := ""
+			if client.Meta.Expired(now) {
+				state = " (expired)"
+			}
+			fmt.Printf("%-20s %s%s\n", client.Name, client.Meta.Expires.Local().Format(time.DateTime), state)
+		}
+	}
+
+	return nil
+}
+
+func CmdStatus(ctx context.Context, cmd *cli.Command) error {
+	vpn, cfg, err := getVpnAndConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	source := cfg.PiVPNConfig.StatusSource()
+	if dump := cmd.String("dump"); dump != "" {
+		source = wireguard.DumpFile(dump)
+	}
+	statuses, err := vpn.Status(source)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fmt.Printf("%s\n", "::: Clients Status :::")
+	fmt.Printf("%-20s %-8s %-16s %-40s %-12s %-12s %s\n", "Name", "Status", "Virtual IP", "Remote endpoint", "Received", "Sent", "Last seen")
+	for _, status := range statuses {
+		state, endpoint, rx, tx, lastSeen := "offline", "(none)", "-", "-", "(not yet)"
+		if status.IsOnline(now) {
+			state = "online"
+		} else if status.Disabled {
+			state = "disabled"
+		}
+		if peer := status.Peer; peer != nil {
+			if !peer.Endpoint.IsEmpty() {
+				endpoint = peer.Endpoint.String()
+			}
+			rx, tx = humanBytes(peer.RxBytes), humanBytes(peer.TxBytes)
+			if !peer.LatestHandshake.IsZero() {
+				lastSeen = peer.LatestHandshake.Format(time.DateTime)
+			}
+		}
+		fmt.Printf("%-20s %-8s %-16s %-40s %-12s %-12s %s\n", status.Name, state, status.IPAddr.String(), endpoint, rx, tx, lastSeen)
+	}
+
 	return nil
 }
 
@@ -339,8 +434,16 @@ func CmdAdd(ctx context.Context, cmd *cli.Command) error {
 	}
 
 	name := cmd.StringArg("name")
+	addrs, err := pivpn.ParseAddrs(cmd.StringSlice("ip"))
+	if err != nil {
+		return err
+	}
+	expires, err := pivpn.ParseExpiry(cmd.String("expires"), time.Now())
+	if err != nil {
+		return err
+	}
 
-	err = vpn.AddClient(name)
+	err = vpn.AddClientWithMetadata(name, pivpn.Metadata{Expires: expires}, addrs...)
 	if err != nil {
 		return err
 	}
@@ -349,6 +452,173 @@ func CmdAdd(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
+func CmdRename(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name, newName := cmd.StringArg("name"), cmd.StringArg("new-name")
+	if err = vpn.RenameClient(name, newName); err != nil {
+		return err
+	}
+
+	fmt.Printf("client %s renamed to %s\n", name, newName)
+	return nil
+}
+
+func CmdAdopt(ctx context.Context, cmd *cli.Command) error {
+	// not loaded, as the unmanaged peers make it fail
+	vpn, _, err := newVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	peer := cmd.StringArg("peer")
+	if peer == "" {
+		peers, err := vpn.UnmanagedPeers()
+		if err != nil {
+			return err
+		}
+		if len(peers) == 0 {
+			fmt.Printf("%s\n", "::: No unmanaged peers :::")
+			return nil
+		}
+		fmt.Printf("%s\n", "::: Unmanaged peers :::")
+		fmt.Printf("%-20s %-49s %s\n", "Peer", "Public key", "Allowed IPs")
+		for _, p := range peers {
+			name := p.Name
+			if name == "" {
+				name = "-"
+			}
+			ips := make([]string, len(p.AllowedIPs))
+			for i, ip := range p.AllowedIPs {
+				ips[i] = ip.String()
+			}
+			fmt.Printf("%-20s %-49s %s\n", name, p.PublicKey.String(), strings.Join(ips, ", "))
+		}
+		return nil
+	}
+
+	name := cmd.String("name")
+	if name == "" {
+		if _, err := wireguard.ParseKeyBase64(peer); err == nil {
+			return errors.New("the peer is given by its public key, name the client with --name")
+		}
+		name = peer
+	}
+	if err = vpn.AdoptPeer(peer, name); err != nil {
+		return err
+	}
+
+	if vpn.Clients.Client(name).External() {
+		fmt.Printf("peer %s adopted as %s, with an external key: its configuration can't be exported\n", peer, name)
+	} else {
+		fmt.Printf("peer %s adopted as %s\n", peer, name)
+	}
+	return nil
+}
+
+func CmdRotate(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := cmd.StringArg("name")
+	if vpn.Clients.Client(name) == nil {
+		return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+	}
+	if !cmd.Bool("yes") {
+		l, err := promptf("Rotate the keys of %s? Its current configuration will stop working. [y/N] ", name)
+		if err != nil {
+			return err
+		}
+		if l = strings.ToLower(strings.TrimSpace(l)); len(l) == 0 || l[0] != 'y' {
+			return nil
+		}
+	}
+
+	if err = vpn.RotateClientKeys(name, cmd.Bool("psk-only")); err != nil {
+		return err
+	}
+
+	fmt.Printf("keys of %s rotated, import its configuration again (`manager qr %s` or `manager export %s`)\n", name, name, name)
+	return nil
+}
+
+func CmdExpire(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := cmd.StringArg("name")
+	client := vpn.Clients.Client(name)
+	if client == nil {
+		return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+	}
+	meta := client.Meta
+	if meta.Expires, err = pivpn.ParseExpiry(cmd.StringArg("expiry"), time.Now()); err != nil {
+		return err
+	}
+	if err = vpn.SetClientMetadata(name, meta); err != nil {
+		return err
+	}
+
+	if meta.Expires.IsZero() {
+		fmt.Printf("client %s no longer expires\n", name)
+	} else {
+		fmt.Printf("client %s expires on %s\n", name, meta.Expires.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+func CmdMeta(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := cmd.StringArg("name")
+	client := vpn.Clients.Client(name)
+	if client == nil {
+		return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+	}
+
+	meta := client.Meta
+	meta.Tags = slices.Clone(meta.Tags)
+	changed := false
+	for flag, field := range map[string]*string{"owner": &meta.Owner, "email": &meta.Email, "description": &meta.Description} {
+		if cmd.IsSet(flag) {
+			*field, changed = strings.TrimSpace(cmd.String(flag)), true
+		}
+	}
+	if cmd.IsSet("tag") {
+		meta.Tags, changed = append(meta.Tags, cmd.StringSlice("tag")...), true
+	}
+	if cmd.IsSet("untag") {
+		untag := pivpn.NormalizeTags(cmd.StringSlice("untag"))
+		meta.Tags, changed = slices.DeleteFunc(meta.Tags, func(t string) bool { return slices.Contains(untag, t) }), true
+	}
+	if changed {
+		if err = vpn.SetClientMetadata(name, meta); err != nil {
+			return err
+		}
+		meta = vpn.Clients.Client(name).Meta
+	}
+
+	fmt.Printf("%-12s %s\n", "Client:", name)
+	fmt.Printf("%-12s %s\n", "Owner:", meta.Owner)
+	fmt.Printf("%-12s %s\n", "Email:", meta.Email)
+	fmt.Printf("%-12s %s\n", "Description:", meta.Description)
+	fmt.Printf("%-12s %s\n", "Tags:", strings.Join(meta.Tags, ", "))
+	if !meta.Expires.IsZero() {
+		fmt.Printf("%-12s %s\n", "Expires:", meta.Expires.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
 func CmdSync(ctx context.Context, cmd *cli.Command) error {
 	vpn, err := getVpn(cmd)
 	if err != nil {
@@ -368,6 +638,355 @@ func CmdSync(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
+type exportFile struct {
+	name    string
+	content string
+}
+
+func exportClient(cmd *cli.Command, client *pivpn.Client, iface string) ([]exportFile, error) {
+	if client.External() {
+		return nil, fmt.Errorf("%w: %s", pivpn.ErrExternalKey, client.Name)
+	}
+	switch cmd.String("format") {
+	case "conf":
+		return []exportFile{{iface + ".conf", client.Export()}}, nil
+	case "networkd":
+		return []exportFile{
+			{iface + ".netdev", client.ExportNetdev(iface)},
+			{iface + ".network", client.ExportNetwork(iface)},
+		}, nil
+	case "nm":
+		return []exportFile{{iface + ".nmconnection", client.ExportNMConnection(iface, cmd.Bool("autoconnect"))}}, nil
+	case "mobileconfig":
+		platform := wireguard.MobileConfigPlatform(cmd.String("platform"))
+		if platform != wireguard.MobileConfigIOS && platform != wireguard.MobileConfigMacOS {
+			return nil, fmt.Errorf("unknown platform %q", platform)
+		}
+		return []exportFile{{iface + ".mobileconfig", client.ExportMobileConfig(iface, wireguard.MobileConfigOptions{
+			Platform:     platform,
+			OnDemand:     cmd.Bool("on-demand"),
+			TrustedSSIDs: cmd.StringSlice("trusted-ssid"),
+		})}}, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", cmd.String("format"))
+	}
+}
+
+func CmdExport(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := cmd.StringArg("name")
+	client := vpn.Clients.Client(name)
+	if client == nil {
+		return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+	}
+
+	iface := cmd.String("interface")
+	if iface == "" {
+		iface = vpn.Name()
+	}
+	if err := wireguard.ValidateInterfaceName(iface); err != nil {
+		return err
+	}
+	files, err := exportClient(cmd, client, iface)
+	if err != nil {
+		return err
+	}
+
+	dir := cmd.String("output")
+	for i, file := range files {
+		if dir != "" {
+			// the files hold the private key of the client
+			path := filepath.Join(dir, file.name)
+			if err := os.WriteFile(path, []byte(file.content), 0600); err != nil {
+				return err
+			}
+			fmt.Printf("%s written\n", path)
+			continue
+		}
+		if len(files) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n", file.name)
+		}
+		fmt.Print(file.content)
+	}
+
+	return nil
+}
+
+func CmdQr(ctx context.Context, cmd *cli.Command) error {
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := cmd.StringArg("name")
+	client := vpn.Clients.Client(name)
+	if client == nil {
+		return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+	}
+	if client.External() {
+		return fmt.Errorf("%w: %s", pivpn.ErrExternalKey, name)
+	}
+
+	out := io.Writer(os.Stdout)
+	if path := cmd.String("output"); path != "" {
+		// the QR code holds the private key of the client
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close() //nolint:errcheck
+		out = file
+	}
+
+	switch format := cmd.String("format"); format {
+	case "terminal":
+		return client.WriteQrCodeTerminal(out, cmd.Bool("invert"))
+	case "svg":
+		return client.WriteQrCodeSVG(out, int(cmd.Int("size")))
+	case "png":
+		return client.WriteQrCode(out, int(cmd.Int("size")))
+	default:
+		return fmt.Errorf("unknown QR code format %q", format)
+	}
+}
+
+func CmdLint(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.StringArg("file")
+	if path == "" {
+		cfg, err := loadConfig(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+		if cfg, err = cfg.ForPiVPN(cmd.String("tunnel")); err != nil {
+			return err
+		}
+		path = filepath.Join(cfg.PiVPNConfig.TunnelDirectory, cfg.PiVPNConfig.Name+".conf")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+
+	conf, err := wireguard.ParseConfig(file, strings.TrimSuffix(filepath.Base(path), ".conf"))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	err = conf.Validate()
+	if errs, ok := errors.AsType[wireguard.ValidationErrors](err); ok {
+		for _, e := range errs {
+			fmt.Printf("%s:%d: %s: %s\n", path, e.Line, e.Why, e.Offender)
+		}
+		return fmt.Errorf("%d problem(s) found in %s", len(errs), path)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: ok\n", path)
+	return nil
+}
+
+func CmdDoctor(ctx context.Context, cmd *cli.Command) error {
+	vpn, _, err := newVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	fix, prune := cmd.Bool("fix"), cmd.Bool("prune")
+	problems, err := vpn.Doctor(fix || prune, prune)
+	unfixed := 0
+	for _, problem := range problems {
+		switch {
+		case problem.Fixed:
+			fmt.Printf("[fixed] %s\n", problem)
+		case problem.Fixable && !fix && !prune:
+			fmt.Printf("[fixable] %s\n", problem)
+			unfixed++
+		case problem.Kind.Prunable() && !prune:
+			fmt.Printf("[prunable] %s\n", problem)
+			unfixed++
+		default:
+			fmt.Printf("[manual] %s\n", problem)
+			unfixed++
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if unfixed > 0 {
+		return fmt.Errorf("%d problem(s) found in %s", unfixed, vpn.Name())
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", vpn.Name())
+	}
+	return nil
+}
+
+func CmdBackup(ctx context.Context, cmd *cli.Command) error {
+	vpn, _, err := newVpn(cmd)
+	if err != nil {
+		return err
+	}
+	backup, err := vpn.Backup(version.RawVersion())
+	if err != nil {
+		return err
+	}
+
+	path := cmd.String("output")
+	if path == "" {
+		path = backup.FileName()
+	}
+	if path == "-" {
+		return backup.Write(os.Stdout)
+	}
+	// the backup holds the private keys of the server and clients
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = backup.Write(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("backed up %s with %d client(s) to %s\n", backup.Manifest.Tunnel, len(backup.Clients()), path)
+	return nil
+}
+
+func CmdImport(ctx context.Context, cmd *cli.Command) error {
+	path := cmd.StringArg("file")
+	if path == "" {
+		return errors.New("the CSV file is required, or - to read it from stdin")
+	}
+	vpn, err := getVpn(cmd)
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close() //nolint:errcheck
+		in = file
+	}
+	specs, err := pivpn.ParseClientsCSV(in, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		return errors.New("no clients to import")
+	}
+
+	dryRun := cmd.Bool("dry-run")
+	results, err := vpn.AddClients(specs, dryRun)
+	fmt.Printf("%-6s %-16s %-40s %s\n", "Line", "Client", "Addresses", "Result")
+	for _, result := range results {
+		addresses := make([]string, len(result.Addresses))
+		for i, address := range result.Addresses {
+			addresses[i] = address.String()
+		}
+		status := "created"
+		switch {
+		case result.Err != nil:
+			status = result.Err.Error()
+		case errors.Is(err, pivpn.ErrBatchFailed):
+			status = "valid"
+		case dryRun:
+			status = "would be created"
+		}
+		fmt.Printf("%-6d %-16s %-40s %s\n", result.Line, result.Name, strings.Join(addresses, ", "), status)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("dry run: %d client(s) would be created\n", len(results))
+	} else {
+		fmt.Printf("%d client(s) created\n", len(results))
+	}
+	return nil
+}
+
+func CmdRestore(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd.String("config"))
+	if err != nil {
+		return err
+	}
+	if cfg, err = cfg.ForPiVPN(cmd.String("tunnel")); err != nil {
+		return err
+	}
+
+	file, err := os.Open(cmd.StringArg("file"))
+	if err != nil {
+		return err
+	}
+	backup, err := pivpn.ReadBackup(file)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup of %s with %d client(s), made on %s by manager %s\n", backup.Manifest.Tunnel,
+		len(backup.Clients()), backup.Manifest.Created.Local().Format(time.DateTime), backup.Manifest.Version)
+	if !cmd.Bool("yes") {
+		l, err := promptf("Replace %s with the backup? [y/N] ", cfg.PiVPNConfig.Name)
+		if err != nil {
+			return err
+		}
+		if l = strings.ToLower(strings.TrimSpace(l)); len(l) == 0 || l[0] != 'y' {
+			return nil
+		}
+	}
+
+	warnings, err := backup.Restore(
+		cfg.PiVPNConfig.Name,
+		cfg.PiVPNConfig.ConfigFilePath,
+		cfg.PiVPNConfig.TunnelDirectory,
+		cfg.PiVPNConfig.ConfigsDirectory,
+		cfg.PiVPNConfig.KeysDirectory,
+	)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Printf("[warning] %s\n", warning)
+	}
+
+	vpn, _, err := newVpn(cmd)
+	if err != nil {
+		return err
+	}
+	vpn.SetTolerant(true)
+	if err = vpn.Reload(); err != nil {
+		return err
+	}
+	if err = vpn.SyncTunnel(); err != nil {
+		return err
+	}
+	if err = vpn.SyncPihole(); err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s, run `manager doctor --fix` to recreate the copies of the client configs in the install home\n", vpn.Name())
+	return nil
+}
+
 func main() {
 	cmd := &cli.Command{
 		Name:                  "manager",
@@ -381,12 +1000,34 @@ func main() {
 				Value:   DefaultConfigPath,
 				Usage:   "Load configuration from `FILE`",
 			},
+			&cli.StringFlag{
+				Name:  "tunnel",
+				Usage: "Manage the PiVPN tunnel `NAME` of a manager with several tunnels",
+			},
 		},
 		Commands: []*cli.Command{
 			{
 				Name:   "list",
 				Usage:  "List the vpn clients",
 				Action: CmdListClients,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "tag",
+						Usage: "Only list the clients tagged `TAG`",
+					},
+				},
+			},
+			{
+				Name:    "status",
+				Aliases: []string{"c", "clients"},
+				Usage:   "Show the connection status of the vpn clients",
+				Action:  CmdStatus,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dump",
+						Usage: "Read the interface state from `FILE`, in the `wg show <iface> dump` format",
+					},
+				},
 			},
 			{
 				Name:    "disable",
@@ -462,6 +1103,113 @@ func main() {
 				Aliases: []string{"a", "make"},
 				Usage:   "Add a new client",
 				Action:  CmdAdd,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "ip",
+						Usage: "Assign `ADDRESS` to the client instead of the next free one, once per address family",
+					},
+					&cli.StringFlag{
+						Name:  "expires",
+						Usage: "Disable the client at `EXPIRY`: a duration (72h, 30d), a date (2006-01-02) or an RFC 3339 time",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+				},
+			},
+			{
+				Name:   "rename",
+				Usage:  "Rename a client, keeping its keys and addresses",
+				Action: CmdRename,
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+					&cli.StringArg{
+						Name: "new-name",
+					},
+				},
+			},
+			{
+				Name:      "adopt",
+				Usage:     "Bring a peer added to the tunnel by hand, given by its name or public key, under management; or list them",
+				ArgsUsage: "[PEER]",
+				Action:    CmdAdopt,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name the client `NAME`, required if the peer has no name",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "peer",
+					},
+				},
+			},
+			{
+				Name:   "rotate",
+				Usage:  "Generate new keys for a client, keeping its name and addresses",
+				Action: CmdRotate,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "psk-only",
+						Usage: "Only rotate the preshared key, keeping the private key",
+					},
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Rotate without confirmation",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+				},
+			},
+			{
+				Name:      "expire",
+				Usage:     "Change when a client gets disabled by the daemon",
+				ArgsUsage: "NAME EXPIRY|never",
+				Action:    CmdExpire,
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+					&cli.StringArg{
+						Name: "expiry",
+					},
+				},
+			},
+			{
+				Name:   "meta",
+				Usage:  "Show or change the owner, email, description and tags of a client",
+				Action: CmdMeta,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Set the owner of the client to `NAME`, empty to clear it",
+					},
+					&cli.StringFlag{
+						Name:  "email",
+						Usage: "Set the email of the owner to `ADDRESS`, empty to clear it",
+					},
+					&cli.StringFlag{
+						Name:  "description",
+						Usage: "Set the description of the client to `TEXT`, empty to clear it",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Add `TAG` to the client",
+					},
+					&cli.StringSliceFlag{
+						Name:  "untag",
+						Usage: "Remove `TAG` from the client",
+					},
+				},
 				Arguments: []cli.Argument{
 					&cli.StringArg{
 						Name: "name",
@@ -473,6 +1221,154 @@ func main() {
 				Usage:  "Re-synchronise the tunnel and clients",
 				Action: CmdSync,
 			},
+			{
+				Name:   "export",
+				Usage:  "Export the configuration of a client",
+				Action: CmdExport,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Value:   "conf",
+						Usage:   "Export in `FORMAT`, one of conf (wg-quick), networkd (systemd-networkd .netdev and .network units), nm (NetworkManager keyfile) or mobileconfig (Apple configuration profile)",
+					},
+					&cli.BoolFlag{
+						Name:  "autoconnect",
+						Usage: "Connect automatically, for the nm format",
+					},
+					&cli.StringFlag{
+						Name:  "platform",
+						Value: string(wireguard.MobileConfigIOS),
+						Usage: "Target the WireGuard app of `PLATFORM`, ios or macos, for the mobileconfig format",
+					},
+					&cli.BoolFlag{
+						Name:  "on-demand",
+						Usage: "Connect on demand, for the mobileconfig format",
+					},
+					&cli.StringSliceFlag{
+						Name:  "trusted-ssid",
+						Usage: "Don't connect on demand on the Wi-Fi network `SSID`, for the mobileconfig format",
+					},
+					&cli.StringFlag{
+						Name:    "interface",
+						Aliases: []string{"i"},
+						Usage:   "Name the client interface `NAME`, defaults to the tunnel name",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the files to `DIR` instead of the standard output",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+				},
+			},
+			{
+				Name:   "qr",
+				Usage:  "Show the configuration of a client as a QR code",
+				Action: CmdQr,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Value:   "terminal",
+						Usage:   "Render in `FORMAT`, one of terminal, svg or png",
+					},
+					&cli.BoolFlag{
+						Name:  "invert",
+						Usage: "Invert the colors, for terminals with a light background",
+					},
+					&cli.IntFlag{
+						Name:  "size",
+						Value: 8,
+						Usage: "Make each module `SIZE` pixels wide (svg) or the image SIZE pixels wide (png)",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the QR code to `FILE` instead of the standard output",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "name",
+					},
+				},
+			},
+			{
+				Name:   "lint",
+				Usage:  "Check a tunnel configuration for problems, defaults to the managed tunnel",
+				Action: CmdLint,
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "file",
+					},
+				},
+			},
+			{
+				Name:   "doctor",
+				Usage:  "Check the PiVPN files for inconsistencies between the tunnel, clients.txt, configs and keys",
+				Action: CmdDoctor,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "fix",
+						Usage: "Repair the problems which can be fixed automatically",
+					},
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "Repair the problems, moving the configurations and keys without a peer to " + pivpn.OrphansDirName + " in the configs dir",
+					},
+				},
+			},
+			{
+				Name:   "backup",
+				Usage:  "Archive the PiVPN files of the tunnel, its clients and keys",
+				Action: CmdBackup,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the archive to `FILE`, - for the standard output, defaults to <tunnel>-<date>.tar.gz",
+					},
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "Create the clients of a CSV file (name, ip, tags, expires, owner) at once, or none if any is invalid",
+				ArgsUsage: "FILE|-",
+				Action:    CmdImport,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only check the clients, and show the addresses they would get",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "file",
+					},
+				},
+			},
+			{
+				Name:   "restore",
+				Usage:  "Replace the PiVPN files with a backup, in the configured locations",
+				Action: CmdRestore,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "yes",
+						Aliases: []string{"y"},
+						Usage:   "Restore without confirmation",
+					},
+				},
+				Arguments: []cli.Argument{
+					&cli.StringArg{
+						Name: "file",
+					},
+				},
+			},
 			{
 				Name:   "daemon",
 				Usage:  "Run the remote vpn management daemon",
@@ -484,5 +1380,6 @@ func main() {
 
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
 		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
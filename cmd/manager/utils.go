@@ -29,6 +29,19 @@ func promptf(prompt string, args ...any) (string, error) {
 	return reader.ReadString('\n')
 }
 
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func isNumeric(s string) bool {
 	for _, r := range s {
 		if !unicode.IsDigit(r) {
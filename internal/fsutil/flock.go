@@ -0,0 +1,52 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const lockPollInterval = 50 * time.Millisecond
+
+var ErrLockTimeout = errors.New("timed out waiting for the lock")
+
+// Lock is an advisory lock on a file, shared between processes.
+type Lock struct {
+	file *os.File
+}
+
+// LockFile takes the lock on path, exclusive or shared, waiting up to timeout for the other holders to release it.
+func LockFile(path string, exclusive bool, timeout time.Duration) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return &Lock{file}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			_ = file.Close()
+			return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+		}
+		if time.Now().After(deadline) {
+			_ = file.Close()
+			return nil, fmt.Errorf("%w: %s is held by another process after %s", ErrLockTimeout, path, timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (l *Lock) Unlock() error {
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return errors.Join(err, l.file.Close())
+}
@@ -0,0 +1,54 @@
+package fsutil
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      bool
+		exclusive bool
+		wantErr   bool
+	}{
+		{"shared with shared", false, false, false},
+		{"exclusive with shared", false, true, true},
+		{"shared with exclusive", true, false, true},
+		{"exclusive with exclusive", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.lock")
+			held, err := LockFile(path, tt.held, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock, err := LockFile(path, tt.exclusive, 100*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LockFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrLockTimeout) {
+					t.Errorf("LockFile() error = %v, want %v", err, ErrLockTimeout)
+				}
+			} else if err = lock.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the lock is acquired once released
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_ = held.Unlock()
+			}()
+			lock, err = LockFile(path, true, time.Second)
+			if err != nil {
+				t.Fatalf("LockFile() after release error = %v", err)
+			}
+			_ = lock.Unlock()
+		})
+	}
+}
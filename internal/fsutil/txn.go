@@ -0,0 +1,212 @@
+package fsutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// fileChange is a staged write or removal of a file.
+type fileChange struct {
+	path   string
+	data   []byte
+	perm   fs.FileMode
+	remove bool
+	// owner is the uid and gid of the written file, nil to keep the owner of the file being replaced.
+	owner *[2]int
+}
+
+// fileBackup is the state of a file before a change was applied, to roll it back.
+type fileBackup struct {
+	path   string
+	exists bool
+	data   []byte
+	perm   fs.FileMode
+	owner  *[2]int
+}
+
+// Transaction stages the file changes of a mutation, so that they are applied together and rolled back together.
+//
+// Each file is replaced atomically, by writing a temporary file which is synced then renamed over it. If a change
+// fails, or if the mutation fails after the commit, the changed files are restored to their previous content.
+type Transaction struct {
+	changes []fileChange
+	applied []fileBackup
+}
+
+func (tx *Transaction) WriteFile(path string, data []byte, perm fs.FileMode) {
+	tx.changes = append(tx.changes, fileChange{path: path, data: data, perm: perm})
+}
+
+// WriteFileOwned stages a write of a file which must belong to uid and gid.
+func (tx *Transaction) WriteFileOwned(path string, data []byte, perm fs.FileMode, uid, gid int) {
+	tx.changes = append(tx.changes, fileChange{path: path, data: data, perm: perm, owner: &[2]int{uid, gid}})
+}
+
+// Remove stages the removal of a file, a missing file is not an error.
+func (tx *Transaction) Remove(path string) {
+	tx.changes = append(tx.changes, fileChange{path: path, remove: true})
+}
+
+// Move stages the renaming of a file, keeping its mode and owner. A missing file is not an error.
+func (tx *Transaction) Move(from, to string) error {
+	backup, err := readBackup(from)
+	if err != nil || !backup.exists {
+		return err
+	}
+	tx.changes = append(tx.changes,
+		fileChange{path: to, data: backup.data, perm: backup.perm, owner: backup.owner},
+		fileChange{path: from, remove: true},
+	)
+	return nil
+}
+
+// Changed returns whether the commit changed the file.
+func (tx *Transaction) Changed(path string) bool {
+	for _, backup := range tx.applied {
+		if backup.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func fileOwner(info fs.FileInfo) *[2]int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return &[2]int{int(stat.Uid), int(stat.Gid)}
+	}
+	return nil
+}
+
+func readBackup(path string) (fileBackup, error) {
+	backup := fileBackup{path: path}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return backup, nil
+	} else if err != nil {
+		return backup, err
+	}
+	backup.data, err = os.ReadFile(path)
+	if err != nil {
+		return backup, err
+	}
+	backup.exists, backup.perm, backup.owner = true, info.Mode().Perm(), fileOwner(info)
+	return backup, nil
+}
+
+// writeFileAtomic replaces the file with data, through a synced temporary file renamed over it.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode, owner *[2]int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil && owner != nil {
+		err = tmp.Chown(owner[0], owner[1])
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close() //nolint:errcheck
+	return d.Sync()
+}
+
+func (tx *Transaction) apply(change fileChange) error {
+	backup, err := readBackup(change.path)
+	if err != nil {
+		return err
+	}
+
+	if change.remove {
+		if !backup.exists {
+			return nil
+		}
+		err = removeFile(change.path)
+	} else {
+		if backup.exists && backup.perm == change.perm && bytes.Equal(backup.data, change.data) && change.owner == nil {
+			return nil
+		}
+		owner := change.owner
+		if owner == nil {
+			owner = backup.owner
+		}
+		err = writeFileAtomic(change.path, change.data, change.perm, owner)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx.applied = append(tx.applied, backup)
+	return nil
+}
+
+// Commit applies the staged changes in order, skipping the files which wouldn't change.
+// If a change fails, the already applied ones are rolled back.
+func (tx *Transaction) Commit() error {
+	changes := tx.changes
+	tx.changes = nil
+	for _, change := range changes {
+		if err := tx.apply(change); err != nil {
+			err = fmt.Errorf("unable to write %s: %w", change.path, err)
+			if rerr := tx.Rollback(); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback restores the files changed by the commit, in the reverse order.
+func (tx *Transaction) Rollback() error {
+	var errs []error
+	for i := len(tx.applied) - 1; i >= 0; i-- {
+		backup := tx.applied[i]
+		var err error
+		if backup.exists {
+			err = writeFileAtomic(backup.path, backup.data, backup.perm, backup.owner)
+		} else {
+			err = removeFile(backup.path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to roll back %s: %w", backup.path, err))
+		}
+	}
+	tx.applied = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+package fsutil
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestTransaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		stage   func(tx *Transaction, dir string)
+		want    map[string]string
+		changed []string
+		wantErr bool
+	}{
+		{
+			"write and remove",
+			func(tx *Transaction, dir string) {
+				tx.WriteFile(filepath.Join(dir, "a"), []byte("new a"), 0644)
+				tx.WriteFile(filepath.Join(dir, "c"), []byte("c"), 0640)
+				tx.Remove(filepath.Join(dir, "b"))
+				tx.Remove(filepath.Join(dir, "missing"))
+			},
+			map[string]string{"a": "new a", "c": "c"},
+			[]string{"a", "b", "c"},
+			false,
+		},
+		{
+			"unchanged file",
+			func(tx *Transaction, dir string) {
+				tx.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+				tx.WriteFile(filepath.Join(dir, "b"), []byte("new b"), 0644)
+			},
+			map[string]string{"a": "a", "b": "new b"},
+			[]string{"b"},
+			false,
+		},
+		{
+			"failure rolls back",
+			func(tx *Transaction, dir string) {
+				tx.WriteFile(filepath.Join(dir, "a"), []byte("new a"), 0644)
+				tx.Remove(filepath.Join(dir, "b"))
+				tx.WriteFile(filepath.Join(dir, "c"), []byte("c"), 0644)
+				tx.WriteFile(filepath.Join(dir, "missing", "d"), []byte("d"), 0644)
+			},
+			map[string]string{"a": "a", "b": "b"},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range map[string]string{"a": "a", "b": "b"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx := &Transaction{}
+			tt.stage(tx, dir)
+			err := tx.Commit()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Commit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := readFiles(t, dir); !maps.Equal(got, tt.want) {
+				t.Errorf("Commit() files = %v, want %v", got, tt.want)
+			}
+			for _, name := range tt.changed {
+				if !tx.Changed(filepath.Join(dir, name)) {
+					t.Errorf("Changed(%s) = false, want true", name)
+				}
+			}
+
+			if err = tx.Rollback(); err != nil {
+				t.Fatalf("Rollback() error = %v", err)
+			}
+			if got, want := readFiles(t, dir), map[string]string{"a": "a", "b": "b"}; !maps.Equal(got, want) {
+				t.Errorf("Rollback() files = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTransactionKeepsMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	if err := os.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Transaction{}
+	tx.WriteFile(path, []byte("new a"), 0640)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Commit() mode = %v, %v, want %v", info.Mode().Perm(), err, fs.FileMode(0640))
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Rollback() mode = %v, %v, want %v", info.Mode().Perm(), err, fs.FileMode(0600))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"net/url"
 	"strings"
 
 	"magnax.ca/VPNManager/internal/version"
@@ -61,10 +62,11 @@ func versionStr() string {
 func NewStdlibEngine() (Engine, error) {
 	// wrap with custom: Stat,
 	tmplts, err := template.New("").Funcs(template.FuncMap{
-		"crumbs":  crumbs,
-		"join":    join,
-		"max":     maxInts,
-		"version": versionStr,
+		"crumbs":     crumbs,
+		"join":       join,
+		"max":        maxInts,
+		"pathescape": url.PathEscape,
+		"version":    versionStr,
 	}).ParseFS(TemplatesFS, "*.html.tpl")
 	if err != nil {
 		return nil, err
@@ -12,41 +12,107 @@
 
     <h1>{{ .Title }}</h1>
 
-    {{ template "breadcrumbs" (crumbs "Tunnels" "/tunnels" .TunnelName (join "" "/tunnel/" .TunnelName) .Client.Name nil) }}
+    {{ template "breadcrumbs" (crumbs "Tunnels" "/tunnels" .TunnelName (join "" "/tunnel/" (pathescape .TunnelName)) .Client.Name nil) }}
+
+    {{ if .Notice -}}
+    <div class="modal success">{{ .Notice }}</div>
+    {{ end -}}
 
     <div class="grid">
         <div class="col config">
             <div>
+                {{ if .Client.External -}}
+                <div class="modal warning">This client was adopted without its private key: its configuration is unavailable. Rotate its keys to give it a new configuration.</div>
+                <p>Public key: <code>{{ .Client.PublicKey }}</code></p>
+                {{ else -}}
                 <pre><code>{{ .Client.Export }}</code></pre>
+                {{ end -}}
+                {{ if not .Client.Meta.Expires.IsZero -}}
+                <p>Expires on {{ .Client.Meta.Expires.Local.Format "2006-01-02 15:04" }}</p>
+                {{ end -}}
+                {{ with .Client.Meta -}}
+                {{ if .Owner }}<p>Owner: {{ .Owner }}{{ if .Email }} &lt;<a href="mailto:{{ .Email }}">{{ .Email }}</a>&gt;{{ end }}</p>{{ end }}
+                {{ if .Description }}<p>{{ .Description }}</p>{{ end }}
+                {{ if .Tags }}<p>Tags:{{ range .Tags }} <span class="muted">{{ . }}</span>{{ end }}</p>{{ end }}
+                {{- end }}
             </div>
             <div class="grid text-center">
+                {{ if not .Client.External -}}
                 <div class="col">
-                    <a class="pure-button button-success" href="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}/conf">Download Config</a>
+                    <a class="pure-button button-success" href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/conf">Download Config</a>
+                    <p>
+                        systemd-networkd:
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/netdev">.netdev</a>
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/network">.network</a>
+                        <br>
+                        NetworkManager:
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/nmconnection">.nmconnection</a>
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/nmconnection?autoconnect=true">(autoconnect)</a>
+                        <br>
+                        Apple profile:
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/mobileconfig?platform=ios">iOS</a>
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/mobileconfig?platform=macos">macOS</a>
+                        <a href="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/mobileconfig?platform=ios&ondemand=true">(on demand)</a>
+                    </p>
                 </div>
+                {{ end -}}
                 <div class="col">
                     {{ if .Client.Disabled -}}
-                        <form action="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}/enable" method="POST"
+                        <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/enable" method="POST"
                               class="pure-form"><input type="hidden" name="next"
-                                                       value="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}"><input
+                                                       value="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}"><input
                                     type="submit" value="Enable" class="pure-button button-success"></form>
                     {{ else -}}
-                        <form action="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}/disable" method="POST"
+                        <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/disable" method="POST"
                               class="pure-form"><input type="hidden" name="next"
-                                                       value="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}"><input
+                                                       value="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}"><input
                                     type="submit" value="Disable" class="pure-button button-warning"></form>
                     {{- end }}
                 </div>
                 <div class="col">
-                    <form action="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}/remove" method="POST"
+                    <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/remove" method="POST"
                           class="pure-form"><input type="submit" value="Remove" class="pure-button button-error">
                     </form>
                 </div>
             </div>
+            <div id="rotate">
+                <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/rotate" method="POST" class="pure-form">
+                    {{ if not .Client.External -}}
+                    <label><input type="checkbox" name="psk_only" value="true"> Preshared key only</label>
+                    {{ end -}}
+                    <button class="pure-button button-warning" type="submit">Rotate Keys</button>
+                </form>
+            </div>
+            <div id="rename">
+                <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/rename" method="POST" class="pure-form">
+                    <!--suppress HtmlFormInputWithoutLabel -->
+                    {{ if .Error -}}
+                    <div class="modal danger">{{ .Error }}</div>
+                    {{ end -}}
+                    <input type="text" name="name" minlength="1" maxlength="15" placeholder="New Name" required{{ if .FormValue }} value="{{ .FormValue }}"{{ end }}>
+                    <button class="pure-button" type="submit">Rename</button>
+                </form>
+            </div>
+            <div id="meta">
+                <form action="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/meta" method="POST" class="pure-form pure-form-stacked">
+                    {{ if .MetaError -}}
+                    <div class="modal danger">{{ .MetaError }}</div>
+                    {{ end -}}
+                    <label>Owner <input type="text" name="owner" value="{{ .Client.Meta.Owner }}"></label>
+                    <label>Email <input type="email" name="email" value="{{ .Client.Meta.Email }}"></label>
+                    <label>Description <input type="text" name="description" value="{{ .Client.Meta.Description }}"></label>
+                    <label>Tags <input type="text" name="tags" placeholder="laptop, staff" value="{{ range $i, $tag := .Client.Meta.Tags }}{{ if $i }}, {{ end }}{{ $tag }}{{ end }}"></label>
+                    <label>Expires <input type="text" name="expires" placeholder="never, 30d or 2006-01-02" value="{{ if .FormExpiry }}{{ .FormExpiry }}{{ else if not .Client.Meta.Expires.IsZero }}{{ .Client.Meta.Expires.Local.Format "2006-01-02T15:04:05Z07:00" }}{{ end }}"></label>
+                    <button class="pure-button" type="submit">Save</button>
+                </form>
+            </div>
         </div>
+        {{ if not .Client.External -}}
         <div class="col first">
-            <img src="/tunnel/{{ .TunnelName }}/{{ .Client.Name }}/qr.png"
+            <img src="/tunnel/{{ pathescape .TunnelName }}/{{ .Client.Name }}/qr.svg" class="qr"
                  alt="configuration QR code for {{ .Client.Name }}">
         </div>
+        {{ end -}}
     </div>
 
     <footer>{{ version }}</footer>
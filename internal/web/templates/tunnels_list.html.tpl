@@ -26,13 +26,13 @@
                 {{ range $name, $tunnel := .Tunnels }}
                     <tr class="tunnel_row">
                     <td rowspan="{{ max (len $tunnel.Clients) 1 }}"><a
-                                href="/tunnel/{{ $name }}">{{ $name }}</a><br><code>{{ $tunnel.Endpoint.String }}</code></td>
+                                href="/tunnel/{{ pathescape $name }}">{{ $name }}</a>{{ if $tunnel.Warnings }} <small class="warning-text">(has problems)</small>{{ end }}<br><code>{{ $tunnel.Endpoint.String }}</code></td>
                     {{ range $i, $client := $tunnel.Clients }}
                         {{ if $i }}
                             </tr>
                             <tr>
                         {{ end }}
-                        <td><a href="/tunnel/{{ $name }}/{{ $client.Name }}">{{ $client.Name }}</a>{{ if $client.Disabled }} <small class="muted">(DISABLED)</small>{{ end }}</td>
+                        <td><a href="/tunnel/{{ pathescape $name }}/{{ $client.Name }}">{{ $client.Name }}</a>{{ if $client.Disabled }} <small class="muted">(DISABLED)</small>{{ end }}</td>
                     {{ else }}
                         <td></td>
                     {{ end }}
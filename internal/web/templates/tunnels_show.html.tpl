@@ -14,41 +14,96 @@
 
     {{ template "breadcrumbs" (crumbs "Tunnels" "/tunnels" .TunnelName nil) }}
 
+    {{ if .Tunnel.Warnings -}}
+    <div class="modal warning">
+        This tunnel has problems, the broken clients are not shown. Run <code>manager doctor</code> on the server to repair it.
+        <ul>
+            {{ range .Tunnel.Warnings }}
+                <li>{{ if .Client }}<strong>{{ .Client }}</strong>: {{ end }}{{ .Message }}</li>
+            {{ end }}
+        </ul>
+    </div>
+    {{ end -}}
+
+    {{ if .Tunnel.Expiring -}}
+    <div class="modal warning">
+        These clients expire soon, they will be disabled:
+        <ul>
+            {{ range .Tunnel.Expiring }}
+                <li><strong>{{ .Client }}</strong>: {{ .Expires.Local.Format "2006-01-02 15:04" }}</li>
+            {{ end }}
+        </ul>
+    </div>
+    {{ end -}}
 
     <div class="grid">
         <div class="col config">
             <pre><code>{{ .Tunnel.Server.Export }}</code></pre>
+            <p><a class="pure-button" href="/tunnel/{{ pathescape .TunnelName }}/-/backup.tar.gz">Download Backup</a></p>
+            {{ if .Changes -}}
+            <div id="changes">
+                <h2>Latest changes <small class="muted">({{ .Changes.Time.Format "2006-01-02 15:04:05" }})</small></h2>
+                <ul>
+                    {{ range .Changes.Diff.Lines }}
+                        <li><code>{{ . }}</code></li>
+                    {{ end }}
+                </ul>
+            </div>
+            {{ end -}}
         </div>
         <div class="col first">
             {{ $tunnelName := .TunnelName -}}
             <div id="add">
-                <form action="/tunnel/{{ $tunnelName }}/create" method="POST" class="pure-form">
+                <form action="/tunnel/{{ pathescape $tunnelName }}/create" method="POST" class="pure-form">
                     <!--suppress HtmlFormInputWithoutLabel -->
                     {{ if .Error -}}
                     <div class="modal danger">{{ .Error }}</div>
                     {{ end -}}
                     <input type="text" name="name" minlength="1" maxlength="15" placeholder="Client Name" required{{ if .FormValue }} value="{{ .FormValue }}"{{ end }}>
+                    <input type="text" name="addresses" placeholder="Address (optional)"{{ if .FormAddr }} value="{{ .FormAddr }}"{{ end }}>
+                    <input type="text" name="expires" placeholder="Expires (optional, 30d or 2006-01-02)"{{ if .FormExpiry }} value="{{ .FormExpiry }}"{{ end }}>
                     <button class="pure-button pure-button-primary" type="submit">Add</button>
                 </form>
             </div>
+            <div id="import">
+                <form action="/tunnel/{{ pathescape $tunnelName }}/import" method="POST" enctype="multipart/form-data" class="pure-form">
+                    {{ if .ImportError -}}
+                    <div class="modal danger">{{ .ImportError }}</div>
+                    {{ else if .ImportResults -}}
+                    <div class="modal {{ if .ImportFailed }}danger{{ else }}success{{ end }}">
+                        {{ if .ImportFailed }}No client was created:{{ else if .ImportDryRun }}These clients would be created:{{ else }}These clients were created:{{ end }}
+                        <ul>
+                            {{ range .ImportResults }}
+                                <li>line {{ .Line }}: <strong>{{ .Name }}</strong>{{ range .Addresses }} {{ . }}{{ end }}{{ if .Err }}: {{ .Err }}{{ end }}</li>
+                            {{ end }}
+                        </ul>
+                    </div>
+                    {{ end -}}
+                    <!--suppress HtmlFormInputWithoutLabel -->
+                    <textarea name="csv" rows="4" placeholder="name,ip,tags,expires,owner">{{ .FormCSV }}</textarea>
+                    <input type="file" name="file" accept=".csv,text/csv">
+                    <label><input type="checkbox" name="dry_run" value="true"{{ if .ImportDryRun }} checked{{ end }}> Dry run</label>
+                    <button class="pure-button" type="submit">Import</button>
+                </form>
+            </div>
             <div id="clients">
                 <table class="pure-table-striped">
                     {{ range $client := .Tunnel.Clients }}
                         <tr>
-                            <td><a href="/tunnel/{{ $tunnelName }}/{{ $client.Name }}">{{ $client.Name }}</a></td>
+                            <td><a href="/tunnel/{{ pathescape $tunnelName }}/{{ $client.Name }}">{{ $client.Name }}</a>{{ if $client.External }} <small class="muted">(external key)</small>{{ end }}{{ if not $client.Meta.Expires.IsZero }} <small class="muted">(expires {{ $client.Meta.Expires.Local.Format "2006-01-02" }})</small>{{ end }}{{ with $client.Meta.Owner }} <small class="muted">{{ . }}</small>{{ end }}{{ range $client.Meta.Tags }} <small class="muted">#{{ . }}</small>{{ end }}</td>
                             <td>
                                 {{ if $client.Disabled -}}
-                                    <form action="/tunnel/{{ $tunnelName }}/{{ $client.Name }}/enable" method="POST"
+                                    <form action="/tunnel/{{ pathescape $tunnelName }}/{{ $client.Name }}/enable" method="POST"
                                           class="pure-form"><input type="submit" value="Enable"
                                                                    class="pure-button button-success"></form>
                                 {{ else -}}
-                                    <form action="/tunnel/{{ $tunnelName }}/{{ $client.Name }}/disable" method="POST"
+                                    <form action="/tunnel/{{ pathescape $tunnelName }}/{{ $client.Name }}/disable" method="POST"
                                           class="pure-form"><input type="submit" value="Disable"
                                                                    class="pure-button button-warning"></form>
                                 {{- end }}
                             </td>
                             <td>
-                                <form action="/tunnel/{{ $tunnelName }}/{{ $client.Name }}/remove" method="POST"
+                                <form action="/tunnel/{{ pathescape $tunnelName }}/{{ $client.Name }}/remove" method="POST"
                                       class="pure-form"><input type="submit" value="Remove"
                                                                class="pure-button button-error"></form>
                             </td>
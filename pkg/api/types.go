@@ -3,6 +3,8 @@ package api
 //go:generate go tool msgp
 
 import (
+	"time"
+
 	"github.com/tinylib/msgp/msgp"
 
 	"magnax.ca/VPNManager/pkg/pivpn"
@@ -13,6 +15,27 @@ type Tunnel struct {
 	Endpoint wireguard.Endpoint `msg:"endpoint"`
 	Server   wireguard.Config   `msg:"server"`
 	Clients  pivpn.ClientList   `msg:"clients"`
+	// Warnings are the problems found while loading the tunnel, the broken clients are missing from Clients.
+	Warnings []Warning `msg:"warnings,omitempty"`
+	// Expiring are the enabled clients which expire soon, soonest first.
+	Expiring []Expiry `msg:"expiring,omitempty"`
+}
+
+// Update is the response to an UpdateRequest without tunnel, from a manager of several tunnels (protocol 1).
+type Update struct {
+	// Tunnels are the tunnels of the manager by name, the ones which couldn't be loaded only have a warning.
+	Tunnels map[string]Tunnel `msg:"tunnels"`
+}
+
+type Expiry struct {
+	Client  string    `msg:"client"`
+	Expires time.Time `msg:"expires"`
+}
+
+type Warning struct {
+	// Client is the name of the client concerned, if any.
+	Client  string `msg:"client,omitempty"`
+	Message string `msg:"message"`
 }
 
 type RequestType int
@@ -23,16 +46,27 @@ const (
 	DeletePeerRequest
 	EnablePeerRequest
 	DisablePeerRequest
+	BackupRequest
+	RenamePeerRequest
+	RotatePeerRequest
+	SetMetadataRequest
+	ImportRequest
 )
 
 type Request struct {
 	Type RequestType `msg:"type"`
 	ID   uint64      `msg:"id,omitempty"`
-	Data msgp.Raw    `msg:"data,omitempty"`
+	// Tunnel is the tunnel of the manager the request is for, always empty with the protocol 0.
+	Tunnel string   `msg:"tunnel,omitempty"`
+	Data   msgp.Raw `msg:"data,omitempty"`
 }
 
 type CreateRequestData struct {
 	Name string `msg:"name"`
+	// Addresses are the requested addresses of the client, the other ones are allocated automatically.
+	Addresses []string `msg:"addresses,omitempty"`
+	// Expires is when the client gets disabled, zero if it doesn't expire.
+	Expires time.Time `msg:"expires"`
 }
 
 type DeleteRequestData struct {
@@ -47,6 +81,49 @@ type DisableRequestData struct {
 	Name string `msg:"name"`
 }
 
+type RenameRequestData struct {
+	Name    string `msg:"name"`
+	NewName string `msg:"new_name"`
+}
+
+type RotateRequestData struct {
+	Name string `msg:"name"`
+	// PSKOnly only rotates the preshared key, keeping the private key.
+	PSKOnly bool `msg:"psk_only,omitempty"`
+}
+
+// MetadataRequestData replaces the metadata of a client, including its expiry.
+type MetadataRequestData struct {
+	Name string         `msg:"name"`
+	Meta pivpn.Metadata `msg:"meta"`
+}
+
+// ImportRequestData creates the clients of a CSV file at once, see pivpn.ParseClientsCSV.
+type ImportRequestData struct {
+	CSV []byte `msg:"csv"`
+	// DryRun only checks the clients, with the addresses they would get.
+	DryRun bool `msg:"dry_run,omitempty"`
+}
+
+// ImportData is the response to an ImportRequest, no client was created if any of the results has an error.
+type ImportData struct {
+	Results []ImportResult `msg:"results"`
+}
+
+type ImportResult struct {
+	Line      int      `msg:"line"`
+	Name      string   `msg:"name"`
+	Addresses []string `msg:"addresses,omitempty"`
+	Err       string   `msg:"err,omitempty"`
+}
+
+// BackupData is the response to a BackupRequest.
+type BackupData struct {
+	// Name is the suggested file name of the archive.
+	Name    string `msg:"name"`
+	Archive []byte `msg:"archive"`
+}
+
 type Status int
 
 const (
@@ -63,10 +140,14 @@ type Response struct {
 	Err    string      `msg:"err,omitempty"`
 }
 
-func TunnelFromVPN(vpn *pivpn.Vpn) *Tunnel {
-	return &Tunnel{
-		Endpoint: vpn.Conf.Endpoint,
-		Server:   vpn.Server,
-		Clients:  vpn.Clients,
+func NewTunnel(t pivpn.Tunnel) *Tunnel {
+	tunnel := &Tunnel{
+		Endpoint: t.Endpoint,
+		Server:   t.Server,
+		Clients:  t.Clients,
+	}
+	for _, warning := range t.Warnings {
+		tunnel.Warnings = append(tunnel.Warnings, Warning{warning.Client, warning.Err.Error()})
 	}
+	return tunnel
 }
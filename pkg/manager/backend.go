@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wgquick"
+)
+
+const (
+	BackendPiVPN   = "pivpn"
+	BackendWgQuick = "wgquick"
+)
+
+// Backend is a tunnel the manager operates, a *pivpn.Vpn or a *wgquick.Vpn as selected by Config.Backend.
+type Backend interface {
+	Name() string
+	// Reload reads the tunnel and its clients.
+	Reload() error
+	// Tunnel returns the tunnel and its clients as loaded.
+	Tunnel() pivpn.Tunnel
+
+	AddClientWithMetadata(name string, meta pivpn.Metadata, requested ...netip.Addr) error
+	RemoveClient(name string) error
+	EnableClient(name string) error
+	DisableClient(name string) error
+	RenameClient(name, newName string) error
+	RotateClientKeys(name string, pskOnly bool) error
+	SetClientMetadata(name string, meta pivpn.Metadata) error
+	DisableExpiredClients(now time.Time) ([]string, error)
+}
+
+// The operations only some backends support.
+type (
+	importer interface {
+		AddClients(specs []pivpn.ClientSpec, dryRun bool) ([]pivpn.ClientResult, error)
+	}
+	backupper interface {
+		Backup(version string) (*pivpn.Backup, error)
+	}
+)
+
+var (
+	_ Backend   = (*pivpn.Vpn)(nil)
+	_ Backend   = (*wgquick.Vpn)(nil)
+	_ importer  = (*pivpn.Vpn)(nil)
+	_ backupper = (*pivpn.Vpn)(nil)
+)
+
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+func errUnsupported(cfg *Config, op string) error {
+	return fmt.Errorf("%w: the %s backend can't %s", errors.ErrUnsupported, cfg.Backend, op)
+}
@@ -18,6 +18,8 @@ import (
 
 const (
 	helloV0Format = "HELLO 0 %s"
+	// helloV1Format announces a manager of several tunnels, its requests and updates have the tunnel names.
+	helloV1Format = "HELLO 1 %s"
 )
 
 type Client struct {
@@ -76,6 +78,8 @@ func (d *dialWithBackoff) Dial(url url.URL, ctx context.Context, psk string) (*w
 }
 
 func (c *Client) Connect(ctx context.Context) {
+	go disableExpiredClients(ctx, c.cfg)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -101,7 +105,11 @@ func (c *Client) connect(ctx context.Context) error {
 	}
 	defer conn.Close() //nolint:errcheck
 
-	err = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(helloV0Format, c.cfg.Name))) //nolint:modernize
+	hello := helloV0Format
+	if c.cfg.MultiTunnel() {
+		hello = helloV1Format
+	}
+	err = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(hello, c.cfg.Name))) //nolint:modernize
 	if err != nil {
 		return err
 	}
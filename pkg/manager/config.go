@@ -2,11 +2,20 @@ package manager
 
 import (
 	"errors"
+	"fmt"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wgquick"
+	"magnax.ca/VPNManager/pkg/wireguard"
 
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsimple"
 )
 
@@ -17,11 +26,34 @@ type Config struct {
 	UseTLS           bool   `hcl:"use_tls,optional"`
 	PSK              string `hcl:"psk,optional"`
 
-	PiVPNConfig *PiVPNConfig `hcl:"pivpn,block"`
+	// Backend is the kind of the tunnel, configured by the block of the same name: pivpn (the default) or wgquick.
+	Backend       string         `hcl:"backend,optional"`
+	PiVPNConfig   *PiVPNConfig   `hcl:"pivpn,block"`
+	WgQuickConfig *WgQuickConfig `hcl:"wgquick,block"`
+
+	// TunnelBlocks declare the tunnels of a manager of several tunnels, the top-level tunnel is then ignored.
+	TunnelBlocks []*TunnelBlock `hcl:"tunnel,block"`
+	// Tunnels are the tunnels of the manager, from TunnelBlocks or the top-level one. See ParseConfig.
+	Tunnels []*TunnelConfig
 
 	Timeouts *Timeouts `hcl:"timeouts,block"`
 }
 
+// TunnelBlock is a `tunnel "name" { ... }` block, whose body is a TunnelConfig.
+type TunnelBlock struct {
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+// TunnelConfig is a tunnel of the manager, configured by the block of its backend.
+type TunnelConfig struct {
+	// Name is the label of the tunnel block, empty for the top-level tunnel.
+	Name          string
+	Backend       string         `hcl:"backend,optional"`
+	PiVPNConfig   *PiVPNConfig   `hcl:"pivpn,block"`
+	WgQuickConfig *WgQuickConfig `hcl:"wgquick,block"`
+}
+
 type PiVPNConfig struct {
 	ConfigFilePath string `hcl:"config_file,optional"`
 
@@ -31,16 +63,172 @@ type PiVPNConfig struct {
 	KeysDirectory    string `hcl:"keys_dir,optional"`
 
 	ReloadPiholeCmd []string `hcl:"reload_cmd_pihole,optional"`
+	// ReloadWgCmd defaults to reloading the wg-quick service of the tunnel.
 	ReloadWgCmd []string `hcl:"reload_cmd_wg,optional"`
+	// WgCmd is the `wg` command, with its arguments if any, which shows the interface and applies the peer changes
+	// with `wg set`. The tunnel is reloaded with ReloadWgCmd only if other settings change or `wg set` fails.
+	WgCmd []string `hcl:"wg_cmd,optional"`
+
+	// UseUAPI talks to userspace WireGuard implementations over their UAPI socket in UAPIDir instead of running `wg`.
+	UseUAPI bool   `hcl:"use_uapi,optional"`
+	UAPIDir string `hcl:"uapi_dir,optional"`
+
+	IPAM *IPAMConfig `hcl:"ipam,block"`
+
+	// ExpiryWarningDays is how many days before their expiry the clients are reported as expiring.
+	ExpiryWarningDays int64 `hcl:"expiry_warning_days,optional"`
+}
+
+// WgQuickConfig is a bare wg-quick tunnel, whose clients are kept in ClientsDirectory.
+type WgQuickConfig struct {
+	Name             string `hcl:"name,optional"`
+	TunnelDirectory  string `hcl:"tunnel_dir,optional"`
+	ClientsDirectory string `hcl:"clients_dir,optional"`
+
+	// Endpoint is the host:port the clients connect to, and DNS the servers they use.
+	Endpoint string   `hcl:"endpoint"`
+	DNS      []string `hcl:"dns,optional"`
+
+	// ReloadWgCmd defaults to reloading the wg-quick service of the tunnel.
+	ReloadWgCmd []string `hcl:"reload_cmd_wg,optional"`
+	// WgCmd, UseUAPI and UAPIDir are as in PiVPNConfig.
+	WgCmd []string `hcl:"wg_cmd,optional"`
+
+	UseUAPI bool   `hcl:"use_uapi,optional"`
+	UAPIDir string `hcl:"uapi_dir,optional"`
+
+	IPAM *IPAMConfig `hcl:"ipam,block"`
+
+	ExpiryWarningDays int64 `hcl:"expiry_warning_days,optional"`
+}
+
+type IPAMConfig struct {
+	// Reserved are the ranges which are only assigned explicitly, as `from-to`, CIDR prefixes or single addresses.
+	Reserved       []string `hcl:"reserved,optional"`
+	Reuse          string   `hcl:"reuse,optional"`
+	ReuseAfterDays int64    `hcl:"reuse_after_days,optional"`
+}
+
+// NewIPAM returns the address allocator of new clients.
+func (c *IPAMConfig) NewIPAM() (*pivpn.IPAM, error) {
+	ipam := &pivpn.IPAM{}
+	if c == nil {
+		return ipam, nil
+	}
+
+	var err error
+	if ipam.Reuse, err = pivpn.ParseReusePolicy(c.Reuse); err != nil {
+		return nil, err
+	}
+	ipam.ReuseAfter = time.Duration(c.ReuseAfterDays) * 24 * time.Hour
+	for _, reserved := range c.Reserved {
+		r, err := pivpn.ParseAddrRange(reserved)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved range %q: %w", reserved, err)
+		}
+		ipam.Reserved = append(ipam.Reserved, r)
+	}
+	return ipam, nil
+}
+
+func (c *PiVPNConfig) ReloadCmd() []string {
+	if len(c.ReloadWgCmd) > 0 {
+		return c.ReloadWgCmd
+	}
+	return []string{"systemctl", "reload", "wg-quick@" + c.Name}
+}
+
+func (c *PiVPNConfig) NewIPAM() (*pivpn.IPAM, error) {
+	return c.IPAM.NewIPAM()
+}
+
+func (c *PiVPNConfig) ExpiryWarning() time.Duration {
+	return time.Duration(c.ExpiryWarningDays) * 24 * time.Hour
+}
+
+func (c *PiVPNConfig) StatusSource() wireguard.StatusSource {
+	return statusSource(c.UseUAPI, c.UAPIDir, c.WgCmd)
+}
+
+func (c *PiVPNConfig) PeerApplier() wireguard.PeerApplier {
+	return peerApplier(c.UseUAPI, c.UAPIDir, c.WgCmd)
+}
+
+// ClientsDir returns the clients dir of the tunnel, in DefaultClientsDir unless set.
+func (c *WgQuickConfig) ClientsDir() string {
+	if c.ClientsDirectory != "" {
+		return c.ClientsDirectory
+	}
+	return filepath.Join(wgquick.DefaultClientsDir, c.Name)
+}
+
+func (c *WgQuickConfig) ReloadCmd() []string {
+	if len(c.ReloadWgCmd) > 0 {
+		return c.ReloadWgCmd
+	}
+	return []string{"systemctl", "reload", "wg-quick@" + c.Name}
+}
+
+func (c *WgQuickConfig) ParseEndpoint() (*wireguard.Endpoint, error) {
+	return wireguard.ParseEndpoint(c.Endpoint)
+}
+
+func (c *WgQuickConfig) ParseDNS() ([]netip.Addr, error) {
+	return pivpn.ParseAddrs(c.DNS)
+}
+
+func (c *WgQuickConfig) NewIPAM() (*pivpn.IPAM, error) {
+	return c.IPAM.NewIPAM()
+}
+
+func (c *WgQuickConfig) ExpiryWarning() time.Duration {
+	return time.Duration(c.ExpiryWarningDays) * 24 * time.Hour
+}
+
+func (c *WgQuickConfig) StatusSource() wireguard.StatusSource {
+	return statusSource(c.UseUAPI, c.UAPIDir, c.WgCmd)
+}
+
+func (c *WgQuickConfig) PeerApplier() wireguard.PeerApplier {
+	return peerApplier(c.UseUAPI, c.UAPIDir, c.WgCmd)
+}
+
+func statusSource(useUAPI bool, uapiDir string, wgCmd []string) wireguard.StatusSource {
+	if useUAPI {
+		return &wireguard.UAPIClient{Dir: uapiDir}
+	}
+	return wireguard.WgShow{Cmd: wgCmd}
+}
+
+func peerApplier(useUAPI bool, uapiDir string, wgCmd []string) wireguard.PeerApplier {
+	if useUAPI {
+		return &wireguard.UAPIClient{Dir: uapiDir}
+	}
+	return wireguard.WgSet{Cmd: wgCmd}
+}
+
+// ExpiryWarning returns how long before their expiry the clients of the backend are reported as expiring.
+func (c *Config) ExpiryWarning() time.Duration {
+	if c.Backend == BackendWgQuick {
+		return c.WgQuickConfig.ExpiryWarning()
+	}
+	return c.PiVPNConfig.ExpiryWarning()
 }
 
 type Timeouts struct {
 	MinRetryIntervalMS int64 `hcl:"min_retry,optional"`
 	MaxRetryIntervalMS int64 `hcl:"max_retry,optional"`
+	// LockTimeoutMS is how long to wait for `pivpn` or another manager to release the PiVPN lock file.
+	LockTimeoutMS int64 `hcl:"lock,optional"`
+	// ExpiryCheckMS is how often the daemon disables the expired clients.
+	ExpiryCheckMS int64 `hcl:"expiry_check,optional"`
 }
 
-func DefaultConfig() (*Config, error) {
-	config := Config{
+// defaultTunnelConfig returns the default configuration of a tunnel, whose interface is named after its block if any.
+func defaultTunnelConfig(name string) *TunnelConfig {
+	tunnel := &TunnelConfig{
+		Name:    name,
+		Backend: BackendPiVPN,
 		PiVPNConfig: &PiVPNConfig{
 			ConfigFilePath:   pivpn.DefaultConfigFilePath,
 			Name:             pivpn.DefaultTunnelName,
@@ -48,11 +236,38 @@ func DefaultConfig() (*Config, error) {
 			ConfigsDirectory: pivpn.DefaultConfigsDir,
 			KeysDirectory:    pivpn.DefaultKeysFilePath,
 			ReloadPiholeCmd:  []string{"/usr/local/bin/pihole", "reloadlists"},
-			ReloadWgCmd:      []string{"systemctl", "reload", "wg-quick@wg0"},
+			WgCmd:            []string{"wg"},
+			UAPIDir:          wireguard.DefaultUAPIDir,
+
+			ExpiryWarningDays: 7,
 		},
+		WgQuickConfig: &WgQuickConfig{
+			Name:            wgquick.DefaultTunnelName,
+			TunnelDirectory: wgquick.DefaultTunnelDir,
+			WgCmd:           []string{"wg"},
+			UAPIDir:         wireguard.DefaultUAPIDir,
+
+			ExpiryWarningDays: 7,
+		},
+	}
+	if name != "" {
+		tunnel.PiVPNConfig.Name, tunnel.WgQuickConfig.Name = name, name
+	}
+	return tunnel
+}
+
+func DefaultConfig() (*Config, error) {
+	tunnel := defaultTunnelConfig("")
+	config := Config{
+		Backend:       tunnel.Backend,
+		PiVPNConfig:   tunnel.PiVPNConfig,
+		WgQuickConfig: tunnel.WgQuickConfig,
+		Tunnels:       []*TunnelConfig{tunnel},
 		Timeouts: &Timeouts{
 			MinRetryIntervalMS: 100,
 			MaxRetryIntervalMS: int64(10 * time.Minute / time.Millisecond),
+			LockTimeoutMS:      int64(pivpn.DefaultLockTimeout / time.Millisecond),
+			ExpiryCheckMS:      int64(time.Minute / time.Millisecond),
 		},
 	}
 	name, err := os.Hostname()
@@ -71,6 +286,19 @@ func ParseConfig(src []byte) (*Config, error) {
 		return nil, err
 	}
 
+	// the tunnel blocks are decoded on their own, over their defaults
+	config.Tunnels = nil
+	for _, block := range config.TunnelBlocks {
+		tunnel := defaultTunnelConfig(block.Name)
+		if diags := gohcl.DecodeBody(block.Body, nil, tunnel); diags.HasErrors() {
+			return nil, diags
+		}
+		config.Tunnels = append(config.Tunnels, tunnel)
+	}
+	if len(config.Tunnels) == 0 {
+		config.Tunnels = []*TunnelConfig{{Backend: config.Backend, PiVPNConfig: config.PiVPNConfig, WgQuickConfig: config.WgQuickConfig}}
+	}
+
 	err = config.Validate()
 	if err != nil {
 		return nil, err
@@ -88,9 +316,124 @@ func (c *Config) Validate() error {
 		return errors.New("orchestrator_addr cannot be empty")
 	}
 
+	names := make(map[string]bool, len(c.Tunnels))
+	// paths are the files and dirs of the pivpn tunnels, which must not be shared as each tunnel rewrites them
+	paths := make(map[string]string)
+	for _, tunnel := range c.Tunnels {
+		if err := tunnel.Validate(); err != nil && tunnel.Name != "" {
+			return fmt.Errorf("tunnel %q: %w", tunnel.Name, err)
+		} else if err != nil {
+			return err
+		}
+		if names[tunnel.Name] {
+			return fmt.Errorf("tunnel %q is declared twice", tunnel.Name)
+		}
+		names[tunnel.Name] = true
+
+		if tunnel.Backend != BackendPiVPN {
+			continue
+		}
+		conf := tunnel.PiVPNConfig
+		for _, path := range []string{conf.ConfigFilePath, conf.ConfigsDirectory, conf.KeysDirectory} {
+			path = filepath.Clean(path)
+			if other, ok := paths[path]; ok && other != tunnel.Name {
+				return fmt.Errorf("tunnels %q and %q share %s, set config_file, configs_dir and keys_dir in their pivpn blocks", other, tunnel.Name, path)
+			}
+			paths[path] = tunnel.Name
+		}
+	}
+
 	return nil
 }
 
+var tunnelNameRE = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,32}$`)
+
+func (t *TunnelConfig) Validate() error {
+	if t.Name != "" && !tunnelNameRE.MatchString(t.Name) {
+		return errors.New("tunnel names must only contain alphanumerical, period, underscore and hyphen; and be between 1 and 32 characters")
+	}
+
+	switch t.Backend {
+	case BackendPiVPN:
+		if _, err := t.PiVPNConfig.NewIPAM(); err != nil {
+			return fmt.Errorf("pivpn ipam: %w", err)
+		}
+	case BackendWgQuick:
+		if _, err := t.WgQuickConfig.ParseEndpoint(); err != nil {
+			return fmt.Errorf("wgquick endpoint: %w", err)
+		}
+		if _, err := t.WgQuickConfig.ParseDNS(); err != nil {
+			return fmt.Errorf("wgquick dns: %w", err)
+		}
+		if _, err := t.WgQuickConfig.NewIPAM(); err != nil {
+			return fmt.Errorf("wgquick ipam: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q, expected %s or %s", t.Backend, BackendPiVPN, BackendWgQuick)
+	}
+	return nil
+}
+
+// MultiTunnel returns whether the tunnels are declared by tunnel blocks, they are then identified by their name.
+func (c *Config) MultiTunnel() bool {
+	return len(c.TunnelBlocks) > 0
+}
+
+// Tunnel returns the tunnel name, the empty name being the only tunnel of the manager.
+func (c *Config) Tunnel(name string) (*TunnelConfig, error) {
+	if name == "" && len(c.Tunnels) == 1 {
+		return c.Tunnels[0], nil
+	} else if name == "" {
+		return nil, errors.New("the manager has several tunnels, the tunnel must be given")
+	}
+	for _, tunnel := range c.Tunnels {
+		if tunnel.Name == name {
+			return tunnel, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+}
+
+// ForTunnel returns the configuration of the manager with the tunnel as the only one.
+func (c *Config) ForTunnel(tunnel *TunnelConfig) *Config {
+	cfg := *c
+	cfg.Backend, cfg.PiVPNConfig, cfg.WgQuickConfig = tunnel.Backend, tunnel.PiVPNConfig, tunnel.WgQuickConfig
+	cfg.TunnelBlocks, cfg.Tunnels = nil, []*TunnelConfig{tunnel}
+	return &cfg
+}
+
+// ForPiVPN returns the configuration of the manager with its PiVPN tunnel name as the only one, for the commands
+// which only manage PiVPN. The empty name is the only PiVPN tunnel of the manager.
+func (c *Config) ForPiVPN(name string) (*Config, error) {
+	if name != "" {
+		tunnel, err := c.Tunnel(name)
+		if err != nil {
+			return nil, err
+		}
+		if tunnel.Backend != BackendPiVPN {
+			return nil, fmt.Errorf("%w: tunnel %s isn't a pivpn tunnel, it's managed through the orchestrator", errors.ErrUnsupported, name)
+		}
+		return c.ForTunnel(tunnel), nil
+	}
+
+	var tunnels []*TunnelConfig
+	var names []string
+	for _, tunnel := range c.Tunnels {
+		if tunnel.Backend == BackendPiVPN {
+			tunnels = append(tunnels, tunnel)
+			names = append(names, tunnel.Name)
+		}
+	}
+	switch len(tunnels) {
+	case 0:
+		return nil, fmt.Errorf("%w: the commands only manage pivpn tunnels, the other ones are managed through the orchestrator", errors.ErrUnsupported)
+	case 1:
+		return c.ForTunnel(tunnels[0]), nil
+	default:
+		return nil, fmt.Errorf("the manager has several pivpn tunnels (%s), the tunnel must be given", strings.Join(names, ", "))
+	}
+}
+
 func (t *Timeouts) MinRetry() time.Duration {
 	return time.Duration(t.MinRetryIntervalMS) * time.Millisecond
 }
@@ -98,3 +441,11 @@ func (t *Timeouts) MinRetry() time.Duration {
 func (t *Timeouts) MaxRetry() time.Duration {
 	return time.Duration(t.MaxRetryIntervalMS) * time.Millisecond
 }
+
+func (t *Timeouts) Lock() time.Duration {
+	return time.Duration(t.LockTimeoutMS) * time.Millisecond
+}
+
+func (t *Timeouts) ExpiryCheck() time.Duration {
+	return time.Duration(t.ExpiryCheckMS) * time.Millisecond
+}
@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+func TestParseConfigTunnels(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		reloads map[string][]string
+		wantErr string
+	}{
+		{
+			name: "top-level",
+			src:  `pivpn {}`,
+			reloads: map[string][]string{
+				"": {"systemctl", "reload", "wg-quick@wg0"},
+			},
+		},
+		{
+			name: "tunnel blocks",
+			src: `
+tunnel "wg0" {}
+tunnel "wg1" {
+  pivpn {
+    config_file = "/etc/pivpn/wg1/setupVars.conf"
+    configs_dir = "/etc/wireguard/wg1/configs"
+    keys_dir    = "/etc/wireguard/wg1/keys"
+  }
+}
+tunnel "wg2" {
+  pivpn {
+    config_file   = "/etc/pivpn/wg2/setupVars.conf"
+    configs_dir   = "/etc/wireguard/wg2/configs"
+    keys_dir      = "/etc/wireguard/wg2/keys"
+    reload_cmd_wg = ["wg-quick", "strip", "wg2"]
+  }
+}`,
+			reloads: map[string][]string{
+				"wg0": {"systemctl", "reload", "wg-quick@wg0"},
+				"wg1": {"systemctl", "reload", "wg-quick@wg1"},
+				"wg2": {"wg-quick", "strip", "wg2"},
+			},
+		},
+		{
+			name: "shared setupVars",
+			src: `
+tunnel "wg0" {}
+tunnel "wg1" {
+  pivpn {
+    configs_dir = "/etc/wireguard/wg1/configs"
+    keys_dir    = "/etc/wireguard/wg1/keys"
+  }
+}`,
+			wantErr: `tunnels "wg0" and "wg1" share /etc/pivpn/wireguard/setupVars.conf`,
+		},
+		{
+			name: "shared configs dir",
+			src: `
+tunnel "wg0" {}
+tunnel "wg1" {
+  pivpn {
+    config_file = "/etc/pivpn/wg1/setupVars.conf"
+    configs_dir = "/etc/wireguard/configs/"
+    keys_dir    = "/etc/wireguard/wg1/keys"
+  }
+}`,
+			wantErr: `tunnels "wg0" and "wg1" share /etc/wireguard/configs`,
+		},
+		{
+			name: "pivpn and wgquick",
+			src: `
+tunnel "wg0" {}
+tunnel "wg1" {
+  backend = "wgquick"
+  wgquick {
+    endpoint = "vpn.example.com:51821"
+  }
+}`,
+			reloads: map[string][]string{
+				"wg0": {"systemctl", "reload", "wg-quick@wg0"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ParseConfig([]byte("name = \"host\"\norchestrator_addr = \"localhost:8080\"\n" + tt.src))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			for name, want := range tt.reloads {
+				tunnel, err := cfg.Tunnel(name)
+				if err != nil {
+					t.Fatalf("Tunnel(%q) error = %v", name, err)
+				}
+				if got := tunnel.PiVPNConfig.ReloadCmd(); !slices.Equal(got, want) {
+					t.Errorf("Tunnel(%q) reload command = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigForPiVPN(t *testing.T) {
+	src := `
+name = "host"
+orchestrator_addr = "localhost:8080"
+tunnel "wg0" {}
+tunnel "wg1" {
+  pivpn {
+    config_file = "/etc/pivpn/wg1/setupVars.conf"
+    configs_dir = "/etc/wireguard/wg1/configs"
+    keys_dir    = "/etc/wireguard/wg1/keys"
+  }
+}
+tunnel "wg2" {
+  backend = "wgquick"
+  wgquick {
+    endpoint = "vpn.example.com:51822"
+  }
+}`
+	cfg, err := ParseConfig([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tunnel  string
+		want    string
+		wantErr string
+	}{
+		{tunnel: "wg1", want: "wg1"},
+		{tunnel: "", wantErr: "several pivpn tunnels (wg0, wg1)"},
+		{tunnel: "wg2", wantErr: "isn't a pivpn tunnel"},
+		{tunnel: "wg3", wantErr: ErrTunnelNotFound.Error()},
+	}
+	for _, tt := range tests {
+		got, err := cfg.ForPiVPN(tt.tunnel)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ForPiVPN(%q) error = %v, want %q", tt.tunnel, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got.PiVPNConfig.Name != tt.want || len(got.Tunnels) != 1 {
+			t.Errorf("ForPiVPN(%q) = %v, %v, want only %s", tt.tunnel, got, err, tt.want)
+		}
+	}
+
+	// a pivpn tunnel next to wg-quick ones isn't ambiguous
+	cfg.Tunnels = slices.DeleteFunc(cfg.Tunnels, func(t *TunnelConfig) bool { return t.Name == "wg0" })
+	if got, err := cfg.ForPiVPN(""); err != nil || got.PiVPNConfig.Name != "wg1" {
+		t.Errorf("ForPiVPN(\"\") = %v, %v, want only wg1", got, err)
+	}
+}
+
+func TestConfigPeerApplier(t *testing.T) {
+	cfg, err := ParseConfig([]byte("name = \"host\"\norchestrator_addr = \"localhost:8080\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applier, ok := cfg.PiVPNConfig.PeerApplier().(wireguard.WgSet); !ok || !slices.Equal(applier.Cmd, []string{"wg"}) {
+		t.Errorf("PeerApplier() = %#v, want wg set by default", cfg.PiVPNConfig.PeerApplier())
+	}
+	cfg.PiVPNConfig.UseUAPI = true
+	if _, ok := cfg.PiVPNConfig.PeerApplier().(*wireguard.UAPIClient); !ok {
+		t.Errorf("PeerApplier() = %#v, want the UAPI client with use_uapi", cfg.PiVPNConfig.PeerApplier())
+	}
+}
@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// disableExpiredClients disables the expired clients on every Timeouts.ExpiryCheck, until ctx is done.
+func disableExpiredClients(ctx context.Context, cfg *Config) {
+	interval := cfg.Timeouts.ExpiryCheck()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, tunnel := range cfg.Tunnels {
+			vpn, err := loadBackend(cfg.ForTunnel(tunnel))
+			if err == nil {
+				var expired []string
+				expired, err = vpn.DisableExpiredClients(time.Now())
+				for _, name := range expired {
+					slog.Info("disabled expired client", "tunnel", vpn.Name(), "client", name)
+				}
+			}
+			if err != nil {
+				slog.Error("unable to disable the expired clients", "tunnel", tunnel.Name, "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
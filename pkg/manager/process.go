@@ -1,10 +1,16 @@
 package manager
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log/slog"
+	"time"
 
+	"magnax.ca/VPNManager/internal/version"
 	"magnax.ca/VPNManager/pkg/api"
 	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wgquick"
 
 	"github.com/tinylib/msgp/msgp"
 )
@@ -40,6 +46,33 @@ func _runProcessor[T any, PT interface {
 }
 
 func processRequest(req *api.Request, cfg *Config) *api.Response {
+	if req.Type == api.UpdateRequest && req.Tunnel == "" && cfg.MultiTunnel() {
+		resp := &api.Response{
+			Type: req.Type,
+			ID:   req.ID,
+		}
+		data, err := processUpdatesRequest(cfg)
+		if err != nil {
+			resp.Status = api.StatusErr
+			resp.Err = err.Error()
+		} else {
+			resp.Status = api.StatusOk
+			resp.Data = data
+		}
+		return resp
+	}
+
+	tunnel, err := cfg.Tunnel(req.Tunnel)
+	if err != nil {
+		return &api.Response{
+			Type:   req.Type,
+			ID:     req.ID,
+			Status: api.StatusErr,
+			Err:    err.Error(),
+		}
+	}
+	cfg = cfg.ForTunnel(tunnel)
+
 	switch req.Type {
 	case api.UpdateRequest:
 		resp := &api.Response{
@@ -55,6 +88,20 @@ func processRequest(req *api.Request, cfg *Config) *api.Response {
 			resp.Data = data
 		}
 		return resp
+	case api.BackupRequest:
+		resp := &api.Response{
+			Type: req.Type,
+			ID:   req.ID,
+		}
+		data, err := processBackupRequest(cfg)
+		if err != nil {
+			resp.Status = api.StatusErr
+			resp.Err = err.Error()
+		} else {
+			resp.Status = api.StatusOk
+			resp.Data = data
+		}
+		return resp
 	case api.CreatePeerRequest:
 		return _runProcessor(cfg, req, processCreateRequest)
 	case api.DeletePeerRequest:
@@ -63,6 +110,14 @@ func processRequest(req *api.Request, cfg *Config) *api.Response {
 		return _runProcessor(cfg, req, processEnableRequest)
 	case api.DisablePeerRequest:
 		return _runProcessor(cfg, req, processDisableRequest)
+	case api.RenamePeerRequest:
+		return _runProcessor(cfg, req, processRenameRequest)
+	case api.RotatePeerRequest:
+		return _runProcessor(cfg, req, processRotateRequest)
+	case api.SetMetadataRequest:
+		return _runProcessor(cfg, req, processMetadataRequest)
+	case api.ImportRequest:
+		return _runProcessor(cfg, req, processImportRequest)
 	}
 
 	return &api.Response{
@@ -73,8 +128,42 @@ func processRequest(req *api.Request, cfg *Config) *api.Response {
 	}
 }
 
-func loadVpn(cfg *Config) (*pivpn.Vpn, error) {
-	vpn, err := pivpn.LoadVpnWithLocations(
+// newBackend returns the configured backend, without reading the tunnel and its clients.
+func newBackend(cfg *Config) (Backend, error) {
+	if cfg.Backend == BackendWgQuick {
+		return newWgQuickVpn(cfg)
+	}
+	return newVpn(cfg)
+}
+
+// newWgQuickVpn returns the configured wg-quick tunnel, without reading it.
+func newWgQuickVpn(cfg *Config) (*wgquick.Vpn, error) {
+	conf := cfg.WgQuickConfig
+	endpoint, err := conf.ParseEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	dns, err := conf.ParseDNS()
+	if err != nil {
+		return nil, err
+	}
+	ipam, err := conf.NewIPAM()
+	if err != nil {
+		return nil, err
+	}
+
+	vpn := wgquick.NewVpn(conf.Name, conf.TunnelDirectory, conf.ClientsDir(), *endpoint, dns)
+	vpn.SetReloadCmd(conf.ReloadCmd())
+	vpn.SetPeerApplier(conf.PeerApplier())
+	vpn.SetTolerant(true)
+	vpn.SetIPAM(ipam)
+	vpn.SetLockTimeout(cfg.Timeouts.Lock())
+	return vpn, nil
+}
+
+// newVpn returns the configured PiVPN vpn, without reading the tunnel and its clients.
+func newVpn(cfg *Config) (*pivpn.Vpn, error) {
+	vpn, err := pivpn.NewVpnWithLocations(
 		cfg.PiVPNConfig.Name,
 		cfg.PiVPNConfig.ConfigFilePath,
 		cfg.PiVPNConfig.TunnelDirectory,
@@ -86,38 +175,114 @@ func loadVpn(cfg *Config) (*pivpn.Vpn, error) {
 		return nil, err
 	}
 
-	vpn.SetReloadCmds(cfg.PiVPNConfig.ReloadPiholeCmd, cfg.PiVPNConfig.ReloadWgCmd)
+	vpn.SetReloadCmds(cfg.PiVPNConfig.ReloadPiholeCmd, cfg.PiVPNConfig.ReloadCmd())
+	vpn.SetPeerApplier(cfg.PiVPNConfig.PeerApplier())
+	vpn.SetLockTimeout(cfg.Timeouts.Lock())
+	// a broken client must not prevent managing the other ones, the orchestrator shows the warnings
+	vpn.SetTolerant(true)
+	ipam, err := cfg.PiVPNConfig.NewIPAM()
+	if err != nil {
+		return nil, err
+	}
+	vpn.SetIPAM(ipam)
+
+	return vpn, nil
+}
+
+func loadBackend(cfg *Config) (Backend, error) {
+	vpn, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = vpn.Reload(); err != nil {
+		slog.Error("unable to load VPN", "err", err)
+		return nil, err
+	}
 
 	return vpn, nil
 }
 
-func processUpdateRequest(cfg *Config) (msgp.Raw, error) {
-	vpn, err := loadVpn(cfg)
+// loadTunnel loads the tunnel of cfg as sent to the orchestrator.
+func loadTunnel(cfg *Config) (*api.Tunnel, error) {
+	vpn, err := loadBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
-	tunnel := api.TunnelFromVPN(vpn)
+	tunnel := api.NewTunnel(vpn.Tunnel())
+	for _, client := range tunnel.Clients.Expiring(time.Now(), cfg.ExpiryWarning()) {
+		tunnel.Expiring = append(tunnel.Expiring, api.Expiry{Client: client.Name, Expires: client.Meta.Expires})
+	}
+	return tunnel, nil
+}
 
+func processUpdateRequest(cfg *Config) (msgp.Raw, error) {
+	tunnel, err := loadTunnel(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return tunnel.MarshalMsg(nil)
 }
 
+// processUpdatesRequest returns every tunnel of a manager of several tunnels. A tunnel which can't be loaded only has
+// a warning, so that the other ones are still managed.
+func processUpdatesRequest(cfg *Config) (msgp.Raw, error) {
+	update := api.Update{Tunnels: make(map[string]api.Tunnel, len(cfg.Tunnels))}
+	for _, t := range cfg.Tunnels {
+		tunnel, err := loadTunnel(cfg.ForTunnel(t))
+		if err != nil {
+			tunnel = &api.Tunnel{Warnings: []api.Warning{{Message: fmt.Sprintf("unable to load the tunnel: %v", err)}}}
+		}
+		update.Tunnels[t.Name] = *tunnel
+	}
+	return update.MarshalMsg(nil)
+}
+
+func processBackupRequest(cfg *Config) (msgp.Raw, error) {
+	// the tunnel isn't loaded, to back up a broken one too
+	vpn, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := vpn.(backupper)
+	if !ok {
+		return nil, errUnsupported(cfg, "back up")
+	}
+	backup, err := b.Backup(version.RawVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = backup.Write(&buf); err != nil {
+		return nil, err
+	}
+	data := api.BackupData{Name: backup.FileName(), Archive: buf.Bytes()}
+	return data.MarshalMsg(nil)
+}
+
 func processCreateRequest(cfg *Config, data *api.CreateRequestData) (msgp.Raw, error) {
-	vpn, err := loadVpn(cfg)
+	vpn, err := loadBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := pivpn.ParseAddrs(data.Addresses)
 	if err != nil {
 		return nil, err
 	}
 
-	err = vpn.AddClient(data.Name)
+	err = vpn.AddClientWithMetadata(data.Name, pivpn.Metadata{Expires: data.Expires}, addrs...)
 	if err != nil {
 		return nil, err
 	}
 
-	client := vpn.Clients.Client(data.Name)
+	tunnel := vpn.Tunnel()
+	client := tunnel.Clients.Client(data.Name)
 	return client.MarshalMsg(nil)
 }
 
 func processDeleteRequest(cfg *Config, data *api.DeleteRequestData) (msgp.Raw, error) {
-	vpn, err := loadVpn(cfg)
+	vpn, err := loadBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +292,7 @@ func processDeleteRequest(cfg *Config, data *api.DeleteRequestData) (msgp.Raw, e
 }
 
 func processEnableRequest(cfg *Config, data *api.EnableRequestData) (msgp.Raw, error) {
-	vpn, err := loadVpn(cfg)
+	vpn, err := loadBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -137,7 +302,7 @@ func processEnableRequest(cfg *Config, data *api.EnableRequestData) (msgp.Raw, e
 }
 
 func processDisableRequest(cfg *Config, data *api.DisableRequestData) (msgp.Raw, error) {
-	vpn, err := loadVpn(cfg)
+	vpn, err := loadBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -145,3 +310,75 @@ func processDisableRequest(cfg *Config, data *api.DisableRequestData) (msgp.Raw,
 	err = vpn.DisableClient(data.Name)
 	return nil, err
 }
+
+func processRenameRequest(cfg *Config, data *api.RenameRequestData) (msgp.Raw, error) {
+	vpn, err := loadBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vpn.RenameClient(data.Name, data.NewName)
+	return nil, err
+}
+
+func processRotateRequest(cfg *Config, data *api.RotateRequestData) (msgp.Raw, error) {
+	vpn, err := loadBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vpn.RotateClientKeys(data.Name, data.PSKOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel := vpn.Tunnel()
+	client := tunnel.Clients.Client(data.Name)
+	return client.MarshalMsg(nil)
+}
+
+func processMetadataRequest(cfg *Config, data *api.MetadataRequestData) (msgp.Raw, error) {
+	vpn, err := loadBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vpn.SetClientMetadata(data.Name, data.Meta)
+	return nil, err
+}
+
+func processImportRequest(cfg *Config, data *api.ImportRequestData) (msgp.Raw, error) {
+	specs, err := pivpn.ParseClientsCSV(bytes.NewReader(data.CSV), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no clients to import")
+	}
+
+	vpn, err := loadBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	i, ok := vpn.(importer)
+	if !ok {
+		return nil, errUnsupported(cfg, "import clients")
+	}
+	results, err := i.AddClients(specs, data.DryRun)
+	if err != nil && !errors.Is(err, pivpn.ErrBatchFailed) {
+		return nil, err
+	}
+
+	imported := api.ImportData{Results: make([]api.ImportResult, len(results))}
+	for i, result := range results {
+		imported.Results[i] = api.ImportResult{Line: result.Line, Name: result.Name}
+		for _, address := range result.Addresses {
+			imported.Results[i].Addresses = append(imported.Results[i].Addresses, address.String())
+		}
+		if result.Err != nil {
+			imported.Results[i].Err = result.Err.Error()
+		}
+	}
+	return imported.MarshalMsg(nil)
+}
@@ -51,8 +51,10 @@ func (m *managerApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	ctx := CtxWithLogger(r.Context(), logger)
 
+	// managers of several tunnels say HELLO 1, and get their tunnels named <manager>/<tunnel>
 	switch parts[1] {
-	case "0":
+	case "0", "1":
+		multi := parts[1] == "1"
 		resp, err := sendV1Request(c, api.Request{Type: api.UpdateRequest})
 		if err != nil {
 			logger.Error("status error", "err", err)
@@ -63,14 +65,14 @@ func (m *managerApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			_ = sendConnectionClose(c, websocket.ClosePolicyViolation)
 			return
 		}
-		err = processV1Update(m.cache, parts[2], resp.Data)
+		err = processV1Update(m.cache, parts[2], multi, resp.Data)
 		if err != nil {
 			logger.Error("couldn't unmarshal update", "err", err)
 			_ = sendConnectionClose(c, websocket.ClosePolicyViolation)
 			return
 		}
 		logger.Info("handshake completed", "version", parts[1])
-		code := m.manageV1Conn(ctx, parts[2], c)
+		code := m.manageV1Conn(ctx, parts[2], multi, c)
 		_ = sendConnectionClose(c, code)
 	}
 }
@@ -79,7 +81,7 @@ func sendConnectionClose(conn *websocket.Conn, code int) error {
 	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
 }
 
-func (m *managerApi) manageV1Conn(ctx context.Context, name string, c *websocket.Conn) int {
+func (m *managerApi) manageV1Conn(ctx context.Context, name string, multi bool, c *websocket.Conn) int {
 	logger := LoggerFromCtx(ctx)
 	// register connection for this manager
 	actionReq, err := m.cache.Register(name)
@@ -95,6 +97,9 @@ func (m *managerApi) manageV1Conn(ctx context.Context, name string, c *websocket
 		case <-ctx.Done():
 			return websocket.CloseGoingAway
 		case req := <-actionReq:
+			if multi {
+				req.Request.Tunnel = strings.TrimPrefix(req.Tunnel, name+"/")
+			}
 			resp, err := sendV1Request(c, req.Request)
 			if err != nil {
 				logger.Error("error sending request", "type", req.Request.Type, "err", err)
@@ -116,7 +121,7 @@ func (m *managerApi) manageV1Conn(ctx context.Context, name string, c *websocket
 			}
 			switch resp.Status {
 			case api.StatusOk:
-				err = processV1Update(m.cache, name, resp.Data)
+				err = processV1Update(m.cache, name, multi, resp.Data)
 				if err != nil {
 					logger.Error("unable to process update", "err", err)
 					return websocket.CloseProtocolError
@@ -158,7 +163,16 @@ func sendV1Request(c *websocket.Conn, r api.Request) (*api.Response, error) {
 	return resp, nil
 }
 
-func processV1Update(cache *Cache, name string, data []byte) error {
+func processV1Update(cache *Cache, name string, multi bool, data []byte) error {
+	if multi {
+		update := &api.Update{}
+		if _, err := update.UnmarshalMsg(data); err != nil {
+			return err
+		}
+		cache.InsertTunnels(name, update.Tunnels)
+		return nil
+	}
+
 	tunnel := &api.Tunnel{}
 	_, err := tunnel.UnmarshalMsg(data)
 	if err != nil {
@@ -3,14 +3,21 @@ package orchestrator
 import (
 	"errors"
 	"iter"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"magnax.ca/VPNManager/pkg/api"
+	"magnax.ca/VPNManager/pkg/wireguard"
 )
 
 type Cache struct {
 	vpns    map[string]api.Tunnel
-	vpnLock sync.RWMutex
+	changes map[string]TunnelChanges
+	// managers are the managers of the tunnels named <manager>/<tunnel>, of the managers of several tunnels
+	managers map[string]string
+	vpnLock  sync.RWMutex
 
 	channels     map[string]chan ActionRequest
 	channelsLock sync.RWMutex
@@ -18,14 +25,25 @@ type Cache struct {
 
 func NewCache() *Cache {
 	vpns := make(map[string]api.Tunnel)
+	changes := make(map[string]TunnelChanges)
 	channels := make(map[string]chan ActionRequest)
 	return &Cache{
 		vpns:     vpns,
+		changes:  changes,
+		managers: make(map[string]string),
 		channels: channels,
 	}
 }
 
+// TunnelChanges are the latest changes seen in the server configuration of a tunnel.
+type TunnelChanges struct {
+	Time time.Time
+	Diff *wireguard.ConfigDiff
+}
+
 type ActionRequest struct {
+	// Tunnel is the tunnel the request is for, the connection of its manager sets the tunnel of the Request.
+	Tunnel   string
 	Request  api.Request
 	Response chan<- api.Response
 }
@@ -44,11 +62,19 @@ func (c *Cache) Register(name string) (<-chan ActionRequest, error) {
 	return comm, nil
 }
 
-func (c *Cache) Get(name string) (chan<- ActionRequest, bool) {
+// Get returns the requests channel of the manager of a tunnel.
+func (c *Cache) Get(tunnel string) (chan<- ActionRequest, bool) {
+	c.vpnLock.RLock()
+	manager, ok := c.managers[tunnel]
+	c.vpnLock.RUnlock()
+	if !ok {
+		manager = tunnel
+	}
+
 	c.channelsLock.RLock()
 	defer c.channelsLock.RUnlock()
 
-	comm, ok := c.channels[name]
+	comm, ok := c.channels[manager]
 	return comm, ok
 }
 
@@ -66,6 +92,14 @@ func (c *Cache) Unregister(name string) {
 	defer c.vpnLock.Unlock()
 
 	delete(c.vpns, name)
+	delete(c.changes, name)
+	for tunnel, manager := range c.managers {
+		if manager == name {
+			delete(c.vpns, tunnel)
+			delete(c.changes, tunnel)
+			delete(c.managers, tunnel)
+		}
+	}
 }
 
 func (c *Cache) Managers() []string {
@@ -73,7 +107,12 @@ func (c *Cache) Managers() []string {
 	defer c.vpnLock.RUnlock()
 	managers := make([]string, 0, len(c.vpns))
 	for name := range c.vpns {
-		managers = append(managers, name)
+		if manager, ok := c.managers[name]; ok {
+			name = manager
+		}
+		if !slices.Contains(managers, name) {
+			managers = append(managers, name)
+		}
 	}
 	return managers
 }
@@ -104,5 +143,44 @@ func (c *Cache) InsertTunnel(name string, tunnel *api.Tunnel) {
 	c.vpnLock.Lock()
 	defer c.vpnLock.Unlock()
 
+	c.insertTunnel(name, tunnel)
+}
+
+// InsertTunnels replaces the tunnels of a manager of several tunnels, named <manager>/<tunnel>.
+func (c *Cache) InsertTunnels(manager string, tunnels map[string]api.Tunnel) {
+	c.vpnLock.Lock()
+	defer c.vpnLock.Unlock()
+
+	for name, owner := range c.managers {
+		if _, ok := tunnels[strings.TrimPrefix(name, manager+"/")]; owner == manager && !ok {
+			delete(c.vpns, name)
+			delete(c.changes, name)
+			delete(c.managers, name)
+		}
+	}
+	for name, tunnel := range tunnels {
+		c.managers[manager+"/"+name] = manager
+		c.insertTunnel(manager+"/"+name, &tunnel)
+	}
+}
+
+// insertTunnel inserts a tunnel, recording the changes of its server. The lock must be held.
+func (c *Cache) insertTunnel(name string, tunnel *api.Tunnel) {
+	if old, ok := c.vpns[name]; ok {
+		diff := wireguard.Diff(&old.Server, &tunnel.Server)
+		if !diff.IsEmpty() {
+			c.changes[name] = TunnelChanges{time.Now(), diff}
+		}
+	}
 	c.vpns[name] = *tunnel
 }
+
+func (c *Cache) GetChanges(name string) *TunnelChanges {
+	c.vpnLock.RLock()
+	defer c.vpnLock.RUnlock()
+
+	if changes, ok := c.changes[name]; ok {
+		return &changes
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package orchestrator
+
+import (
+	"slices"
+	"testing"
+
+	"magnax.ca/VPNManager/pkg/api"
+)
+
+func TestCacheInsertTunnels(t *testing.T) {
+	c := NewCache()
+	if _, err := c.Register("host"); err != nil {
+		t.Fatal(err)
+	}
+	c.InsertTunnels("host", map[string]api.Tunnel{"wg0": {}, "wg1": {}})
+	c.InsertTunnel("other", &api.Tunnel{})
+
+	for _, name := range []string{"host/wg0", "host/wg1"} {
+		if c.GetTunnel(name) == nil {
+			t.Errorf("GetTunnel(%q) = nil", name)
+		}
+		if got, ok := c.Get(name); !ok || got != (chan<- ActionRequest)(c.channels["host"]) {
+			t.Errorf("Get(%q) = %v, %v, want the channel of host", name, got, ok)
+		}
+	}
+	if got := c.Managers(); len(got) != 2 || !slices.Contains(got, "host") || !slices.Contains(got, "other") {
+		t.Errorf("Managers() = %v, want host and other", got)
+	}
+
+	c.InsertTunnels("host", map[string]api.Tunnel{"wg1": {}})
+	if c.GetTunnel("host/wg0") != nil || c.GetTunnel("host/wg1") == nil {
+		t.Errorf("InsertTunnels() kept the removed tunnel host/wg0")
+	}
+
+	c.Unregister("host")
+	if c.GetTunnel("host/wg1") != nil || c.GetTunnel("other") == nil {
+		t.Errorf("Unregister() kept the tunnels of host or removed other")
+	}
+	if _, ok := c.Get("host/wg1"); ok {
+		t.Errorf("Get() after Unregister() found the channel of host")
+	}
+}
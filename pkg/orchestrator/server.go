@@ -4,19 +4,25 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 
 	"magnax.ca/VPNManager/internal/web"
 	"magnax.ca/VPNManager/pkg/api"
 	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wireguard"
 )
 
 var upgrader = websocket.Upgrader{}
@@ -113,13 +119,24 @@ func (s *Server) loadRoutes() http.Handler {
 	mux.Handle("/", http.RedirectHandler("/tunnels", http.StatusSeeOther))
 	mux.HandleFunc("GET /tunnels", s.httpGetTunnels)
 	mux.HandleFunc("GET /tunnel/{name}", s.httpGetTunnel)
+	// under a path no client can take, as client names may have dots
+	mux.HandleFunc("GET /tunnel/{name}/-/backup.tar.gz", s.httpGetTunnelBackup)
 	mux.HandleFunc("GET /tunnel/{name}/{client}", s.httpGetTunnelClient)
 	mux.HandleFunc("GET /tunnel/{name}/{client}/conf", s.httpGetTunnelClientFile)
+	mux.HandleFunc("GET /tunnel/{name}/{client}/netdev", s.httpGetTunnelClientNetdev)
+	mux.HandleFunc("GET /tunnel/{name}/{client}/network", s.httpGetTunnelClientNetwork)
+	mux.HandleFunc("GET /tunnel/{name}/{client}/nmconnection", s.httpGetTunnelClientNMConnection)
+	mux.HandleFunc("GET /tunnel/{name}/{client}/mobileconfig", s.httpGetTunnelClientMobileConfig)
 	mux.HandleFunc("GET /tunnel/{name}/{client}/qr.png", s.httpGetTunnelClientQR)
+	mux.HandleFunc("GET /tunnel/{name}/{client}/qr.svg", s.httpGetTunnelClientQRSVG)
 	mux.HandleFunc("POST /tunnel/{name}/create", s.httpPOSTTunnelClientCreate)
+	mux.HandleFunc("POST /tunnel/{name}/import", s.httpPOSTTunnelImport)
 	mux.HandleFunc("POST /tunnel/{name}/{client}/enable", s.httpPOSTTunnelClientEnable)
 	mux.HandleFunc("POST /tunnel/{name}/{client}/disable", s.httpPOSTTunnelClientDisable)
 	mux.HandleFunc("POST /tunnel/{name}/{client}/remove", s.httpPOSTTunnelClientRemove)
+	mux.HandleFunc("POST /tunnel/{name}/{client}/rename", s.httpPOSTTunnelClientRename)
+	mux.HandleFunc("POST /tunnel/{name}/{client}/rotate", s.httpPOSTTunnelClientRotate)
+	mux.HandleFunc("POST /tunnel/{name}/{client}/meta", s.httpPOSTTunnelClientMeta)
 
 	return mux
 }
@@ -182,6 +199,7 @@ func (s *Server) loadClient(r *http.Request, t *api.Tunnel) (*pivpn.Client, erro
 
 func (s *Server) refreshTunnel(w http.ResponseWriter, comms chan<- ActionRequest, resultChan chan api.Response, tunnelName string) bool {
 	comms <- ActionRequest{
+		Tunnel: tunnelName,
 		Request: api.Request{
 			Type: api.UpdateRequest,
 			ID:   nextReqId(),
@@ -249,6 +267,7 @@ func (s *Server) httpGetTunnel(w http.ResponseWriter, r *http.Request) {
 			"Title":      fmt.Sprintf("%s - %s", tunnelName, tunnel.Endpoint.String()),
 			"TunnelName": tunnelName,
 			"Tunnel":     tunnel,
+			"Changes":    s.cache.GetChanges(tunnelName),
 		},
 		r.Context(),
 	)
@@ -290,7 +309,9 @@ func (s *Server) httpGetTunnelClient(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
-func (s *Server) httpGetTunnelClientFile(w http.ResponseWriter, r *http.Request) {
+// serveTunnelClientFile serves the client configuration as a download, ext being the file extension and export the
+// function exporting the configuration for the tunnel.
+func (s *Server) serveTunnelClientFile(w http.ResponseWriter, r *http.Request, ext, contentType string, export func(tunnelName string, client *pivpn.Client) string) {
 	tunnelName, tunnel, err := s.loadTunnel(r)
 	if err != nil {
 		if errors.Is(err, ErrTunnelNotFound) {
@@ -310,16 +331,74 @@ func (s *Server) httpGetTunnelClientFile(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	if client.External() {
+		s.serveError(w, http.StatusNotFound, fmt.Errorf("%w: %s", pivpn.ErrExternalKey, client.Name))
+		return
+	}
 
-	conf := client.Export()
+	// the interface defaults to the one of the tunnel, the tunnels of managers of several tunnels being named
+	// <manager>/<interface>
+	interfaceName := r.FormValue("interface")
+	if interfaceName == "" {
+		interfaceName = tunnel.Server.Name
+	}
+	if interfaceName == "" {
+		interfaceName = path.Base(tunnelName)
+	}
+	if err := wireguard.ValidateInterfaceName(interfaceName); err != nil {
+		s.serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	conf := export(interfaceName, client)
 
 	h := w.Header()
-	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.conf\"", tunnelName))
-	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", interfaceName, ext))
+	h.Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(conf))
 }
 
+func (s *Server) httpGetTunnelClientFile(w http.ResponseWriter, r *http.Request) {
+	s.serveTunnelClientFile(w, r, "conf", "text/plain; charset=utf-8", func(_ string, client *pivpn.Client) string {
+		return client.Export()
+	})
+}
+
+func (s *Server) httpGetTunnelClientNetdev(w http.ResponseWriter, r *http.Request) {
+	s.serveTunnelClientFile(w, r, "netdev", "text/plain; charset=utf-8", func(tunnelName string, client *pivpn.Client) string {
+		return client.ExportNetdev(tunnelName)
+	})
+}
+
+func (s *Server) httpGetTunnelClientNetwork(w http.ResponseWriter, r *http.Request) {
+	s.serveTunnelClientFile(w, r, "network", "text/plain; charset=utf-8", func(tunnelName string, client *pivpn.Client) string {
+		return client.ExportNetwork(tunnelName)
+	})
+}
+
+func (s *Server) httpGetTunnelClientNMConnection(w http.ResponseWriter, r *http.Request) {
+	autoconnect, _ := strconv.ParseBool(r.FormValue("autoconnect"))
+	s.serveTunnelClientFile(w, r, "nmconnection", "text/plain; charset=utf-8", func(tunnelName string, client *pivpn.Client) string {
+		return client.ExportNMConnection(tunnelName, autoconnect)
+	})
+}
+
+func (s *Server) httpGetTunnelClientMobileConfig(w http.ResponseWriter, r *http.Request) {
+	opts := wireguard.MobileConfigOptions{Platform: wireguard.MobileConfigIOS}
+	if r.FormValue("platform") == string(wireguard.MobileConfigMacOS) {
+		opts.Platform = wireguard.MobileConfigMacOS
+	}
+	opts.OnDemand, _ = strconv.ParseBool(r.FormValue("ondemand"))
+	for _, ssid := range r.Form["ssid"] {
+		if ssid = strings.TrimSpace(ssid); ssid != "" {
+			opts.TrustedSSIDs = append(opts.TrustedSSIDs, ssid)
+		}
+	}
+	s.serveTunnelClientFile(w, r, "mobileconfig", "application/x-apple-aspen-config", func(tunnelName string, client *pivpn.Client) string {
+		return client.ExportMobileConfig(tunnelName, opts)
+	})
+}
+
 func (s *Server) httpGetTunnelClientQR(w http.ResponseWriter, r *http.Request) {
 	_, tunnel, err := s.loadTunnel(r)
 	if err != nil {
@@ -340,6 +419,10 @@ func (s *Server) httpGetTunnelClientQR(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if client.External() {
+		s.serveError(w, http.StatusNotFound, fmt.Errorf("%w: %s", pivpn.ErrExternalKey, client.Name))
+		return
+	}
 
 	size := -5
 	if fs := r.FormValue("size"); fs != "" {
@@ -355,6 +438,45 @@ func (s *Server) httpGetTunnelClientQR(w http.ResponseWriter, r *http.Request) {
 	_ = client.WriteQrCode(w, size)
 }
 
+func (s *Server) httpGetTunnelClientQRSVG(w http.ResponseWriter, r *http.Request) {
+	_, tunnel, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	client, err := s.loadClient(r, tunnel)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	if client.External() {
+		s.serveError(w, http.StatusNotFound, fmt.Errorf("%w: %s", pivpn.ErrExternalKey, client.Name))
+		return
+	}
+
+	size := 0
+	if fs := r.FormValue("size"); fs != "" {
+		if s, err := strconv.ParseInt(fs, 10, 0); err == nil {
+			size = int(s)
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Disposition", "inline")
+	h.Set("Content-Type", "image/svg+xml")
+	w.WriteHeader(http.StatusOK)
+	_ = client.WriteQrCodeSVG(w, size)
+}
+
 func (s *Server) httpPOSTTunnelClientEnable(w http.ResponseWriter, r *http.Request) {
 	tunnelName, tunnel, err := s.loadTunnel(r)
 	if err != nil {
@@ -389,6 +511,7 @@ func (s *Server) httpPOSTTunnelClientEnable(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	comms <- ActionRequest{
+		Tunnel: tunnelName,
 		Request: api.Request{
 			Type: api.EnablePeerRequest,
 			ID:   nextReqId(),
@@ -406,7 +529,7 @@ func (s *Server) httpPOSTTunnelClientEnable(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	nextUrl := "/tunnel/" + tunnelName
+	nextUrl := "/tunnel/" + url.PathEscape(tunnelName)
 	if v := r.FormValue("next"); v != "" {
 		nextUrl = v
 	}
@@ -448,6 +571,7 @@ func (s *Server) httpPOSTTunnelClientDisable(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	comms <- ActionRequest{
+		Tunnel: tunnelName,
 		Request: api.Request{
 			Type: api.DisablePeerRequest,
 			ID:   nextReqId(),
@@ -465,7 +589,7 @@ func (s *Server) httpPOSTTunnelClientDisable(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	nextUrl := "/tunnel/" + tunnelName
+	nextUrl := "/tunnel/" + url.PathEscape(tunnelName)
 	if v := r.FormValue("next"); v != "" {
 		nextUrl = v
 	}
@@ -473,6 +597,51 @@ func (s *Server) httpPOSTTunnelClientDisable(w http.ResponseWriter, r *http.Requ
 	http.Redirect(w, r, nextUrl, http.StatusFound)
 }
 
+func (s *Server) httpGetTunnelBackup(w http.ResponseWriter, r *http.Request) {
+	tunnelName, _, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	comms, ok := s.cache.Get(tunnelName)
+	if !ok {
+		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
+		return
+	}
+
+	resultChan := make(chan api.Response, 1)
+	comms <- ActionRequest{
+		Tunnel: tunnelName,
+		Request: api.Request{
+			Type: api.BackupRequest,
+			ID:   nextReqId(),
+		},
+		Response: resultChan,
+	}
+	result := <-resultChan
+	if result.Status != api.StatusOk {
+		s.serveError(w, http.StatusInternalServerError, errors.New(result.Err))
+		return
+	}
+	var backup api.BackupData
+	if _, err = backup.UnmarshalMsg(result.Data); err != nil {
+		s.serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s\"", strings.ReplaceAll(tunnelName, "/", "-"), backup.Name))
+	h.Set("Content-Type", "application/gzip")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(backup.Archive)
+}
+
 func (s *Server) httpPOSTTunnelClientCreate(w http.ResponseWriter, r *http.Request) {
 	tunnelName, tunnel, err := s.loadTunnel(r)
 	if err != nil {
@@ -485,6 +654,8 @@ func (s *Server) httpPOSTTunnelClientCreate(w http.ResponseWriter, r *http.Reque
 	}
 
 	clientName := r.PostFormValue("name")
+	addresses := strings.TrimSpace(r.PostFormValue("addresses"))
+	expiry := strings.TrimSpace(r.PostFormValue("expires"))
 
 	comms, ok := s.cache.Get(tunnelName)
 	if !ok {
@@ -492,15 +663,239 @@ func (s *Server) httpPOSTTunnelClientCreate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	result := api.Response{}
 	resultChan := make(chan api.Response, 1)
-	data, err := api.CreateRequestData{Name: clientName}.MarshalMsg(nil)
+	expires, err := pivpn.ParseExpiry(expiry, time.Now())
+	if err != nil {
+		result.Err = err.Error()
+	} else {
+		data, err := (&api.CreateRequestData{Name: clientName, Addresses: []string{addresses}, Expires: expires}).MarshalMsg(nil)
+		if err != nil {
+			s.serveError(w, http.StatusInternalServerError, err)
+			return
+		}
+		comms <- ActionRequest{
+			Tunnel: tunnelName,
+			Request: api.Request{
+				Type: api.CreatePeerRequest,
+				ID:   nextReqId(),
+				Data: data,
+			},
+			Response: resultChan,
+		}
+		result = <-resultChan
+	}
+	if result.Status != api.StatusOk {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = s.view.Render(
+			w,
+			"tunnels/show",
+			web.C{
+				"Title":      fmt.Sprintf("%s - %s", tunnelName, tunnel.Endpoint.String()),
+				"TunnelName": tunnelName,
+				"Tunnel":     tunnel,
+				"Error":      result.Err,
+				"FormValue":  clientName,
+				"FormAddr":   addresses,
+				"FormExpiry": expiry,
+			},
+			r.Context(),
+		)
+		return
+	}
+
+	if s.refreshTunnel(w, comms, resultChan, tunnelName) {
+		return
+	}
+
+	http.Redirect(w, r, strings.Join([]string{"/tunnel", url.PathEscape(tunnelName), clientName}, "/"), http.StatusFound)
+}
+
+// maxImportSize is the largest CSV file accepted by httpPOSTTunnelImport.
+const maxImportSize = 1 << 20
+
+func (s *Server) httpPOSTTunnelImport(w http.ResponseWriter, r *http.Request) {
+	tunnelName, tunnel, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize+1<<10)
+	if err = r.ParseMultipartForm(maxImportSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		s.serveError(w, http.StatusBadRequest, err)
+		return
+	}
+	csv := []byte(r.PostFormValue("csv"))
+	if file, _, err := r.FormFile("file"); err == nil {
+		csv, err = io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			s.serveError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	dryRun, _ := strconv.ParseBool(r.PostFormValue("dry_run"))
+
+	comms, ok := s.cache.Get(tunnelName)
+	if !ok {
+		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
+		return
+	}
+
+	resultChan := make(chan api.Response, 1)
+	data, err := (&api.ImportRequestData{CSV: csv, DryRun: dryRun}).MarshalMsg(nil)
 	if err != nil {
 		s.serveError(w, http.StatusInternalServerError, err)
 		return
 	}
 	comms <- ActionRequest{
+		Tunnel: tunnelName,
 		Request: api.Request{
-			Type: api.CreatePeerRequest,
+			Type: api.ImportRequest,
+			ID:   nextReqId(),
+			Data: data,
+		},
+		Response: resultChan,
+	}
+	result := <-resultChan
+	imported := api.ImportData{}
+	if result.Status == api.StatusOk {
+		if _, err = imported.UnmarshalMsg(result.Data); err != nil {
+			s.serveError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	failed := result.Status != api.StatusOk || slices.ContainsFunc(imported.Results, func(r api.ImportResult) bool { return r.Err != "" })
+
+	if !failed && !dryRun {
+		if s.refreshTunnel(w, comms, resultChan, tunnelName) {
+			return
+		}
+		tunnel = s.cache.GetTunnel(tunnelName)
+	}
+
+	// rendered instead of redirecting, so that the results are only shown once
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	c := web.C{
+		"Title":         fmt.Sprintf("%s - %s", tunnelName, tunnel.Endpoint.String()),
+		"TunnelName":    tunnelName,
+		"Tunnel":        tunnel,
+		"ImportError":   result.Err,
+		"ImportResults": imported.Results,
+		"ImportDryRun":  dryRun,
+		"ImportFailed":  failed,
+	}
+	if failed || dryRun {
+		c["FormCSV"] = string(csv)
+	}
+	_ = s.view.Render(w, "tunnels/show", c, r.Context())
+}
+
+func (s *Server) httpPOSTTunnelClientRemove(w http.ResponseWriter, r *http.Request) {
+	tunnelName, tunnel, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	client, err := s.loadClient(r, tunnel)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	comms, ok := s.cache.Get(tunnelName)
+	if !ok {
+		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
+		return
+	}
+
+	resultChan := make(chan api.Response, 1)
+	data, err := api.DeleteRequestData{Name: client.Name}.MarshalMsg(nil)
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	comms <- ActionRequest{
+		Tunnel: tunnelName,
+		Request: api.Request{
+			Type: api.DeletePeerRequest,
+			ID:   nextReqId(),
+			Data: data,
+		},
+		Response: resultChan,
+	}
+	result := <-resultChan
+	if result.Status != api.StatusOk {
+		s.serveError(w, http.StatusInternalServerError, errors.New(result.Err))
+		return
+	}
+
+	if s.refreshTunnel(w, comms, resultChan, tunnelName) {
+		return
+	}
+
+	http.Redirect(w, r, "/tunnel/"+url.PathEscape(tunnelName), http.StatusFound)
+}
+
+func (s *Server) httpPOSTTunnelClientRename(w http.ResponseWriter, r *http.Request) {
+	tunnelName, tunnel, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	client, err := s.loadClient(r, tunnel)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	newName := strings.TrimSpace(r.PostFormValue("name"))
+
+	comms, ok := s.cache.Get(tunnelName)
+	if !ok {
+		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
+		return
+	}
+
+	resultChan := make(chan api.Response, 1)
+	data, err := api.RenameRequestData{Name: client.Name, NewName: newName}.MarshalMsg(nil)
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	comms <- ActionRequest{
+		Tunnel: tunnelName,
+		Request: api.Request{
+			Type: api.RenamePeerRequest,
 			ID:   nextReqId(),
 			Data: data,
 		},
@@ -512,13 +907,14 @@ func (s *Server) httpPOSTTunnelClientCreate(w http.ResponseWriter, r *http.Reque
 		w.WriteHeader(http.StatusBadRequest)
 		_ = s.view.Render(
 			w,
-			"tunnels/show",
+			"tunnels/client",
 			web.C{
-				"Title":      fmt.Sprintf("%s - %s", tunnelName, tunnel.Endpoint.String()),
+				"Title":      fmt.Sprintf("%[3]s @ %[1]s - %[2]s", tunnelName, tunnel.Endpoint.String(), client.Name),
 				"TunnelName": tunnelName,
 				"Tunnel":     tunnel,
+				"Client":     client,
 				"Error":      result.Err,
-				"FormValue":  clientName,
+				"FormValue":  newName,
 			},
 			r.Context(),
 		)
@@ -529,10 +925,10 @@ func (s *Server) httpPOSTTunnelClientCreate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	http.Redirect(w, r, strings.Join([]string{"/tunnel", tunnelName, clientName}, "/"), http.StatusFound)
+	http.Redirect(w, r, strings.Join([]string{"/tunnel", url.PathEscape(tunnelName), newName}, "/"), http.StatusFound)
 }
 
-func (s *Server) httpPOSTTunnelClientRemove(w http.ResponseWriter, r *http.Request) {
+func (s *Server) httpPOSTTunnelClientRotate(w http.ResponseWriter, r *http.Request) {
 	tunnelName, tunnel, err := s.loadTunnel(r)
 	if err != nil {
 		if errors.Is(err, ErrTunnelNotFound) {
@@ -553,6 +949,8 @@ func (s *Server) httpPOSTTunnelClientRemove(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	pskOnly, _ := strconv.ParseBool(r.PostFormValue("psk_only"))
+
 	comms, ok := s.cache.Get(tunnelName)
 	if !ok {
 		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
@@ -560,14 +958,15 @@ func (s *Server) httpPOSTTunnelClientRemove(w http.ResponseWriter, r *http.Reque
 	}
 
 	resultChan := make(chan api.Response, 1)
-	data, err := api.DeleteRequestData{Name: client.Name}.MarshalMsg(nil)
+	data, err := api.RotateRequestData{Name: client.Name, PSKOnly: pskOnly}.MarshalMsg(nil)
 	if err != nil {
 		s.serveError(w, http.StatusInternalServerError, err)
 		return
 	}
 	comms <- ActionRequest{
+		Tunnel: tunnelName,
 		Request: api.Request{
-			Type: api.DeletePeerRequest,
+			Type: api.RotatePeerRequest,
 			ID:   nextReqId(),
 			Data: data,
 		},
@@ -578,10 +977,123 @@ func (s *Server) httpPOSTTunnelClientRemove(w http.ResponseWriter, r *http.Reque
 		s.serveError(w, http.StatusInternalServerError, errors.New(result.Err))
 		return
 	}
+	rotated := new(pivpn.Client)
+	if _, err = rotated.UnmarshalMsg(result.Data); err != nil {
+		s.serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if s.refreshTunnel(w, comms, resultChan, tunnelName) {
+		return
+	}
+
+	// rendered instead of redirecting, so that the notice is only shown once
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_ = s.view.Render(
+		w,
+		"tunnels/client",
+		web.C{
+			"Title":      fmt.Sprintf("%[3]s @ %[1]s - %[2]s", tunnelName, tunnel.Endpoint.String(), rotated.Name),
+			"TunnelName": tunnelName,
+			"Tunnel":     s.cache.GetTunnel(tunnelName),
+			"Client":     rotated,
+			"Notice":     "The keys were rotated: import this configuration again, the previous one no longer works.",
+		},
+		r.Context(),
+	)
+}
+
+func (s *Server) httpPOSTTunnelClientMeta(w http.ResponseWriter, r *http.Request) {
+	tunnelName, tunnel, err := s.loadTunnel(r)
+	if err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	client, err := s.loadClient(r, tunnel)
+	if err != nil {
+		if errors.Is(err, ErrClientNotFound) {
+			s.serveError(w, http.StatusNotFound, err)
+		} else {
+			s.serveError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	meta := pivpn.Metadata{
+		Owner:       strings.TrimSpace(r.PostFormValue("owner")),
+		Email:       strings.TrimSpace(r.PostFormValue("email")),
+		Description: strings.TrimSpace(r.PostFormValue("description")),
+		Expires:     client.Meta.Expires,
+	}
+	for _, tag := range strings.Split(r.PostFormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	formExpiry := strings.TrimSpace(r.PostFormValue("expires"))
+
+	renderErr := func(msg string) {
+		edited := *client
+		edited.Meta = meta
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = s.view.Render(
+			w,
+			"tunnels/client",
+			web.C{
+				"Title":      fmt.Sprintf("%[3]s @ %[1]s - %[2]s", tunnelName, tunnel.Endpoint.String(), client.Name),
+				"TunnelName": tunnelName,
+				"Tunnel":     tunnel,
+				"Client":     &edited,
+				"MetaError":  msg,
+				"FormExpiry": formExpiry,
+			},
+			r.Context(),
+		)
+	}
+
+	if meta.Expires, err = pivpn.ParseExpiry(formExpiry, time.Now()); err != nil {
+		renderErr(err.Error())
+		return
+	}
+
+	comms, ok := s.cache.Get(tunnelName)
+	if !ok {
+		s.serveError(w, http.StatusServiceUnavailable, fmt.Errorf("no communication channel with %q available", tunnelName))
+		return
+	}
+
+	resultChan := make(chan api.Response, 1)
+	reqData := &api.MetadataRequestData{Name: client.Name, Meta: meta}
+	data, err := reqData.MarshalMsg(nil)
+	if err != nil {
+		s.serveError(w, http.StatusInternalServerError, err)
+		return
+	}
+	comms <- ActionRequest{
+		Tunnel: tunnelName,
+		Request: api.Request{
+			Type: api.SetMetadataRequest,
+			ID:   nextReqId(),
+			Data: data,
+		},
+		Response: resultChan,
+	}
+	result := <-resultChan
+	if result.Status != api.StatusOk {
+		renderErr(result.Err)
+		return
+	}
 
 	if s.refreshTunnel(w, comms, resultChan, tunnelName) {
 		return
 	}
 
-	http.Redirect(w, r, "/tunnel/"+tunnelName, http.StatusFound)
+	http.Redirect(w, r, strings.Join([]string{"/tunnel", url.PathEscape(tunnelName), client.Name}, "/"), http.StatusFound)
 }
@@ -0,0 +1,27 @@
+package orchestrator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerRoutes(t *testing.T) {
+	mux := (&Server{}).loadRoutes().(*http.ServeMux)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		// clients may be named like the files of the tunnel
+		{"/tunnel/host/backup.tar.gz", "GET /tunnel/{name}/{client}"},
+		{"/tunnel/host%2Fwg1/backup.tar.gz", "GET /tunnel/{name}/{client}"},
+		{"/tunnel/host/-/backup.tar.gz", "GET /tunnel/{name}/-/backup.tar.gz"},
+		{"/tunnel/host/alice1/conf", "GET /tunnel/{name}/{client}/conf"},
+	}
+	for _, tt := range tests {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, tt.path, nil)); pattern != tt.want {
+			t.Errorf("GET %s is routed to %q, want %q", tt.path, pattern, tt.want)
+		}
+	}
+}
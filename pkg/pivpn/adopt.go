@@ -0,0 +1,131 @@
+package pivpn
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// unmanaged returns whether a tunnel peer has no client configuration, as when it was added by hand.
+func (v *Vpn) unmanaged(peer *wireguard.Peer) bool {
+	if peer.Name == "" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(v.configsDir, peer.Name+".conf"))
+	return os.IsNotExist(err)
+}
+
+// UnmanagedPeers returns the tunnel peers without a client configuration, which can be adopted with AdoptPeer.
+func (v *Vpn) UnmanagedPeers() ([]wireguard.Peer, error) {
+	lock, err := fsutil.LockFile(v.lockFilePath, false, v.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	server, _, err := v.readTunnel()
+	if err != nil {
+		return nil, err
+	}
+	var peers []wireguard.Peer
+	for _, peer := range server.Peers {
+		if v.unmanaged(&peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+// AdoptPeer brings an unmanaged peer, given by its name or public key, under management as the client name. The
+// tunnel peer is only renamed, and gets a clients.txt entry.
+//
+// The client gets a full configuration if the keys of the peer are in the keys dir. Otherwise, it is external: its
+// configuration is a stub marked as such, which can't be exported, but the client can be enabled, disabled, renamed
+// and removed like the others.
+func (v *Vpn) AdoptPeer(peer, name string) error {
+	if err := validateClientName(name); err != nil {
+		return err
+	}
+	if peer == "" {
+		return fmt.Errorf("%w: empty name", ErrPeerNotFound)
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// the unmanaged peers make the loading fail otherwise
+	tolerant := v.Tolerant
+	v.Tolerant = true
+	defer func() { v.Tolerant = tolerant }()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Server.Peers, func(p wireguard.Peer) bool {
+			return (p.Name == peer || p.PublicKey.String() == peer) && v.unmanaged(&p)
+		})
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", ErrPeerNotFound, peer)
+		}
+		p := v.Server.Peers[idx]
+		for i, other := range v.Server.Peers {
+			if i != idx && other.Name == name {
+				return fmt.Errorf("%w: %s", ErrClientExists, name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(v.configsDir, name+".conf")); err == nil {
+			return fmt.Errorf("%w: %s", ErrClientExists, filepath.Join(v.configsDir, name+".conf"))
+		}
+
+		// the allowed IPs outside the tunnel subnets are networks routed through the client
+		var addresses []netip.Prefix
+		for _, address := range peerAddresses(&v.Server, &p) {
+			if slices.ContainsFunc(v.Server.Interface.Addresses, func(subnet netip.Prefix) bool { return subnet.Masked().Contains(address.Addr()) }) {
+				addresses = append(addresses, address)
+			}
+		}
+		if len(addresses) == 0 {
+			return fmt.Errorf("%w: peer %s has no address in %v", ErrAddressOutOfRange, peer, v.Server.Interface.Addresses)
+		}
+
+		keys := &Keys{Name: name, PresharedKey: p.PresharedKey}
+		if p.Name != "" {
+			if known, err := ReadKeysFromFS(p.Name, os.DirFS(v.keysDir)); err == nil && *known.PublicKey() == p.PublicKey {
+				keys.PrivateKey = known.PrivateKey
+			}
+		}
+
+		client := v.newClient(keys, addresses, time.Now())
+		client.Disabled = p.Disabled
+		if client.External() {
+			client.ExternalKey = p.PublicKey
+			tx.WriteFile(filepath.Join(v.configsDir, name+".conf"), []byte(externalKeyComment+client.Export()), 0640)
+		} else {
+			tx.WriteFile(filepath.Join(v.configsDir, name+".conf"), []byte(client.Export()), 0640)
+			if p.Name != name {
+				for _, suffix := range []string{"_priv", "_pub", "_psk"} {
+					tx.Remove(filepath.Join(v.keysDir, p.Name+suffix))
+				}
+			}
+			tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_priv"), []byte(keys.PrivateKey.String()), 0640, 0, 0)
+			tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_pub"), []byte(keys.PrivateKey.Public().String()), 0640, 0, 0)
+			tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_psk"), []byte(keys.PresharedKey.String()), 0640, 0, 0)
+
+			if err := ensureDir(v.Conf.UserConfigPath, v.Conf.UserId, v.Conf.GroupId); err != nil {
+				return err
+			}
+			tx.WriteFile(filepath.Join(v.Conf.UserConfigPath, name+".conf"), []byte(client.Export()), 0640)
+		}
+
+		if p.Name != "" {
+			delete(v.skipped, p.Name)
+			v.Warnings = slices.DeleteFunc(v.Warnings, func(w Warning) bool { return w.Client == p.Name })
+		}
+		v.Server.Peers[idx].Name = name
+		v.Clients = append(slices.Clone(v.Clients), client)
+		return nil
+	})
+}
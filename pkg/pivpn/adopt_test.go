@@ -0,0 +1,100 @@
+package pivpn
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+func TestVpnAdoptPeer(t *testing.T) {
+	v, dir := testInstall(t)
+
+	// a site router without name nor keys, and a peer whose keys are known
+	router, _ := wireguard.NewPrivateKey()
+	keys := NewKeys("c3")
+	tunnel, err := os.ReadFile(v.tunnelFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel = append(tunnel, []byte("\n[Peer]\nPublicKey = "+router.Public().String()+"\nAllowedIPs = 10.6.0.10/32, 192.168.10.0/24\n"+
+		"\n### begin c3 ###\n[Peer]\nPublicKey = "+keys.PublicKey().String()+"\nPresharedKey = "+keys.PresharedKey.String()+"\nAllowedIPs = 10.6.0.11/32\n### end c3 ###\n")...)
+	if err = os.WriteFile(v.tunnelFilePath, tunnel, 0640); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, key := range map[string]string{"_priv": keys.PrivateKey.String(), "_psk": keys.PresharedKey.String()} {
+		if err = os.WriteFile(filepath.Join(v.keysDir, "c3"+suffix), []byte(key), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = v.Reload(); err == nil {
+		t.Fatalf("Reload() with unmanaged peers error = nil")
+	}
+	// as the daemon, which keeps working with unmanaged peers
+	v.SetTolerant(true)
+	peers, err := v.UnmanagedPeers()
+	if err != nil || len(peers) != 2 || peers[0].PublicKey != *router.Public() || peers[1].Name != "c3" {
+		t.Fatalf("UnmanagedPeers() = %v, %v, want the router and c3", peers, err)
+	}
+
+	if err = v.AdoptPeer(router.Public().String(), "router1"); err != nil {
+		t.Fatalf("AdoptPeer() error = %v", err)
+	}
+	if err = v.AdoptPeer(router.Public().String(), "router2"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("AdoptPeer() twice error = %v, want %v", err, ErrPeerNotFound)
+	}
+	client := v.Clients.Client("router1")
+	if client == nil || !client.External() || client.PublicKey() != *router.Public() {
+		t.Fatalf("AdoptPeer() client = %v, want an external client with the router key", client)
+	}
+	if err = client.WriteQrCode(io.Discard, 1); !errors.Is(err, ErrExternalKey) {
+		t.Errorf("WriteQrCode() error = %v, want %v", err, ErrExternalKey)
+	}
+	if _, err = os.Stat(filepath.Join(v.Conf.UserConfigPath, "router1.conf")); err == nil {
+		t.Errorf("AdoptPeer() wrote the stub in the user configs")
+	}
+	if err = v.RotateClientKeys("router1", true); !errors.Is(err, ErrExternalKey) {
+		t.Errorf("RotateClientKeys(pskOnly) error = %v, want %v", err, ErrExternalKey)
+	}
+	if err = v.DisableClient("router1"); err != nil {
+		t.Errorf("DisableClient() error = %v", err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("adopting the keys needs to chown them to root")
+	}
+	if err = v.AdoptPeer("c3", "c4"); err != nil {
+		t.Fatalf("AdoptPeer() error = %v", err)
+	}
+	if c4 := v.Clients.Client("c4"); c4 == nil || c4.External() || c4.Interface.PrivateKey != keys.PrivateKey || c4.Peers[0].PresharedKey != keys.PresharedKey {
+		t.Errorf("AdoptPeer() client = %v, want the keys of c3", c4)
+	}
+	if got := readFiles(t, v.keysDir); got["c3_priv"] != "" || got["c4_priv"] != keys.PrivateKey.String() {
+		t.Errorf("AdoptPeer() keys = %v, want the keys of c3 moved to c4", got)
+	}
+
+	v.SetTolerant(false)
+	if err = v.Reload(); err != nil {
+		t.Fatalf("Reload() after adoption error = %v", err)
+	}
+	if c := v.Clients.Client("router1"); c == nil || !c.External() || !c.Disabled || c.ExternalKey != *router.Public() {
+		t.Errorf("Reload() client = %v, want the disabled external router", c)
+	}
+	if problems, err := v.Doctor(false, false); err != nil || len(problems) > 0 {
+		t.Errorf("Doctor() after adoption = %v, %v, want none", problems, err)
+	}
+
+	if err = v.RotateClientKeys("router1", false); err != nil {
+		t.Fatalf("RotateClientKeys() error = %v", err)
+	}
+	if c := v.Clients.Client("router1"); c == nil || c.External() || !c.Disabled {
+		t.Errorf("RotateClientKeys() client = %v, want a disabled client with keys", c)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "configs", "router1.conf")); len(data) == 0 || string(data) != v.Clients.Client("router1").Export() {
+		t.Errorf("RotateClientKeys() config = %q", data)
+	}
+}
@@ -0,0 +1,354 @@
+package pivpn
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+const (
+	// BackupFormat is the version of the backup archive layout.
+	BackupFormat = 1
+
+	backupManifest   = "manifest.json"
+	backupSetupVars  = "setupVars.conf"
+	backupTunnel     = "tunnel.conf"
+	backupPiholeHost = "hosts.wireguard"
+	backupConfigsDir = "configs"
+	backupKeysDir    = "keys"
+	backupClientList = backupConfigsDir + "/clients.txt"
+
+	maxBackupFileSize = 1 << 20
+)
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupManifest describes a backup archive, it is its first entry.
+type BackupManifest struct {
+	Format int `json:"format"`
+	// Version is the version of the manager which made the backup.
+	Version string       `json:"version"`
+	Created time.Time    `json:"created"`
+	Tunnel  string       `json:"tunnel"`
+	Files   []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Backup is a copy of the files of a PiVPN tunnel, keyed by their path in the archive.
+//
+// The archive is a gzipped tar of the manifest, setupVars.conf, tunnel.conf, configs/ (the client configs,
+// clients.txt and released.txt), keys/ and hosts.wireguard if the pihole is used.
+type Backup struct {
+	Manifest BackupManifest
+	Files    map[string][]byte
+}
+
+// Backup copies the files of the tunnel under the shared lock.
+func (v *Vpn) Backup(version string) (*Backup, error) {
+	lock, err := fsutil.LockFile(v.lockFilePath, false, v.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	b := &Backup{
+		Manifest: BackupManifest{Format: BackupFormat, Version: version, Created: time.Now().UTC().Truncate(time.Second), Tunnel: strings.TrimSuffix(filepath.Base(v.tunnelFilePath), ".conf")},
+		Files:    make(map[string][]byte),
+	}
+	add := func(name, src string) error {
+		info, err := os.Stat(src)
+		if err != nil {
+			return IoError{err, src}
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return IoError{err, src}
+		}
+		sum := sha256.Sum256(data)
+		b.Files[name] = data
+		b.Manifest.Files = append(b.Manifest.Files, BackupFile{name, info.Mode().Perm(), hex.EncodeToString(sum[:])})
+		return nil
+	}
+
+	if err = add(backupSetupVars, v.setupVarsPath); err != nil {
+		return nil, err
+	}
+	if err = add(backupTunnel, v.tunnelFilePath); err != nil {
+		return nil, err
+	}
+	for _, dir := range []struct{ name, src string }{{backupConfigsDir, v.configsDir}, {backupKeysDir, v.keysDir}} {
+		entries, err := os.ReadDir(dir.src)
+		if err != nil {
+			return nil, IoError{err, dir.src}
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if err = add(path.Join(dir.name, entry.Name()), filepath.Join(dir.src, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err = os.Stat(v.piholeHostFilePath); err == nil {
+		if err = add(backupPiholeHost, v.piholeHostFilePath); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// FileName is the default name of the archive of the backup.
+func (b *Backup) FileName() string {
+	return fmt.Sprintf("%s-%s.tar.gz", b.Manifest.Tunnel, b.Manifest.Created.Format("20060102-150405"))
+}
+
+// Write writes the archive of the backup.
+func (b *Backup) Write(w io.Writer) error {
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	entry := func(name string, mode fs.FileMode, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: b.Manifest.Created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	if err = entry(backupManifest, 0644, manifest); err != nil {
+		return err
+	}
+	for _, file := range b.Manifest.Files {
+		if err = entry(file.Path, file.Mode, b.Files[file.Path]); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// validBackupPath returns whether the path can be part of a backup.
+func validBackupPath(name string) bool {
+	switch name {
+	case backupSetupVars, backupTunnel, backupPiholeHost:
+		return true
+	}
+	dir, base := path.Split(name)
+	return (dir == backupConfigsDir+"/" || dir == backupKeysDir+"/") && base != "" && base != "." && base != ".."
+}
+
+// ReadBackup reads a backup archive and validates it: its files must match the manifest, and the setupVars and
+// tunnel must parse. Broken clients are only reported by Restore, as they are by a tolerant Reload.
+func ReadBackup(r io.Reader) (*Backup, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+
+	b := &Backup{Files: make(map[string][]byte)}
+	var manifest []byte
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+		if hdr.Typeflag == tar.TypeDir && (hdr.Name == backupConfigsDir+"/" || hdr.Name == backupKeysDir+"/") {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalidBackup, hdr.Name)
+		}
+		if hdr.Name != backupManifest && !validBackupPath(hdr.Name) {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, hdr.Name)
+		}
+		if _, ok := b.Files[hdr.Name]; ok || (hdr.Name == backupManifest && manifest != nil) {
+			return nil, fmt.Errorf("%w: duplicate file %s", ErrInvalidBackup, hdr.Name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBackupFileSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+		if len(data) > maxBackupFileSize {
+			return nil, fmt.Errorf("%w: %s is too large", ErrInvalidBackup, hdr.Name)
+		}
+		if hdr.Name == backupManifest {
+			manifest = data
+		} else {
+			b.Files[hdr.Name] = data
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidBackup, backupManifest)
+	}
+	if err = json.Unmarshal(manifest, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidBackup, backupManifest, err)
+	}
+	if b.Manifest.Format != BackupFormat {
+		return nil, fmt.Errorf("%w: unsupported format %d", ErrInvalidBackup, b.Manifest.Format)
+	}
+	if err = b.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+	return b, nil
+}
+
+func (b *Backup) validate() error {
+	listed := make(map[string]bool)
+	for _, file := range b.Manifest.Files {
+		if !validBackupPath(file.Path) || listed[file.Path] {
+			return fmt.Errorf("unexpected manifest entry %s", file.Path)
+		}
+		listed[file.Path] = true
+		if file.Mode&^fs.ModePerm != 0 {
+			return fmt.Errorf("invalid mode %v of %s", file.Mode, file.Path)
+		}
+		data, ok := b.Files[file.Path]
+		if !ok {
+			return fmt.Errorf("missing file %s", file.Path)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != file.SHA256 {
+			return fmt.Errorf("checksum mismatch of %s", file.Path)
+		}
+	}
+	for name := range b.Files {
+		if !listed[name] {
+			return fmt.Errorf("%s is not in the manifest", name)
+		}
+	}
+
+	for _, name := range []string{backupSetupVars, backupTunnel, backupClientList} {
+		if _, ok := b.Files[name]; !ok {
+			return fmt.Errorf("missing file %s", name)
+		}
+	}
+	// the install user is only looked up by the restore, it may not exist here
+	envs, err := godotenv.UnmarshalBytes(b.Files[backupSetupVars])
+	if err != nil {
+		return fmt.Errorf("%s: %w", backupSetupVars, err)
+	}
+	for _, name := range []string{"pivpnHOST", "install_home", "install_user"} {
+		if _, ok := envs[name]; !ok {
+			return fmt.Errorf("%s: %w", backupSetupVars, &MissingSetupVar{name})
+		}
+	}
+	if _, err = wireguard.ParseConfig(bytes.NewReader(b.Files[backupTunnel]), b.Manifest.Tunnel); err != nil {
+		return fmt.Errorf("%s: %w", backupTunnel, err)
+	}
+	return nil
+}
+
+// Clients returns the names of the clients in the backup.
+func (b *Backup) Clients() []string {
+	var names []string
+	for _, file := range b.Manifest.Files {
+		if dir, base := path.Split(file.Path); dir == backupConfigsDir+"/" && strings.HasSuffix(base, ".conf") {
+			names = append(names, strings.TrimSuffix(base, ".conf"))
+		}
+	}
+	return names
+}
+
+// Restore reinstates the backup as the tunnel name, in the given PiVPN locations which may differ from the ones it
+// was made from. The client configs and keys which aren't in the backup are removed.
+//
+// The restored files are rolled back if the tunnel can't be loaded, the clients which can't be are only reported as
+// warnings. The tunnel isn't reloaded.
+func (b *Backup) Restore(name, pivpnSetupVars, tunnelDir, configsDir, keysDir string) ([]Warning, error) {
+	return newVpn(name, pivpnSetupVars, tunnelDir, configsDir, keysDir).restore(b)
+}
+
+func (v *Vpn) restore(b *Backup) ([]Warning, error) {
+	for _, dir := range []string{filepath.Dir(v.setupVarsPath), filepath.Dir(v.tunnelFilePath), v.configsDir, v.keysDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, IoError{err, dir}
+		}
+	}
+
+	lock, err := fsutil.LockFile(v.lockFilePath, true, v.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	tx := &fsutil.Transaction{}
+	for _, dir := range []struct{ name, dst string }{{backupConfigsDir, v.configsDir}, {backupKeysDir, v.keysDir}} {
+		entries, err := os.ReadDir(dir.dst)
+		if err != nil {
+			return nil, IoError{err, dir.dst}
+		}
+		for _, entry := range entries {
+			if _, ok := b.Files[path.Join(dir.name, entry.Name())]; !ok && entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				tx.Remove(filepath.Join(dir.dst, entry.Name()))
+			}
+		}
+	}
+	for _, file := range b.Manifest.Files {
+		var dst string
+		switch dir, base := path.Split(file.Path); {
+		case file.Path == backupSetupVars:
+			dst = v.setupVarsPath
+		case file.Path == backupTunnel:
+			dst = v.tunnelFilePath
+		case file.Path == backupPiholeHost:
+			if _, err = os.Stat(filepath.Dir(v.piholeHostFilePath)); err != nil {
+				continue
+			}
+			dst = v.piholeHostFilePath
+		case dir == backupConfigsDir+"/":
+			dst = filepath.Join(v.configsDir, base)
+		case dir == backupKeysDir+"/":
+			dst = filepath.Join(v.keysDir, base)
+		}
+		tx.WriteFile(dst, b.Files[file.Path], file.Mode)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	v.Tolerant = true
+	if err = v.readSetupVars(); err == nil {
+		err = v.load()
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return nil, errors.Join(err, rerr)
+		}
+		return nil, err
+	}
+	return v.Warnings, nil
+}
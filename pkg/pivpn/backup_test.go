@@ -0,0 +1,142 @@
+package pivpn
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeBackup(t *testing.T, b *Backup) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	v, dir := testInstall(t)
+	backup, err := v.Backup("test")
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+
+	b, err := ReadBackup(bytes.NewReader(writeBackup(t, backup)))
+	if err != nil {
+		t.Fatalf("ReadBackup() error = %v", err)
+	}
+	if b.Manifest.Version != "test" || b.Manifest.Tunnel != "wg0" {
+		t.Errorf("ReadBackup() manifest = %+v", b.Manifest)
+	}
+	if got, want := b.Clients(), []string{"a1", "b2"}; !slices.Equal(got, want) {
+		t.Errorf("Clients() = %v, want %v", got, want)
+	}
+
+	// restore as wg1 in another layout, over a stale client
+	target := t.TempDir()
+	r := newVpn("wg1", filepath.Join(target, "pivpn", "setupVars.conf"), filepath.Join(target, "wireguard"), filepath.Join(target, "wireguard", "configs"), filepath.Join(target, "wireguard", "keys"))
+	r.piholeHostFilePath = filepath.Join(target, "pivpn", "hosts.wireguard")
+	for path, data := range map[string]string{r.configsDir: "c3.conf", r.keysDir: "c3_priv"} {
+		_ = os.MkdirAll(path, 0700)
+		if err = os.WriteFile(filepath.Join(path, data), []byte("stale"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	warnings, err := r.restore(b)
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("restore() = %v, %v", warnings, err)
+	}
+	if r.Server.Name != "wg1" || len(r.Clients) != 2 {
+		t.Errorf("restore() loaded %s with %d clients, want wg1 with 2", r.Server.Name, len(r.Clients))
+	}
+	if got, want := readFiles(t, r.keysDir), readFiles(t, v.keysDir); !maps.Equal(got, want) {
+		t.Errorf("restore() keys = %v, want %v", got, want)
+	}
+	if got, want := readFiles(t, r.configsDir), readFiles(t, v.configsDir); !maps.Equal(got, want) {
+		t.Errorf("restore() configs = %v, want %v", got, want)
+	}
+	if info, err := os.Stat(filepath.Join(r.keysDir, "a1_priv")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("restore() key mode = %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "hosts.wireguard")); err == nil {
+		t.Errorf("restore() wrote the hosts file of the backed up install")
+	}
+}
+
+func TestReadBackupInvalid(t *testing.T) {
+	v, _ := testInstall(t)
+	backup, err := v.Backup("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawArchive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name]))})
+			_, _ = tw.Write([]byte(files[name]))
+		}
+		_ = tw.Close()
+		_ = gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		archive func() []byte
+	}{
+		{"not an archive", func() []byte { return []byte("backup") }},
+		{"no manifest", func() []byte { return rawArchive(map[string]string{"setupVars.conf": ""}) }},
+		{"path traversal", func() []byte { return rawArchive(map[string]string{"configs/../../etc/passwd": ""}) }},
+		{
+			"checksum mismatch",
+			func() []byte {
+				b := &Backup{backup.Manifest, maps.Clone(backup.Files)}
+				b.Files["keys/a1_priv"] = []byte("tampered")
+				return writeBackup(t, b)
+			},
+		},
+		{
+			"unlisted file",
+			func() []byte {
+				manifest, _ := json.Marshal(backup.Manifest)
+				files := map[string]string{"manifest.json": string(manifest), "keys/c3_priv": "unlisted"}
+				for name, data := range backup.Files {
+					files[name] = string(data)
+				}
+				return rawArchive(files)
+			},
+		},
+		{
+			"invalid tunnel",
+			func() []byte {
+				b := &Backup{backup.Manifest, maps.Clone(backup.Files)}
+				b.Manifest.Files = slices.Clone(b.Manifest.Files)
+				b.Files[backupTunnel] = []byte("[Interface]\nAddress = invalid\n")
+				sum := sha256.Sum256(b.Files[backupTunnel])
+				b.Manifest.Files[slices.IndexFunc(b.Manifest.Files, func(f BackupFile) bool { return f.Path == backupTunnel })].SHA256 = hex.EncodeToString(sum[:])
+				return writeBackup(t, b)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadBackup(bytes.NewReader(tt.archive())); !errors.Is(err, ErrInvalidBackup) {
+				t.Errorf("ReadBackup() error = %v, want %v", err, ErrInvalidBackup)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"log/slog"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -34,26 +35,63 @@ type Client struct {
 
 	Disabled     bool      `msg:"disabled"`
 	CreationDate time.Time `msg:"created"`
+	Meta         Metadata  `msg:"meta"`
+	// ExternalKey is the public key of an external client, see External.
+	ExternalKey wireguard.Key `msg:"external_key,omitzero"`
 }
 
+// externalKeyComment marks the configuration stub of an external client.
+const externalKeyComment = "# external key: the private key of this client is unknown, this configuration can't be used\n"
+
 var (
 	invalidDNSChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
 )
 
+// External returns whether the client was adopted without its private key. Its configuration is only a stub, which
+// can't be exported.
+func (c *Client) External() bool {
+	return c.Interface.PrivateKey.IsZero()
+}
+
+// PublicKey returns the public key of the client, the one of its tunnel peer if it is external.
+func (c *Client) PublicKey() wireguard.Key {
+	if c.External() {
+		return c.ExternalKey
+	}
+	return *c.Interface.PrivateKey.Public()
+}
+
 func (c *Client) DNSName() string {
 	return invalidDNSChars.ReplaceAllLiteralString(c.Name, "-")
 }
 
+// IPv4 returns the first IPv4 address of the client, which PiVPN records in clients.txt.
+func (c *Client) IPv4() netip.Addr {
+	for _, address := range c.Interface.Addresses {
+		if address.Addr().Is4() {
+			return address.Addr()
+		}
+	}
+	return netip.Addr{}
+}
+
 func (c *Client) ToPeer() wireguard.Peer {
+	allowedIPs := make([]netip.Prefix, len(c.Interface.Addresses))
+	for i, address := range c.Interface.Addresses {
+		allowedIPs[i] = netip.PrefixFrom(address.Addr(), address.Addr().BitLen())
+	}
 	return wireguard.Peer{
 		Name:         c.Name,
-		PublicKey:    *c.Interface.PrivateKey.Public(),
+		PublicKey:    c.PublicKey(),
 		PresharedKey: c.Peers[0].PresharedKey,
-		AllowedIPs:   []netip.Prefix{netip.PrefixFrom(c.Interface.Addresses[0].Addr(), 32)},
+		AllowedIPs:   allowedIPs,
 	}
 }
 
 func (c *Client) WriteQrCode(w io.Writer, size int) error {
+	if c.External() {
+		return fmt.Errorf("%w: %s", ErrExternalKey, c.Name)
+	}
 	img, err := qrcode.New(c.Export(), qrcode.High)
 	if err != nil {
 		return err
@@ -61,14 +99,66 @@ func (c *Client) WriteQrCode(w io.Writer, size int) error {
 	return img.Write(size, w)
 }
 
+// WriteQrCodeSVG writes the QR code as an SVG image, each module being size pixels wide.
+// If size is 0 or less, the image has no intrinsic size and scales to its container.
+func (c *Client) WriteQrCodeSVG(w io.Writer, size int) error {
+	if c.External() {
+		return fmt.Errorf("%w: %s", ErrExternalKey, c.Name)
+	}
+	img, err := qrcode.New(c.Export(), qrcode.High)
+	if err != nil {
+		return err
+	}
+	bits := img.Bitmap()
+	n := len(bits)
+
+	dimensions := ""
+	if size > 0 {
+		dimensions = fmt.Sprintf(` width="%[1]d" height="%[1]d"`, n*size)
+	}
+
+	// one rectangle per horizontal run of dark modules
+	var path strings.Builder
+	for y := range bits {
+		for x := 0; x < len(bits[y]); x++ {
+			if !bits[y][x] {
+				continue
+			}
+			start := x
+			for x < len(bits[y]) && bits[y][x] {
+				x++
+			}
+			_, _ = fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+
+	_, err = fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %[1]d %[1]d"%[2]s shape-rendering="crispEdges">`+
+		`<rect width="%[1]d" height="%[1]d" fill="#fff"/><path d="%[3]s" fill="#000"/></svg>`+"\n", n, dimensions, path.String())
+	return err
+}
+
+// WriteQrCodeTerminal writes the QR code with UTF-8 half blocks, two modules per character.
+// The dark modules are drawn as blanks for terminals with a dark background, unless invert is set.
+func (c *Client) WriteQrCodeTerminal(w io.Writer, invert bool) error {
+	if c.External() {
+		return fmt.Errorf("%w: %s", ErrExternalKey, c.Name)
+	}
+	img, err := qrcode.New(c.Export(), qrcode.Low)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, img.ToSmallString(invert))
+	return err
+}
+
 func (c *ClientList) ToClientInfoList() ClientInfoList {
 	l := make(ClientInfoList, len(*c))
 	for i, client := range *c {
 		l[i] = ClientInfo{
 			Name:         client.Name,
-			PublicKey:    *client.Interface.PrivateKey.Public(),
+			PublicKey:    client.PublicKey(),
 			CreationDate: client.CreationDate,
-			IPAddr:       client.Interface.Addresses[0].Addr(),
+			IPAddr:       client.IPv4(),
 		}
 	}
 
@@ -84,6 +174,18 @@ func (c *ClientList) Client(name string) *Client {
 	return nil
 }
 
+// Expiring returns the enabled clients expiring before now+within, soonest first.
+func (c ClientList) Expiring(now time.Time, within time.Duration) []Client {
+	var expiring []Client
+	for _, client := range c {
+		if !client.Disabled && !client.Meta.Expires.IsZero() && client.Meta.Expires.Before(now.Add(within)) {
+			expiring = append(expiring, client)
+		}
+	}
+	slices.SortStableFunc(expiring, func(a, b Client) int { return a.Meta.Expires.Compare(b.Meta.Expires) })
+	return expiring
+}
+
 type ClientInfo struct {
 	Name         string
 	PublicKey    wireguard.Key
@@ -98,6 +200,9 @@ func int2ip(nn uint32) netip.Addr {
 }
 
 func ip2int(ip netip.Addr) uint32 {
+	if !ip.Is4() {
+		return 0
+	}
 	bytes := ip.As4()
 	return binary.BigEndian.Uint32(bytes[:])
 }
@@ -143,6 +248,36 @@ func ParseClientList(input io.Reader) (ClientInfoList, error) {
 	return clients, nil
 }
 
+// parseClientLines parses each line of clients.txt on its own, skipping the invalid and duplicate lines whose errors
+// are returned.
+func parseClientLines(input io.Reader) (ClientInfoList, []error) {
+	var clients ClientInfoList
+	var errs []error
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(input)
+	for num := 1; scanner.Scan(); num++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		list, err := ParseClientList(strings.NewReader(line))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid clients.txt line %d: %w", num, err))
+			continue
+		}
+		if names[list[0].Name] {
+			errs = append(errs, fmt.Errorf("duplicate clients.txt entry for %s on line %d", list[0].Name, num))
+			continue
+		}
+		names[list[0].Name] = true
+		clients = append(clients, list[0])
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return clients, errs
+}
+
 func (c ClientInfoList) AsMap() map[string]ClientInfo {
 	m := make(map[string]ClientInfo, len(c))
 	for _, info := range c {
@@ -0,0 +1,128 @@
+package pivpn
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// testQrClient returns a client which can be exported.
+func testQrClient() *Client {
+	client := testClient("alice1", "10.6.0.2/24")
+	key, _ := wireguard.NewPrivateKey()
+	server, _ := wireguard.NewPrivateKey()
+	client.Interface.PrivateKey = *key
+	client.Peers[0] = wireguard.Peer{
+		PublicKey:  *server.Public(),
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		Endpoint:   wireguard.Endpoint{Host: "vpn.example.com", Port: 51820},
+	}
+	return &client
+}
+
+// testBitmap returns the modules of the QR code of the client, as the Write functions encode it.
+func testBitmap(t *testing.T, client *Client, level qrcode.RecoveryLevel) [][]bool {
+	t.Helper()
+	img, err := qrcode.New(client.Export(), level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img.Bitmap()
+}
+
+func TestClientWriteQrCodeSVG(t *testing.T) {
+	client := testQrClient()
+	want := testBitmap(t, client, qrcode.High)
+	n := len(want)
+
+	var out strings.Builder
+	if err := client.WriteQrCodeSVG(&out, 4); err != nil {
+		t.Fatalf("WriteQrCodeSVG() error = %v", err)
+	}
+	var svg struct {
+		XMLName xml.Name `xml:"svg"`
+		ViewBox string   `xml:"viewBox,attr"`
+		Width   string   `xml:"width,attr"`
+		Path    struct {
+			D string `xml:"d,attr"`
+		} `xml:"path"`
+	}
+	if err := xml.Unmarshal([]byte(out.String()), &svg); err != nil {
+		t.Fatalf("WriteQrCodeSVG() isn't well-formed: %v\n%s", err, out.String())
+	}
+	if svg.ViewBox != fmt.Sprintf("0 0 %d %d", n, n) || svg.Width != strconv.Itoa(4*n) {
+		t.Errorf("WriteQrCodeSVG() viewBox = %q, width = %q, want %d modules of 4 pixels", svg.ViewBox, svg.Width, n)
+	}
+
+	got := make([][]bool, n)
+	for y := range got {
+		got[y] = make([]bool, n)
+	}
+	for _, run := range regexp.MustCompile(`M(\d+) (\d+)h(\d+)v1h-\d+z`).FindAllStringSubmatch(svg.Path.D, -1) {
+		x, _ := strconv.Atoi(run[1])
+		y, _ := strconv.Atoi(run[2])
+		w, _ := strconv.Atoi(run[3])
+		for i := x; i < x+w && y < n && i < n; i++ {
+			got[y][i] = true
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteQrCodeSVG() modules differ from the QR code")
+	}
+
+	out.Reset()
+	svg.Width = ""
+	if err := client.WriteQrCodeSVG(&out, 0); err != nil {
+		t.Fatalf("WriteQrCodeSVG(0) error = %v", err)
+	}
+	if err := xml.Unmarshal([]byte(out.String()), &svg); err != nil || svg.Width != "" {
+		t.Errorf("WriteQrCodeSVG(0) width = %q, %v, want no intrinsic size", svg.Width, err)
+	}
+}
+
+func TestClientWriteQrCodeTerminal(t *testing.T) {
+	client := testQrClient()
+	want := testBitmap(t, client, qrcode.Low)
+	n := len(want)
+
+	for _, invert := range []bool{false, true} {
+		var out strings.Builder
+		if err := client.WriteQrCodeTerminal(&out, invert); err != nil {
+			t.Fatalf("WriteQrCodeTerminal(%v) error = %v", invert, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if len(lines) != (n+1)/2 {
+			t.Fatalf("WriteQrCodeTerminal(%v) has %d lines, want %d", invert, len(lines), (n+1)/2)
+		}
+
+		// the filled half blocks are the light modules, or the dark ones when inverted
+		got := make([][]bool, n)
+		for y := range got {
+			got[y] = make([]bool, n)
+		}
+		for i, line := range lines {
+			runes := []rune(line)
+			if len(runes) != n {
+				t.Fatalf("WriteQrCodeTerminal(%v) line %d has %d modules, want %d", invert, i, len(runes), n)
+			}
+			for x, r := range runes {
+				got[2*i][x] = (r == '█' || r == '▀') == invert
+				if 2*i+1 < n {
+					got[2*i+1][x] = (r == '█' || r == '▄') == invert
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("WriteQrCodeTerminal(%v) modules differ from the QR code\n%s", invert, out.String())
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package pivpn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// OrphansDirName is the directory of the configs dir where Vpn.Doctor moves the files without a peer when pruning.
+const OrphansDirName = "orphans"
+
+// ProblemKind is a class of inconsistency between the PiVPN files, found by Vpn.Doctor.
+type ProblemKind int
+
+const (
+	// ProblemClientList is a missing, invalid, duplicate or outdated entry of clients.txt.
+	ProblemClientList ProblemKind = iota
+	// ProblemOrphanClient is an entry of clients.txt without a peer in the tunnel.
+	ProblemOrphanClient
+	// ProblemMissingConfig is a peer without a valid client configuration.
+	ProblemMissingConfig
+	// ProblemOrphanConfig is a client configuration without a peer in the tunnel.
+	ProblemOrphanConfig
+	// ProblemKeyMismatch is a peer or key file whose keys don't match the client configuration.
+	ProblemKeyMismatch
+	// ProblemMissingKeys is a peer without valid key files.
+	ProblemMissingKeys
+	// ProblemOrphanKeys are key files without a peer in the tunnel.
+	ProblemOrphanKeys
+	// ProblemAddressMismatch is a peer whose allowed IPs aren't the client addresses.
+	ProblemAddressMismatch
+	// ProblemDuplicateAddress is a client using the address of the server or of a previous client.
+	ProblemDuplicateAddress
+	// ProblemUserConfig is a missing or outdated copy of the client configuration in the user directory.
+	ProblemUserConfig
+	// ProblemOrphanUserConfig is a copy of a client configuration without a peer in the tunnel.
+	ProblemOrphanUserConfig
+	// ProblemHosts is an outdated pihole hosts file.
+	ProblemHosts
+)
+
+var problemKindNames = [...]string{
+	ProblemClientList:       "client-list",
+	ProblemOrphanClient:     "orphan-client",
+	ProblemMissingConfig:    "missing-config",
+	ProblemOrphanConfig:     "orphan-config",
+	ProblemKeyMismatch:      "key-mismatch",
+	ProblemMissingKeys:      "missing-keys",
+	ProblemOrphanKeys:       "orphan-keys",
+	ProblemAddressMismatch:  "address-mismatch",
+	ProblemDuplicateAddress: "duplicate-address",
+	ProblemUserConfig:       "user-config",
+	ProblemOrphanUserConfig: "orphan-user-config",
+	ProblemHosts:            "hosts",
+}
+
+// Prunable returns whether the problem is a file without a peer, which is only moved away when pruning.
+func (k ProblemKind) Prunable() bool {
+	return k == ProblemOrphanConfig || k == ProblemOrphanKeys || k == ProblemOrphanUserConfig
+}
+
+func (k ProblemKind) String() string {
+	if int(k) < len(problemKindNames) {
+		return problemKindNames[k]
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+type Problem struct {
+	Kind ProblemKind
+	// Client is the name of the client concerned, if any.
+	Client  string
+	Why     string
+	Fixable bool
+	Fixed   bool
+}
+
+func (p Problem) String() string {
+	if p.Client == "" {
+		return fmt.Sprintf("%s: %s", p.Kind, p.Why)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Kind, p.Client, p.Why)
+}
+
+// clientFile is a client configuration read from the configs dir.
+type clientFile struct {
+	conf    *wireguard.Config
+	data    []byte
+	modTime time.Time
+	err     error
+}
+
+type doctor struct {
+	v        *Vpn
+	tx       *fsutil.Transaction
+	problems []Problem
+	// orphansDir is where the files without a peer are moved to when pruning, empty otherwise
+	orphansDir string
+	pruned     bool
+}
+
+func (d *doctor) report(kind ProblemKind, client string, fixable bool, format string, args ...any) {
+	d.problems = append(d.problems, Problem{Kind: kind, Client: client, Why: fmt.Sprintf(format, args...), Fixable: fixable})
+}
+
+// Doctor cross-checks the tunnel peers with clients.txt, the client configurations, the keys, the user copies of the
+// configurations and the pihole hosts file, and returns the problems found. Unlike Reload, it only needs the tunnel
+// configuration to be valid.
+//
+// The client configurations are the reference, as the devices use them: peers, keys and clients.txt entries are
+// rewritten to match them, and missing configurations are regenerated from the keys when possible. Clients with the
+// address of another one get new addresses, and must import their configuration again.
+//
+// The configurations, keys and user copies without a peer may be the only copy of a device's private key, they are
+// only fixed if prune is set too, by moving them to a new directory in OrphansDirName of the configs dir.
+//
+// If fix is set, the fixable problems are repaired in a single transaction and the tunnel is reloaded.
+func (v *Vpn) Doctor(fix, prune bool) ([]Problem, error) {
+	lock, err := fsutil.LockFile(v.lockFilePath, fix, v.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	d := &doctor{v: v, tx: &fsutil.Transaction{}}
+	if prune {
+		d.orphansDir = filepath.Join(v.configsDir, OrphansDirName, time.Now().Format("20060102-150405"))
+	}
+	original, err := d.diagnose()
+	if err != nil {
+		return nil, err
+	}
+	if !fix || !slices.ContainsFunc(d.problems, func(p Problem) bool { return p.Fixable }) {
+		return d.problems, nil
+	}
+
+	if err = ensureDir(v.Conf.UserConfigPath, v.Conf.UserId, v.Conf.GroupId); err != nil {
+		return d.problems, err
+	}
+	if d.pruned {
+		if err = os.MkdirAll(d.orphansDir, 0700); err != nil {
+			return d.problems, err
+		}
+	}
+	if err = d.tx.Commit(); err != nil {
+		return d.problems, err
+	}
+	if v.synced == nil {
+		v.synced = original
+	}
+	rollback := func(err error, reloaded bool) error {
+		errs := []error{err, d.tx.Rollback()}
+		v.Server = *original
+		if reloaded {
+			errs = append(errs, v.reloadTunnel(false))
+		}
+		return errors.Join(errs...)
+	}
+	if err = v.reloadTunnel(false); err != nil {
+		return d.problems, rollback(err, false)
+	}
+	if d.tx.Changed(v.piholeHostFilePath) {
+		if err = v.run(v.ReloadCmds.Pihole, nil); err != nil {
+			return d.problems, rollback(err, true)
+		}
+	}
+
+	for i := range d.problems {
+		d.problems[i].Fixed = d.problems[i].Fixable
+	}
+	return d.problems, nil
+}
+
+// diagnose reports the problems and stages their fixes, returning the tunnel configuration as read.
+// The vpn holds the fixed tunnel and clients afterward.
+func (d *doctor) diagnose() (*wireguard.Config, error) {
+	v := d.v
+
+	tunnelFile, err := os.Open(v.tunnelFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tunnelFile.Close() }()
+	server, err := wireguard.ParseConfig(tunnelFile, strings.TrimSuffix(filepath.Base(v.tunnelFilePath), ".conf"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", v.tunnelFilePath, err)
+	}
+	original := server.Clone()
+	v.Server = *server
+
+	infos, err := d.readClientList()
+	if err != nil {
+		return nil, err
+	}
+	configs, err := readClientFiles(v.configsDir)
+	if err != nil {
+		return nil, err
+	}
+	userConfigs, err := readClientFiles(v.Conf.UserConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	keyNames, err := readKeyNames(v.keysDir)
+	if err != nil {
+		return nil, err
+	}
+	ipam, err := v.ipam()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[netip.Addr]bool)
+	for _, address := range v.Server.Interface.Addresses {
+		used[address.Addr()] = true
+	}
+	for _, peer := range v.Server.Peers {
+		for _, ip := range peer.AllowedIPs {
+			if ip.IsSingleIP() {
+				used[ip.Addr()] = true
+			}
+		}
+	}
+	for _, file := range configs {
+		if file.conf != nil {
+			for _, address := range file.conf.Interface.Addresses {
+				used[address.Addr()] = true
+			}
+		}
+	}
+	// the addresses of the server and of the previous clients, which the next ones must not use
+	seen := make(map[netip.Addr]bool)
+	for _, address := range v.Server.Interface.Addresses {
+		seen[address.Addr()] = true
+	}
+
+	v.Clients, v.skipped = nil, make(map[string]ClientInfo)
+	var newInfos ClientInfoList
+	peers := make(map[string]bool, len(v.Server.Peers))
+	for i := range v.Server.Peers {
+		peer := &v.Server.Peers[i]
+		name := peer.Name
+		if name == "" {
+			d.report(ProblemMissingConfig, "", false, "peer %s has no name", peer.PublicKey)
+			markSeen(seen, peer)
+			continue
+		}
+		peers[name] = true
+
+		info, hasInfo := infos[name]
+		file := configs[name]
+		keys, keysErr := ReadKeysFromFS(name, os.DirFS(v.keysDir))
+
+		rewrite := false
+		var client Client
+		switch {
+		case file != nil && file.err == nil:
+			client = Client{Config: *file.conf, Disabled: peer.Disabled, CreationDate: file.modTime}
+		case keysErr == nil && *keys.PublicKey() == peer.PublicKey:
+			client = v.newClient(keys, peerAddresses(&v.Server, peer), time.Now())
+			client.Disabled = peer.Disabled
+			rewrite = true
+			d.report(ProblemMissingConfig, name, true, "configuration is %s, it can be regenerated from the keys", describeClientFile(file))
+		default:
+			d.report(ProblemMissingConfig, name, false, "configuration is %s and there is no matching private key", describeClientFile(file))
+			if hasInfo {
+				newInfos = append(newInfos, info)
+			}
+			v.skipped[name] = info
+			markSeen(seen, peer)
+			continue
+		}
+		if hasInfo {
+			client.CreationDate = info.CreationDate
+		}
+
+		if client.External() {
+			// the tunnel is the only reference for the public key
+			client.ExternalKey = peer.PublicKey
+		}
+		pub := client.PublicKey()
+		if peer.PublicKey != pub {
+			d.report(ProblemKeyMismatch, name, true, "tunnel public key %s doesn't match the client private key", peer.PublicKey)
+			peer.PublicKey = pub
+		}
+		if psk := client.Peers[0].PresharedKey; peer.PresharedKey != psk {
+			d.report(ProblemKeyMismatch, name, true, "tunnel preshared key doesn't match the client one")
+			peer.PresharedKey = psk
+		}
+
+		writeKeys := false
+		if client.External() {
+			// there are no keys to write
+		} else if keysErr != nil {
+			d.report(ProblemMissingKeys, name, true, "keys are missing or invalid: %v", keysErr)
+			writeKeys = true
+		} else if pubData, err := os.ReadFile(filepath.Join(v.keysDir, name+"_pub")); err != nil ||
+			keys.PrivateKey != client.Interface.PrivateKey || keys.PresharedKey != client.Peers[0].PresharedKey ||
+			strings.TrimSpace(string(pubData)) != pub.String() {
+			d.report(ProblemKeyMismatch, name, true, "key files don't match the client configuration")
+			writeKeys = true
+		}
+
+		var duplicates []netip.Addr
+		for _, address := range client.Interface.Addresses {
+			if seen[address.Addr()] {
+				duplicates = append(duplicates, address.Addr())
+			}
+		}
+		if len(duplicates) > 0 {
+			allocated, err := ipam.Allocate(v.Server.Interface.Addresses, used, nil, time.Now())
+			if err != nil {
+				d.report(ProblemDuplicateAddress, name, false, "address %v is already used: %v", duplicates, err)
+			} else {
+				addresses := slices.Clone(client.Interface.Addresses)
+				for j, address := range addresses {
+					if !slices.Contains(duplicates, address.Addr()) {
+						continue
+					}
+					for _, a := range allocated {
+						if a.Addr().BitLen() == address.Addr().BitLen() {
+							addresses[j] = a
+							used[a.Addr()] = true
+						}
+					}
+				}
+				d.report(ProblemDuplicateAddress, name, true, "address %v is already used, new addresses %v", duplicates, addresses)
+				client.Interface.Addresses = addresses
+				rewrite = true
+			}
+		}
+		for _, address := range client.Interface.Addresses {
+			seen[address.Addr()] = true
+		}
+
+		// keep the allowed IPs routing networks behind the client
+		allowedIPs := slices.DeleteFunc(slices.Clone(peer.AllowedIPs), netip.Prefix.IsSingleIP)
+		allowedIPs = append(client.ToPeer().AllowedIPs, allowedIPs...)
+		if !slices.Equal(allowedIPs, peer.AllowedIPs) {
+			if len(duplicates) == 0 {
+				d.report(ProblemAddressMismatch, name, true, "tunnel allowed IPs %v don't match the client addresses", peer.AllowedIPs)
+			}
+			peer.AllowedIPs = allowedIPs
+		}
+
+		data := []byte(client.Export())
+		if rewrite {
+			d.tx.WriteFile(filepath.Join(v.configsDir, name+".conf"), data, 0640)
+		} else {
+			data = file.data
+		}
+		if writeKeys {
+			d.tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_priv"), []byte(client.Interface.PrivateKey.String()), 0640, 0, 0)
+			d.tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_pub"), []byte(pub.String()), 0640, 0, 0)
+			d.tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_psk"), []byte(client.Peers[0].PresharedKey.String()), 0640, 0, 0)
+		}
+
+		if userConfig := userConfigs[name]; client.External() {
+			// the stub is of no use to the user
+		} else if userConfig == nil || !bytes.Equal(userConfig.data, data) {
+			if userConfig == nil {
+				d.report(ProblemUserConfig, name, true, "copy in %s is missing", v.Conf.UserConfigPath)
+			} else if !rewrite {
+				d.report(ProblemUserConfig, name, true, "copy in %s is outdated", v.Conf.UserConfigPath)
+			}
+			d.tx.WriteFile(filepath.Join(v.Conf.UserConfigPath, name+".conf"), data, 0640)
+		}
+
+		newInfo := ClientInfo{name, pub, client.CreationDate, client.IPv4()}
+		if !hasInfo {
+			d.report(ProblemClientList, name, true, "missing from clients.txt")
+		} else if info.PublicKey != newInfo.PublicKey || info.IPAddr != newInfo.IPAddr {
+			d.report(ProblemClientList, name, true, "clients.txt entry is outdated")
+		}
+		newInfos = append(newInfos, newInfo)
+		v.Clients = append(v.Clients, client)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(infos)) {
+		if !peers[name] {
+			d.report(ProblemOrphanClient, name, true, "in clients.txt but not in the tunnel")
+		}
+	}
+	if slices.ContainsFunc(d.problems, func(p Problem) bool {
+		return p.Fixable && (p.Kind == ProblemClientList || p.Kind == ProblemOrphanClient)
+	}) {
+		d.tx.WriteFile(filepath.Join(v.configsDir, "clients.txt"), []byte(newInfos.Export()), 0644)
+	}
+
+	prune := d.orphansDir != ""
+	for _, name := range slices.Sorted(maps.Keys(configs)) {
+		if !peers[name] {
+			d.report(ProblemOrphanConfig, name, prune, "configuration without peer in the tunnel")
+			if err = d.prune(filepath.Join(v.configsDir, name+".conf"), name+".conf"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(keyNames)) {
+		if !peers[name] {
+			d.report(ProblemOrphanKeys, name, prune, "keys without peer in the tunnel")
+			for _, f := range []string{name + "_priv", name + "_psk", name + "_pub"} {
+				if err = d.prune(filepath.Join(v.keysDir, f), f); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(userConfigs)) {
+		if !peers[name] {
+			d.report(ProblemOrphanUserConfig, name, prune, "copy in %s without peer in the tunnel", v.Conf.UserConfigPath)
+			if err = d.prune(filepath.Join(v.Conf.UserConfigPath, name+".conf"), name+".user.conf"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !wireguard.Diff(original, &v.Server).IsEmpty() {
+		v.stageTunnel(d.tx)
+	}
+	if hosts, err := os.ReadFile(v.piholeHostFilePath); err == nil && string(hosts) != v.piholeHosts() {
+		d.report(ProblemHosts, "", true, "%s is outdated", v.piholeHostFilePath)
+		v.stagePihole(d.tx)
+	}
+
+	return original, nil
+}
+
+// prune stages the move of a file without a peer to the orphans dir as name, if pruning.
+func (d *doctor) prune(path, name string) error {
+	if d.orphansDir == "" {
+		return nil
+	}
+	d.pruned = true
+	return d.tx.Move(path, filepath.Join(d.orphansDir, name))
+}
+
+// readClientList reads clients.txt, reporting the invalid and duplicate entries.
+func (d *doctor) readClientList() (map[string]ClientInfo, error) {
+	file, err := os.Open(filepath.Join(d.v.configsDir, "clients.txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		d.report(ProblemClientList, "", true, "clients.txt is missing")
+		return map[string]ClientInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	infos, errs := parseClientLines(file)
+	for _, err := range errs {
+		d.report(ProblemClientList, "", true, "%v", err)
+	}
+	return infos.AsMap(), nil
+}
+
+// readClientFiles reads the client configurations of the directory, a missing directory has none.
+func readClientFiles(dir string) (map[string]*clientFile, error) {
+	files := make(map[string]*clientFile)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".conf")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		file := &clientFile{}
+		files[name] = file
+		if info, err := entry.Info(); err == nil {
+			file.modTime = info.ModTime()
+		}
+		if file.data, file.err = os.ReadFile(filepath.Join(dir, entry.Name())); file.err != nil {
+			continue
+		}
+		if file.conf, file.err = wireguard.ParseConfig(bytes.NewReader(file.data), name); file.err == nil && len(file.conf.Peers) == 0 {
+			file.err = errors.New("no server peer")
+		}
+	}
+	return files, nil
+}
+
+func describeClientFile(file *clientFile) string {
+	if file == nil {
+		return "missing"
+	}
+	return fmt.Sprintf("invalid (%v)", file.err)
+}
+
+// readKeyNames returns the names of the clients with key files, the server ones excluded.
+func readKeyNames(dir string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		for _, suffix := range []string{"_priv", "_pub", "_psk"} {
+			if name, ok := strings.CutSuffix(entry.Name(), suffix); ok && name != "server" {
+				names[name] = true
+			}
+		}
+	}
+	return names, nil
+}
+
+// markSeen records the addresses of a peer without client configuration.
+func markSeen(seen map[netip.Addr]bool, peer *wireguard.Peer) {
+	for _, ip := range peer.AllowedIPs {
+		if ip.IsSingleIP() {
+			seen[ip.Addr()] = true
+		}
+	}
+}
+
+// peerAddresses returns the addresses of the client of a peer, with the prefix length of the server subnets.
+func peerAddresses(server *wireguard.Config, peer *wireguard.Peer) []netip.Prefix {
+	var addresses []netip.Prefix
+	for _, ip := range peer.AllowedIPs {
+		if !ip.IsSingleIP() {
+			continue
+		}
+		bits := ip.Bits()
+		for _, address := range server.Interface.Addresses {
+			if address.Masked().Contains(ip.Addr()) {
+				bits = address.Bits()
+				break
+			}
+		}
+		addresses = append(addresses, netip.PrefixFrom(ip.Addr(), bits))
+	}
+	return addresses
+}
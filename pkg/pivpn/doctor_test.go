@@ -0,0 +1,241 @@
+package pivpn
+
+import (
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// testInstall writes a consistent PiVPN installation with the clients a1 (10.6.0.2) and b2 (10.6.0.3).
+func testInstall(t *testing.T) (*Vpn, string) {
+	t.Helper()
+	dir := t.TempDir()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Vpn{
+		setupVarsPath:      filepath.Join(dir, "setupVars.conf"),
+		tunnelFilePath:     filepath.Join(dir, "wg0.conf"),
+		piholeHostFilePath: filepath.Join(dir, "hosts.wireguard"),
+		lockFilePath:       filepath.Join(dir, LockFileName),
+		configsDir:         filepath.Join(dir, "configs"),
+		keysDir:            filepath.Join(dir, "keys"),
+		LockTimeout:        time.Second,
+		Conf: Config{
+			DNS:            []netip.Addr{netip.MustParseAddr("9.9.9.9")},
+			Endpoint:       wireguard.Endpoint{Host: "vpn.example.com", Port: 51820},
+			UserConfigPath: filepath.Join(dir, "home", "configs"),
+			UserId:         os.Getuid(),
+			GroupId:        os.Getgid(),
+		},
+	}
+	v.SetReloadCmds([]string{"true"}, []string{"true"})
+	for _, d := range []string{v.configsDir, v.keysDir, v.Conf.UserConfigPath} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverKey, _ := wireguard.NewPrivateKey()
+	v.Server = wireguard.Config{
+		Name: "wg0",
+		Interface: wireguard.Interface{
+			PrivateKey: *serverKey,
+			Addresses:  []netip.Prefix{netip.MustParsePrefix("10.6.0.1/24")},
+		},
+	}
+	files := map[string]string{}
+	for i, name := range []string{"a1", "b2"} {
+		keys := NewKeys(name)
+		client := v.newClient(keys, []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 6, 0, byte(i + 2)}), 24)}, time.Unix(1700000000, 0))
+		v.Clients = append(v.Clients, client)
+		peer := client.ToPeer()
+		v.Server.Peers = append(v.Server.Peers, peer)
+
+		files[filepath.Join(v.configsDir, name+".conf")] = client.Export()
+		files[filepath.Join(v.Conf.UserConfigPath, name+".conf")] = client.Export()
+		files[filepath.Join(v.keysDir, name+"_priv")] = keys.PrivateKey.String()
+		files[filepath.Join(v.keysDir, name+"_pub")] = keys.PublicKey().String()
+		files[filepath.Join(v.keysDir, name+"_psk")] = keys.PresharedKey.String()
+	}
+	files[v.setupVarsPath] = "pivpnDNS1=9.9.9.9\npivpnHOST=vpn.example.com\npivpnPORT=51820\ninstall_home=" + filepath.Join(dir, "home") + "\ninstall_user=" + u.Username + "\n"
+	files[v.tunnelFilePath] = v.Server.Export()
+	files[filepath.Join(v.configsDir, "clients.txt")] = v.Clients.ToClientInfoList().Export()
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Vpn{
+		setupVarsPath:      v.setupVarsPath,
+		tunnelFilePath:     v.tunnelFilePath,
+		piholeHostFilePath: v.piholeHostFilePath,
+		lockFilePath:       v.lockFilePath,
+		configsDir:         v.configsDir,
+		keysDir:            v.keysDir,
+		LockTimeout:        v.LockTimeout,
+		Conf:               v.Conf,
+		ReloadCmds:         v.ReloadCmds,
+	}, dir
+}
+
+func replaceInFile(t *testing.T, path, old, new string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), old) {
+		t.Fatalf("%s doesn't contain %q", path, old)
+	}
+	if err = os.WriteFile(path, []byte(strings.ReplaceAll(string(data), old, new)), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVpnDoctor(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string)
+		want    []ProblemKind
+	}{
+		{
+			"consistent",
+			func(t *testing.T, dir string) {},
+			nil,
+		},
+		{
+			"client list",
+			func(t *testing.T, dir string) {
+				path := filepath.Join(dir, "configs", "clients.txt")
+				data, _ := os.ReadFile(path)
+				lines := strings.SplitAfter(string(data), "\n")
+				_ = os.WriteFile(path, []byte(lines[1]+"invalid line\n"+"c3              "+strings.Fields(lines[0])[1]+" 1700000000  168165380\n"), 0644)
+			},
+			[]ProblemKind{ProblemClientList, ProblemClientList, ProblemOrphanClient},
+		},
+		{
+			"orphans",
+			func(t *testing.T, dir string) {
+				_ = os.WriteFile(filepath.Join(dir, "configs", "c3.conf"), []byte("[Interface]\n"), 0640)
+				_ = os.WriteFile(filepath.Join(dir, "keys", "c3_priv"), []byte("x"), 0640)
+				_ = os.WriteFile(filepath.Join(dir, "home", "configs", "c3.conf"), []byte("[Interface]\n"), 0640)
+			},
+			[]ProblemKind{ProblemOrphanConfig, ProblemOrphanKeys, ProblemOrphanUserConfig},
+		},
+		{
+			"missing config",
+			func(t *testing.T, dir string) {
+				_ = os.Remove(filepath.Join(dir, "configs", "b2.conf"))
+			},
+			[]ProblemKind{ProblemMissingConfig},
+		},
+		{
+			"keys",
+			func(t *testing.T, dir string) {
+				_ = os.WriteFile(filepath.Join(dir, "keys", "a1_pub"), []byte("invalid"), 0640)
+				_ = os.Remove(filepath.Join(dir, "keys", "b2_psk"))
+			},
+			[]ProblemKind{ProblemKeyMismatch, ProblemMissingKeys},
+		},
+		{
+			"duplicate address",
+			func(t *testing.T, dir string) {
+				replaceInFile(t, filepath.Join(dir, "wg0.conf"), "10.6.0.3/32", "10.6.0.2/32")
+				replaceInFile(t, filepath.Join(dir, "configs", "b2.conf"), "10.6.0.3/24", "10.6.0.2/24")
+			},
+			[]ProblemKind{ProblemDuplicateAddress},
+		},
+		{
+			"user config",
+			func(t *testing.T, dir string) {
+				_ = os.Remove(filepath.Join(dir, "home", "configs", "a1.conf"))
+			},
+			[]ProblemKind{ProblemUserConfig},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, dir := testInstall(t)
+			tt.corrupt(t, dir)
+
+			problems, err := v.Doctor(false, false)
+			if err != nil {
+				t.Fatalf("Doctor() error = %v", err)
+			}
+			var got []ProblemKind
+			for _, p := range problems {
+				got = append(got, p.Kind)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Doctor() = %v, want %v", problems, tt.want)
+			}
+
+			if os.Geteuid() != 0 {
+				t.Skip("fixing the keys needs to chown them to root")
+			}
+			if _, err = v.Doctor(true, true); err != nil {
+				t.Fatalf("Doctor(true, true) error = %v", err)
+			}
+			if problems, err = v.Doctor(false, false); err != nil || len(problems) > 0 {
+				t.Errorf("Doctor() after fix = %v, %v, want none", problems, err)
+			}
+			if err = v.Reload(); err != nil {
+				t.Errorf("Reload() after fix error = %v", err)
+			}
+		})
+	}
+}
+
+func TestVpnDoctorPrune(t *testing.T) {
+	v, dir := testInstall(t)
+	orphans := map[string]string{
+		filepath.Join(dir, "configs", "c3.conf"):         "c3.conf",
+		filepath.Join(dir, "keys", "c3_priv"):            "c3_priv",
+		filepath.Join(dir, "home", "configs", "c3.conf"): "c3.user.conf",
+	}
+	for path := range orphans {
+		if err := os.WriteFile(path, []byte("[Interface]\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// fixing alone keeps the orphans, which may hold the only private key of a device
+	problems, err := v.Doctor(true, false)
+	if err != nil || len(problems) != 3 || slices.ContainsFunc(problems, func(p Problem) bool { return p.Fixable || p.Fixed }) {
+		t.Fatalf("Doctor(true, false) = %v, %v, want 3 unfixable orphans", problems, err)
+	}
+	for path := range orphans {
+		if _, err = os.Stat(path); err != nil {
+			t.Errorf("Doctor(true, false) removed %s: %v", path, err)
+		}
+	}
+
+	if problems, err = v.Doctor(true, true); err != nil || len(problems) != 3 || !problems[0].Fixed {
+		t.Fatalf("Doctor(true, true) = %v, %v, want 3 fixed orphans", problems, err)
+	}
+	moved, _ := filepath.Glob(filepath.Join(dir, "configs", OrphansDirName, "*"))
+	if len(moved) != 1 {
+		t.Fatalf("Doctor(true, true) orphans dirs = %v, want one", moved)
+	}
+	for path, name := range orphans {
+		if _, err = os.Stat(path); err == nil {
+			t.Errorf("Doctor(true, true) kept %s", path)
+		}
+		if data, err := os.ReadFile(filepath.Join(moved[0], name)); err != nil || string(data) != "[Interface]\n" {
+			t.Errorf("Doctor(true, true) moved %s = %q, %v", name, data, err)
+		}
+	}
+	if problems, err = v.Doctor(false, false); err != nil || len(problems) > 0 {
+		t.Errorf("Doctor() after pruning = %v, %v, want none", problems, err)
+	}
+}
@@ -0,0 +1,16 @@
+package pivpn
+
+import (
+	"time"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+)
+
+const (
+	// LockFileName is the lock file in the PiVPN config dir. `pivpn` doesn't take it, wrap it with flock(1) to run it
+	// alongside the manager, e.g. `flock /etc/pivpn/wireguard/vpnmanager.lock pivpn add`.
+	LockFileName       = "vpnmanager.lock"
+	DefaultLockTimeout = 10 * time.Second
+)
+
+var ErrLockTimeout = fsutil.ErrLockTimeout
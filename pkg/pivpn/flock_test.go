@@ -0,0 +1,32 @@
+package pivpn
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+)
+
+func TestVpnConcurrentChange(t *testing.T) {
+	v, dir := testInstall(t)
+	clientsTxt := filepath.Join(dir, "configs", "clients.txt")
+
+	// a pivpn add without the lock appends to clients.txt while the mutation runs
+	err := v.mutate(func(tx *fsutil.Transaction) error {
+		file, err := os.OpenFile(clientsTxt, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString("c3 " + NewKeys("c3").PublicKey().String() + " 1700000000 10.6.0.4\n")
+		return errors.Join(err, file.Close())
+	})
+	if !errors.Is(err, ErrConcurrentChange) {
+		t.Fatalf("mutate() error = %v, want %v", err, ErrConcurrentChange)
+	}
+	if data, _ := os.ReadFile(clientsTxt); !strings.Contains(string(data), "c3 ") {
+		t.Errorf("mutate() overwrote the concurrent change of clients.txt:\n%s", data)
+	}
+}
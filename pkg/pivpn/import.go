@@ -0,0 +1,167 @@
+package pivpn
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+)
+
+// ErrBatchFailed is returned by AddClients when a client of the batch can't be created, none are then.
+var ErrBatchFailed = errors.New("no client was created")
+
+// errDryRun rolls back the mutation of a dry run.
+var errDryRun = errors.New("dry run")
+
+// importColumns are the columns of a clients CSV file without header, in order.
+var importColumns = []string{"name", "ip", "tags", "expires", "owner"}
+
+// ClientSpec is a client to create with AddClients.
+type ClientSpec struct {
+	// Line is the line of the client in its CSV file, if any.
+	Line int
+	Name string
+	// Addresses are the requested addresses of the client, the other ones are allocated automatically.
+	Addresses []netip.Addr
+	Meta      Metadata
+	// Err is why the client couldn't be parsed, it is reported by AddClients.
+	Err error
+}
+
+// ClientResult is the outcome of the creation of a client by AddClients.
+type ClientResult struct {
+	Line      int
+	Name      string
+	Addresses []netip.Prefix
+	Err       error
+}
+
+// splitCell splits a cell holding a list, separated by commas, semicolons or spaces.
+func splitCell(cell string) []string {
+	return strings.FieldsFunc(cell, func(r rune) bool { return r == ',' || r == ';' || unicode.IsSpace(r) })
+}
+
+// ParseClientsCSV reads the clients to create from a CSV file, with the expiries relative to now.
+//
+// The columns are name, ip, tags, expires and owner, in this order unless the first row is a header naming them; a
+// header can also have the email and description columns. The ip and tags cells are lists, separated by spaces or
+// semicolons. Lines starting with # are ignored. The rows which can't be parsed are returned with their Err set.
+func ParseClientsCSV(r io.Reader, now time.Time) ([]ClientSpec, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	columns := importColumns
+	var specs []ClientSpec
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if first && slices.ContainsFunc(record, func(cell string) bool { return strings.EqualFold(strings.TrimSpace(cell), "name") }) {
+			columns = make([]string, len(record))
+			for i, cell := range record {
+				columns[i] = strings.ToLower(strings.TrimSpace(cell))
+				if !slices.Contains(importColumns, columns[i]) && columns[i] != "email" && columns[i] != "description" {
+					return nil, fmt.Errorf("line %d: unknown column %q", line, cell)
+				}
+			}
+			continue
+		}
+
+		spec := ClientSpec{Line: line}
+		if len(record) > len(columns) {
+			spec.Err = fmt.Errorf("%d columns, expected at most %d", len(record), len(columns))
+		}
+		for i, cell := range record[:min(len(record), len(columns))] {
+			cell = strings.TrimSpace(cell)
+			var err error
+			switch columns[i] {
+			case "name":
+				spec.Name = cell
+			case "ip":
+				spec.Addresses, err = ParseAddrs(splitCell(cell))
+			case "tags":
+				spec.Meta.Tags = splitCell(cell)
+			case "expires":
+				spec.Meta.Expires, err = ParseExpiry(cell, now)
+			case "owner":
+				spec.Meta.Owner = cell
+			case "email":
+				spec.Meta.Email = cell
+			case "description":
+				spec.Meta.Description = cell
+			}
+			if err != nil && spec.Err == nil {
+				spec.Err = err
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// AddClients creates the clients in a single transaction, reloading the tunnel once. The clients requesting addresses
+// are created first, so that they get them.
+//
+// Every client is checked: if any can't be created, none is and ErrBatchFailed is returned with the result of each.
+// If dryRun is set, nothing is written and the results are the clients as they would be created.
+func (v *Vpn) AddClients(specs []ClientSpec, dryRun bool) ([]ClientResult, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var order []int
+	for _, requesting := range []bool{true, false} {
+		for i, spec := range specs {
+			if (len(spec.Addresses) > 0) == requesting {
+				order = append(order, i)
+			}
+		}
+	}
+
+	var results []ClientResult
+	err := v.mutate(func(tx *fsutil.Transaction) error {
+		results = make([]ClientResult, len(specs))
+		failed := false
+		for _, i := range order {
+			spec := specs[i]
+			results[i] = ClientResult{Line: spec.Line, Name: spec.Name, Err: spec.Err}
+			if results[i].Err == nil {
+				results[i].Err = validateClientName(spec.Name)
+			}
+			if results[i].Err == nil {
+				results[i].Err = spec.Meta.Validate()
+			}
+			if results[i].Err == nil {
+				results[i].Err = v.addClient(tx, spec.Name, spec.Meta, spec.Addresses)
+			}
+			if results[i].Err != nil {
+				failed = true
+				continue
+			}
+			results[i].Addresses = v.Clients[len(v.Clients)-1].Interface.Addresses
+		}
+		if failed {
+			return ErrBatchFailed
+		} else if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		return results, nil
+	}
+	return results, err
+}
@@ -0,0 +1,113 @@
+package pivpn
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClientsCSV(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		input   string
+		want    []ClientSpec
+		wantErr bool
+	}{
+		{
+			"positional",
+			"alice1,10.6.0.20,laptop;staff,30d,Alice\n# comment\nbob2\n",
+			[]ClientSpec{
+				{Line: 1, Name: "alice1", Addresses: []netip.Addr{netip.MustParseAddr("10.6.0.20")}, Meta: Metadata{Owner: "Alice", Tags: []string{"laptop", "staff"}, Expires: now.AddDate(0, 0, 30)}},
+				{Line: 3, Name: "bob2"},
+			},
+			false,
+		},
+		{
+			"header",
+			"Owner, Name, Email\nAlice,alice1,alice@example.com\n",
+			[]ClientSpec{
+				{Line: 2, Name: "alice1", Meta: Metadata{Owner: "Alice", Email: "alice@example.com"}},
+			},
+			false,
+		},
+		{
+			"invalid rows",
+			"alice1,10.6.0.x\nbob2,,,soon\ncarol3,,,,,extra\n",
+			[]ClientSpec{
+				{Line: 1, Name: "alice1", Err: errors.New("invalid address")},
+				{Line: 2, Name: "bob2", Err: errors.New("invalid expiry")},
+				{Line: 3, Name: "carol3", Err: errors.New("too many columns")},
+			},
+			false,
+		},
+		{
+			"unknown column",
+			"name,group\nalice1,staff\n",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientsCSV(strings.NewReader(tt.input), now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClientsCSV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseClientsCSV() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.Line != w.Line || g.Name != w.Name || !slices.Equal(g.Addresses, w.Addresses) || (g.Err != nil) != (w.Err != nil) ||
+					g.Meta.Owner != w.Meta.Owner || g.Meta.Email != w.Meta.Email || !slices.Equal(g.Meta.Tags, w.Meta.Tags) || !g.Meta.Expires.Equal(w.Meta.Expires) {
+					t.Errorf("ParseClientsCSV()[%d] = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestVpnAddClients(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating the keys needs to chown them to root")
+	}
+	v, _ := testInstall(t)
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel, _ := os.ReadFile(v.tunnelFilePath)
+
+	// the second client gets 10.6.0.4 although the first one comes first, as it requests it
+	specs := []ClientSpec{
+		{Line: 1, Name: "c3", Meta: Metadata{Tags: []string{"Staff"}}},
+		{Line: 2, Name: "d4", Addresses: []netip.Addr{netip.MustParseAddr("10.6.0.4")}},
+	}
+	results, err := v.AddClients(specs, true)
+	if err != nil || len(results) != 2 || results[0].Addresses[0].Addr() != netip.MustParseAddr("10.6.0.5") || results[1].Addresses[0].Addr() != netip.MustParseAddr("10.6.0.4") {
+		t.Fatalf("AddClients(dryRun) = %v, %v", results, err)
+	}
+	if after, _ := os.ReadFile(v.tunnelFilePath); string(after) != string(tunnel) || len(v.Clients) != 2 {
+		t.Errorf("AddClients(dryRun) changed the tunnel")
+	}
+
+	failing := append(slices.Clone(specs), ClientSpec{Line: 3, Name: "a1"}, ClientSpec{Line: 4, Name: "e5", Err: errors.New("invalid")})
+	results, err = v.AddClients(failing, false)
+	if !errors.Is(err, ErrBatchFailed) || results[0].Err != nil || !errors.Is(results[2].Err, ErrClientExists) || results[3].Err == nil {
+		t.Fatalf("AddClients() = %v, %v, want %v for a1 and e5", results, err, ErrBatchFailed)
+	}
+	if after, _ := os.ReadFile(v.tunnelFilePath); string(after) != string(tunnel) || len(v.Clients) != 2 {
+		t.Errorf("AddClients() of a failing batch changed the tunnel")
+	}
+
+	if results, err = v.AddClients(specs, false); err != nil {
+		t.Fatalf("AddClients() = %v, %v", results, err)
+	}
+	if err = v.Reload(); err != nil || len(v.Clients) != 4 || !v.Clients.Client("c3").Meta.HasTag("staff") {
+		t.Errorf("Reload() after AddClients() = %v, %v", v.Clients, err)
+	}
+}
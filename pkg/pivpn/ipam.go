@@ -0,0 +1,267 @@
+package pivpn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+var (
+	ErrAddressInUse      = errors.New("address already in use")
+	ErrAddressOutOfRange = errors.New("address is not in the tunnel subnets")
+	ErrNoFreeAddress     = errors.New("tunnel has no usable IP addresses left")
+)
+
+type ReusePolicy int
+
+const (
+	// ReuseLowest allocates the lowest free address, even if it was just released.
+	ReuseLowest ReusePolicy = iota
+	// ReuseAvoidRecent doesn't allocate the addresses released less than IPAM.ReuseAfter ago.
+	ReuseAvoidRecent
+)
+
+func ParseReusePolicy(s string) (ReusePolicy, error) {
+	switch s {
+	case "", "lowest":
+		return ReuseLowest, nil
+	case "avoid_recent":
+		return ReuseAvoidRecent, nil
+	default:
+		return ReuseLowest, fmt.Errorf("unknown reuse policy %q, expected lowest or avoid_recent", s)
+	}
+}
+
+// AddrRange is an inclusive range of addresses.
+type AddrRange struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+// ParseAddrRange parses a range written as `from-to`, as a CIDR prefix or as a single address.
+func ParseAddrRange(s string) (AddrRange, error) {
+	s = strings.TrimSpace(s)
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		r := AddrRange{}
+		var err error
+		if r.From, err = netip.ParseAddr(strings.TrimSpace(from)); err != nil {
+			return r, err
+		}
+		if r.To, err = netip.ParseAddr(strings.TrimSpace(to)); err != nil {
+			return r, err
+		}
+		if r.From.BitLen() != r.To.BitLen() || r.To.Less(r.From) {
+			return r, &wireguard.ParseError{Why: "Invalid address range", Offender: s}
+		}
+		return r, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return AddrRange{}, err
+		}
+		prefix = prefix.Masked()
+		return AddrRange{prefix.Addr(), lastAddr(prefix)}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return AddrRange{}, err
+	}
+	return AddrRange{addr, addr}, nil
+}
+
+func (r AddrRange) Contains(addr netip.Addr) bool {
+	return r.From.Compare(addr) <= 0 && addr.Compare(r.To) <= 0
+}
+
+func (r AddrRange) String() string {
+	if r.From == r.To {
+		return r.From.String()
+	}
+	return r.From.String() + "-" + r.To.String()
+}
+
+// lastAddr returns the last address of the prefix, which is the broadcast address for IPv4.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// ParseAddrs parses addresses given as separate values or separated by commas, ignoring the empty ones.
+func ParseAddrs(values []string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, value := range values {
+		for s := range strings.SplitSeq(value, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// IPAM allocates the addresses of new clients in the tunnel subnets.
+type IPAM struct {
+	// Reserved are never allocated automatically, but can be assigned explicitly.
+	Reserved []AddrRange
+	Reuse    ReusePolicy
+	// ReuseAfter is how long a released address isn't reused with ReuseAvoidRecent. If it's 0, they are never reused.
+	ReuseAfter time.Duration
+	// Released records when addresses were released, for ReuseAvoidRecent.
+	Released map[netip.Addr]time.Time
+}
+
+func (i *IPAM) IsReserved(addr netip.Addr) bool {
+	_, ok := i.reservedRange(addr)
+	return ok
+}
+
+// reservedRange returns the reserved range containing addr, if any.
+func (i *IPAM) reservedRange(addr netip.Addr) (AddrRange, bool) {
+	for _, r := range i.Reserved {
+		if r.Contains(addr) {
+			return r, true
+		}
+	}
+	return AddrRange{}, false
+}
+
+func (i *IPAM) recentlyReleased(addr netip.Addr, now time.Time) bool {
+	if i.Reuse != ReuseAvoidRecent {
+		return false
+	}
+	released, ok := i.Released[addr]
+	return ok && (i.ReuseAfter == 0 || now.Sub(released) < i.ReuseAfter)
+}
+
+// usable returns whether the address can be given to a client, i.e. isn't the network or broadcast address.
+func usable(netblock netip.Prefix, addr netip.Addr) bool {
+	if !netblock.Contains(addr) || addr == netblock.Masked().Addr() {
+		return false
+	}
+	return !addr.Is4() || netblock.Bits() >= 31 || addr != lastAddr(netblock)
+}
+
+// Allocate returns the addresses of a new client, one per address family of the netblocks, with their prefix length.
+// The requested addresses are used as is, the other ones are the lowest free address after the server's one.
+// The used addresses are the ones of the server and of the existing clients.
+func (i *IPAM) Allocate(netblocks []netip.Prefix, used map[netip.Addr]bool, requested []netip.Addr, now time.Time) ([]netip.Prefix, error) {
+	var addresses []netip.Prefix
+	var families []int
+	for _, netblock := range netblocks {
+		family := netblock.Addr().BitLen()
+		if slices.Contains(families, family) {
+			continue
+		}
+		families = append(families, family)
+
+		idx := slices.IndexFunc(requested, func(a netip.Addr) bool { return a.BitLen() == family })
+		if idx >= 0 {
+			ip := requested[idx]
+			if !usable(netblock, ip) {
+				return nil, fmt.Errorf("%w: %s is not usable in %s", ErrAddressOutOfRange, ip, netblock.Masked())
+			}
+			if used[ip] {
+				return nil, fmt.Errorf("%w: %s", ErrAddressInUse, ip)
+			}
+			addresses = append(addresses, netip.PrefixFrom(ip, netblock.Bits()))
+			continue
+		}
+
+		// get first address after the server's IP, skipping the reserved ranges at once as they can be huge in IPv6
+		ip := netblock.Addr().Next()
+		for netblock.Contains(ip) && (used[ip] || i.IsReserved(ip) || i.recentlyReleased(ip, now)) {
+			if r, ok := i.reservedRange(ip); ok {
+				ip = r.To.Next()
+			} else {
+				ip = ip.Next()
+			}
+		}
+		if !usable(netblock, ip) {
+			return nil, fmt.Errorf("%w in %s", ErrNoFreeAddress, netblock.Masked())
+		}
+		addresses = append(addresses, netip.PrefixFrom(ip, netblock.Bits()))
+	}
+
+	if len(addresses) == 0 {
+		return nil, errors.New("tunnel has no address")
+	}
+	for _, ip := range requested {
+		if !slices.ContainsFunc(addresses, func(p netip.Prefix) bool { return p.Addr() == ip }) {
+			return nil, fmt.Errorf("%w: %s", ErrAddressOutOfRange, ip)
+		}
+	}
+
+	return addresses, nil
+}
+
+// Release records that the addresses are free again, forgetting the ones that can be reused.
+func (i *IPAM) Release(addrs []netip.Addr, now time.Time) {
+	if i.Released == nil {
+		i.Released = make(map[netip.Addr]time.Time, len(addrs))
+	}
+	for addr, released := range i.Released {
+		if i.ReuseAfter > 0 && now.Sub(released) >= i.ReuseAfter {
+			delete(i.Released, addr)
+		}
+	}
+	for _, addr := range addrs {
+		i.Released[addr] = now
+	}
+}
+
+// ParseReleased parses the released addresses, one `<address> <unix time>` per line.
+func ParseReleased(input io.Reader) (map[netip.Addr]time.Time, error) {
+	released := make(map[netip.Addr]time.Time)
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, &wireguard.ParseError{Why: fmt.Sprintf("expected 2 fields in line, got %d", len(fields)), Offender: scanner.Text()}
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, &wireguard.ParseError{Why: "Invalid time", Offender: fields[1]}
+		}
+		released[addr] = time.Unix(unix, 0)
+	}
+	return released, scanner.Err()
+}
+
+func ExportReleased(released map[netip.Addr]time.Time) string {
+	addrs := make([]netip.Addr, 0, len(released))
+	for addr := range released {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	var builder strings.Builder
+	for _, addr := range addrs {
+		_, _ = fmt.Fprintf(&builder, "%s %d\n", addr, released[addr].Unix())
+	}
+	return builder.String()
+}
@@ -0,0 +1,150 @@
+package pivpn
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAddrRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"10.6.0.2-10.6.0.20", "10.6.0.2-10.6.0.20", false},
+		{"10.6.0.128/28", "10.6.0.128-10.6.0.143", false},
+		{"10.6.0.130/28", "10.6.0.128-10.6.0.143", false},
+		{"fd00::/126", "fd00::-fd00::3", false},
+		{" 10.6.0.9 ", "10.6.0.9", false},
+		{"10.6.0.20-10.6.0.2", "", true},
+		{"10.6.0.2-fd00::1", "", true},
+		{"printer", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseAddrRange(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAddrRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseAddrRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	now := time.Unix(1800000000, 0)
+	netblocks := []netip.Prefix{netip.MustParsePrefix("10.6.0.1/24"), netip.MustParsePrefix("fd00::1/64")}
+	used := map[netip.Addr]bool{
+		netip.MustParseAddr("10.6.0.1"): true,
+		netip.MustParseAddr("10.6.0.2"): true,
+		netip.MustParseAddr("fd00::1"):  true,
+	}
+
+	tests := []struct {
+		name      string
+		ipam      IPAM
+		netblocks []netip.Prefix
+		requested []string
+		want      []string
+		wantErr   error
+	}{
+		{"lowest", IPAM{}, netblocks, nil, []string{"10.6.0.3/24", "fd00::2/64"}, nil},
+		{
+			"reserved",
+			IPAM{Reserved: []AddrRange{{netip.MustParseAddr("10.6.0.3"), netip.MustParseAddr("10.6.0.9")}}},
+			netblocks, nil, []string{"10.6.0.10/24", "fd00::2/64"}, nil,
+		},
+		{
+			"static in reserved range",
+			IPAM{Reserved: []AddrRange{{netip.MustParseAddr("10.6.0.3"), netip.MustParseAddr("10.6.0.9")}}},
+			netblocks, []string{"10.6.0.5"}, []string{"10.6.0.5/24", "fd00::2/64"}, nil,
+		},
+		{"static ipv6", IPAM{}, netblocks, []string{"fd00::42"}, []string{"10.6.0.3/24", "fd00::42/64"}, nil},
+		{"static in use", IPAM{}, netblocks, []string{"10.6.0.2"}, nil, ErrAddressInUse},
+		{"static outside", IPAM{}, netblocks, []string{"10.7.0.2"}, nil, ErrAddressOutOfRange},
+		{"static broadcast", IPAM{}, netblocks, []string{"10.6.0.255"}, nil, ErrAddressOutOfRange},
+		{"static missing family", IPAM{}, netblocks[:1], []string{"fd00::42"}, nil, ErrAddressOutOfRange},
+		{
+			"lowest reuses released",
+			IPAM{Released: map[netip.Addr]time.Time{netip.MustParseAddr("10.6.0.3"): now}},
+			netblocks[:1], nil, []string{"10.6.0.3/24"}, nil,
+		},
+		{
+			"avoid recent",
+			IPAM{Reuse: ReuseAvoidRecent, ReuseAfter: time.Hour, Released: map[netip.Addr]time.Time{
+				netip.MustParseAddr("10.6.0.3"): now.Add(-time.Minute),
+				netip.MustParseAddr("10.6.0.4"): now.Add(-2 * time.Hour),
+			}},
+			netblocks[:1], nil, []string{"10.6.0.4/24"}, nil,
+		},
+		{
+			"avoid forever",
+			IPAM{Reuse: ReuseAvoidRecent, Released: map[netip.Addr]time.Time{
+				netip.MustParseAddr("10.6.0.3"): now.Add(-1000 * time.Hour),
+			}},
+			netblocks[:1], nil, []string{"10.6.0.4/24"}, nil,
+		},
+		{
+			"large reserved range",
+			IPAM{Reserved: []AddrRange{{netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::7fff:ffff:ffff:ffff")}}},
+			netblocks[1:], nil, []string{"fd00::8000:0:0:0/64"}, nil,
+		},
+		{
+			"full ipv6",
+			IPAM{Reserved: []AddrRange{{netip.MustParseAddr("fd00::"), netip.MustParseAddr("fd00::ffff:ffff:ffff:ffff")}}},
+			netblocks[1:], nil, nil, ErrNoFreeAddress,
+		},
+		{
+			"full",
+			IPAM{Reserved: []AddrRange{{netip.MustParseAddr("10.6.0.3"), netip.MustParseAddr("10.6.0.255")}}},
+			netblocks[:1], nil, nil, ErrNoFreeAddress,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested []netip.Addr
+			for _, r := range tt.requested {
+				requested = append(requested, netip.MustParseAddr(r))
+			}
+			got, err := tt.ipam.Allocate(tt.netblocks, used, requested, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Allocate() error = %v, want %v", err, tt.wantErr)
+			}
+			var want []netip.Prefix
+			for _, w := range tt.want {
+				want = append(want, netip.MustParsePrefix(w))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Allocate() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	now := time.Unix(1800000000, 0)
+	ipam := IPAM{Reuse: ReuseAvoidRecent, ReuseAfter: time.Hour, Released: map[netip.Addr]time.Time{
+		netip.MustParseAddr("10.6.0.3"): now.Add(-2 * time.Hour),
+		netip.MustParseAddr("10.6.0.4"): now.Add(-time.Minute),
+	}}
+	ipam.Release([]netip.Addr{netip.MustParseAddr("10.6.0.5")}, now)
+
+	exported := ExportReleased(ipam.Released)
+	want := "10.6.0.4 1799999940\n10.6.0.5 1800000000\n"
+	if exported != want {
+		t.Errorf("ExportReleased() = %q, want %q", exported, want)
+	}
+	parsed, err := ParseReleased(strings.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ParseReleased() error = %v", err)
+	}
+	if !reflect.DeepEqual(parsed, ipam.Released) {
+		t.Errorf("ParseReleased() = %v, want %v", parsed, ipam.Released)
+	}
+}
@@ -0,0 +1,125 @@
+package pivpn
+
+//go:generate go tool msgp
+//msgp:ignore MetadataList
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetadataFileName is the file next to clients.txt holding the Metadata of the clients, as PiVPN doesn't know about it.
+const MetadataFileName = "clients.meta.json"
+
+var tagRE = regexp.MustCompile(`^[a-zA-Z0-9._:/-]{1,32}$`)
+
+// Metadata is what the manager records about a client beyond PiVPN.
+type Metadata struct {
+	// Owner is the person using the client.
+	Owner       string `json:"owner,omitempty" msg:"owner,omitempty"`
+	Email       string `json:"email,omitempty" msg:"email,omitempty"`
+	Description string `json:"description,omitempty" msg:"description,omitempty"`
+	// Tags are sorted and unique, see NormalizeTags.
+	Tags []string `json:"tags,omitempty" msg:"tags,omitempty"`
+	// Expires is when the client gets disabled, zero if it doesn't expire.
+	Expires time.Time `json:"expires,omitzero" msg:"expires"`
+}
+
+func (m Metadata) IsZero() bool {
+	return m.Owner == "" && m.Email == "" && m.Description == "" && len(m.Tags) == 0 && m.Expires.IsZero()
+}
+
+func (m Metadata) HasTag(tag string) bool {
+	return slices.Contains(m.Tags, strings.ToLower(tag))
+}
+
+// Validate checks the email and tags, and normalizes the tags.
+func (m *Metadata) Validate() error {
+	if m.Email != "" {
+		if _, err := mail.ParseAddress(m.Email); err != nil {
+			return fmt.Errorf("invalid email %q: %w", m.Email, err)
+		}
+	}
+	for _, tag := range m.Tags {
+		if !tagRE.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q: tags must only contain alphanumerical, period, underscore, colon, slash and hyphen; and be between 1 and 32 characters", tag)
+		}
+	}
+	m.Tags = NormalizeTags(m.Tags)
+	return nil
+}
+
+// NormalizeTags returns the tags in lower case, sorted and without duplicates.
+func NormalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	normalized := make([]string, len(tags))
+	for i, tag := range tags {
+		normalized[i] = strings.ToLower(strings.TrimSpace(tag))
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+// Expired returns whether the client has expired at now.
+func (m Metadata) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// ParseExpiry parses an expiry relative to now: "never", a duration such as 72h or 30d, a date which expires at its
+// end in the local time zone, or an RFC 3339 time.
+func ParseExpiry(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "never":
+		return time.Time{}, nil
+	case strings.HasSuffix(s, "d"):
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days > 0 {
+			return now.AddDate(0, 0, days).Truncate(time.Second), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d).Truncate(time.Second), nil
+	}
+	if date, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return date.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q: expected never, a duration (72h, 30d), a date (2006-01-02) or an RFC 3339 time", s)
+}
+
+// MetadataList is the metadata of the clients, by name.
+type MetadataList map[string]Metadata
+
+func ParseMetadata(input io.Reader) (MetadataList, error) {
+	var list MetadataList
+	if err := json.NewDecoder(input).Decode(&list); err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = MetadataList{}
+	}
+	return list, nil
+}
+
+// Export returns the metadata file, without the clients which have none.
+func (l MetadataList) Export() string {
+	clients := make(MetadataList, len(l))
+	for name, meta := range l {
+		if !meta.IsZero() {
+			clients[name] = meta
+		}
+	}
+	data, _ := json.MarshalIndent(clients, "", "  ")
+	return string(data) + "\n"
+}
@@ -0,0 +1,79 @@
+package pivpn
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2025, 3, 10, 15, 4, 5, 250, time.Local)
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"never", time.Time{}, false},
+		{"", time.Time{}, false},
+		{"72h", time.Date(2025, 3, 13, 15, 4, 5, 0, time.Local), false},
+		{"30d", time.Date(2025, 4, 9, 15, 4, 5, 0, time.Local), false},
+		{"2025-04-01", time.Date(2025, 4, 2, 0, 0, 0, 0, time.Local), false},
+		{"2025-04-01T12:00:00Z", time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC), false},
+		{"0d", time.Time{}, true},
+		{"-1h", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseExpiry(tt.input, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		meta     Metadata
+		wantTags []string
+		wantErr  bool
+	}{
+		{"empty", Metadata{}, nil, false},
+		{"tags", Metadata{Tags: []string{"Laptop", "team:ops", "laptop"}}, []string{"laptop", "team:ops"}, false},
+		{"email", Metadata{Owner: "Alex", Email: "alex@example.com"}, nil, false},
+		{"invalid email", Metadata{Email: "alex"}, nil, true},
+		{"invalid tag", Metadata{Tags: []string{"two words"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.meta.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(tt.meta.Tags, tt.wantTags) {
+				t.Errorf("Validate() tags = %v, want %v", tt.meta.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestMetadataListExport(t *testing.T) {
+	list := MetadataList{
+		"phone3":  {Owner: "Alex", Email: "alex@example.com", Description: "work phone", Tags: []string{"phone"}, Expires: time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		"laptop1": {},
+	}
+	got, err := ParseMetadata(strings.NewReader(list.Export()))
+	if err != nil {
+		t.Fatalf("ParseMetadata() error = %v", err)
+	}
+	if want := (MetadataList{"phone3": list["phone3"]}); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseMetadata(Export()) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package pivpn
+
+import (
+	"net/netip"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// ClientStatus is the live state of a client, as seen by the server.
+type ClientStatus struct {
+	Name     string
+	IPAddr   netip.Addr
+	Disabled bool
+
+	// Peer is nil if the client isn't loaded in the interface, e.g. when disabled.
+	Peer *wireguard.PeerStatus
+}
+
+func (s *ClientStatus) IsOnline(now time.Time) bool {
+	return s.Peer != nil && s.Peer.IsOnline(now)
+}
+
+// Status joins the live state of the interface to the clients, using their public keys.
+func (c ClientList) Status(device *wireguard.DeviceStatus) []ClientStatus {
+	statuses := make([]ClientStatus, len(c))
+	for i, client := range c {
+		statuses[i] = ClientStatus{
+			Name:     client.Name,
+			Disabled: client.Disabled,
+			Peer:     device.Peer(client.PublicKey()),
+		}
+		// a tolerant load keeps the clients without an address
+		if len(client.Interface.Addresses) > 0 {
+			statuses[i].IPAddr = client.Interface.Addresses[0].Addr()
+		}
+	}
+	return statuses
+}
+
+func (v *Vpn) Status(source wireguard.StatusSource) ([]ClientStatus, error) {
+	device, err := source.DeviceStatus(v.Name())
+	if err != nil {
+		return nil, err
+	}
+	return v.Clients.Status(device), nil
+}
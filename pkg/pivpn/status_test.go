@@ -0,0 +1,26 @@
+package pivpn
+
+import (
+	"net/netip"
+	"testing"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+func TestClientListStatus(t *testing.T) {
+	key, _ := wireguard.NewPrivateKey()
+	clients := ClientList{
+		{Config: wireguard.Config{Name: "alice1", Interface: wireguard.Interface{PrivateKey: *key, Addresses: []netip.Prefix{netip.MustParsePrefix("10.6.0.2/24")}}}},
+		// loaded by a tolerant Reload without an Address line
+		{Config: wireguard.Config{Name: "bob2", Interface: wireguard.Interface{PrivateKey: *key}}},
+	}
+	device := &wireguard.DeviceStatus{Peers: []wireguard.PeerStatus{{PublicKey: *key.Public()}}}
+
+	statuses := clients.Status(device)
+	if len(statuses) != 2 || statuses[0].IPAddr != netip.MustParseAddr("10.6.0.2") || statuses[0].Peer == nil {
+		t.Errorf("Status() = %+v, want alice1 at 10.6.0.2 and online", statuses)
+	}
+	if len(statuses) == 2 && statuses[1].IPAddr.IsValid() {
+		t.Errorf("Status() bob2 address = %v, want none", statuses[1].IPAddr)
+	}
+}
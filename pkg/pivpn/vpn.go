@@ -1,19 +1,22 @@
 package pivpn
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"net/netip"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"magnax.ca/VPNManager/internal/fsutil"
 	"magnax.ca/VPNManager/pkg/wireguard"
 )
 
@@ -30,23 +33,83 @@ const (
 var (
 	ErrClientNotFound = errors.New("client not found")
 	ErrClientExists   = errors.New("client with this name already exists")
+	ErrClientExpired  = errors.New("client has expired")
+	ErrExternalKey    = errors.New("client has an external key, its configuration is unavailable")
+	ErrPeerNotFound   = errors.New("unmanaged peer not found")
+	// ErrConcurrentChange is returned when a process which doesn't take the lock, i.e. pivpn, changed the files
+	// during a mutation. The mutation isn't written, so that the changes of the other process aren't lost.
+	ErrConcurrentChange = errors.New("changed by another process without the lock")
 )
 
+// Warning is a problem found while loading a tolerant vpn.
+type Warning struct {
+	// Client is the name of the client concerned, if any.
+	Client string
+	Err    error
+}
+
+func (w Warning) Error() string {
+	if w.Client == "" {
+		return w.Err.Error()
+	}
+	return fmt.Sprintf("client %s: %v", w.Client, w.Err)
+}
+
+func (w Warning) Unwrap() error {
+	return w.Err
+}
+
+// Tunnel is the state of a tunnel and its clients, as reported to the orchestrator.
+type Tunnel struct {
+	// Endpoint is where the clients connect to.
+	Endpoint wireguard.Endpoint
+	Server   wireguard.Config
+	Clients  ClientList
+	Warnings []Warning
+}
+
 type Vpn struct {
+	setupVarsPath  string
 	tunnelFilePath string
-	configsDir     string
-	keysDir        string
-	ReloadCmds     struct {
+	// piholeHostFilePath is the hosts file of the clients, only written if it exists
+	piholeHostFilePath string
+	// lockFilePath is locked by every read-modify-write of the files, see LockFileName
+	lockFilePath string
+	configsDir   string
+	keysDir      string
+	ReloadCmds   struct {
 		Pihole []string
 		Wg     []string
 	}
-
-	lock sync.Mutex
+	// IPAM allocates the addresses of new clients, it defaults to the lowest free address.
+	IPAM *IPAM
+	// PeerApplier applies peer changes without reloading the interface, they are reloaded if it's nil.
+	PeerApplier wireguard.PeerApplier
+	// Executor runs the external commands, it defaults to wireguard.ExecExecutor.
+	Executor wireguard.Executor
+
+	// Tolerant skips the clients which can't be loaded instead of failing, they are reported in Warnings.
+	// The tunnel peers, clients.txt entries and files of the skipped clients are kept as is.
+	Tolerant bool
+	Warnings []Warning
+	// skipped are the clients.txt entries of the skipped clients, empty if they have none
+	skipped map[string]ClientInfo
+	// metadata is the metadata file as loaded, nil if it couldn't be read and must be kept as is
+	metadata MetadataList
+	// loaded are the files pivpn writes as loaded, to detect its changes made without the lock
+	loaded map[string][]byte
+
+	// LockTimeout is how long to wait for other processes to release the lock file.
+	LockTimeout time.Duration
+	lock        sync.Mutex
 
 	Conf Config
 
 	Server  wireguard.Config
 	Clients ClientList
+
+	// synced is the tunnel configuration as last read from or written to disk
+	synced *wireguard.Config
 }
 
 func LoadVpn() (*Vpn, error) {
@@ -54,213 +117,591 @@ func LoadVpn() (*Vpn, error) {
 }
 
 func LoadVpnWithLocations(name, pivpnSetupVars, tunnelDir, configsDir, KeysDir string) (*Vpn, error) {
-	vpn := Vpn{
-		tunnelFilePath: filepath.Join(tunnelDir, name+".conf"),
-		configsDir:     configsDir,
-		keysDir:        KeysDir,
+	vpn, err := NewVpnWithLocations(name, pivpnSetupVars, tunnelDir, configsDir, KeysDir)
+	if err != nil {
+		return nil, err
+	}
+	if err = vpn.Reload(); err != nil {
+		return nil, err
 	}
+	return vpn, nil
+}
 
-	setupVarsFile, err := os.Open(pivpnSetupVars)
-	if err != nil {
+// NewVpnWithLocations reads the PiVPN configuration, the tunnel and its clients are only read by Reload.
+func NewVpnWithLocations(name, pivpnSetupVars, tunnelDir, configsDir, KeysDir string) (*Vpn, error) {
+	vpn := newVpn(name, pivpnSetupVars, tunnelDir, configsDir, KeysDir)
+	if err := vpn.readSetupVars(); err != nil {
 		return nil, err
 	}
+	return vpn, nil
+}
+
+func newVpn(name, pivpnSetupVars, tunnelDir, configsDir, KeysDir string) *Vpn {
+	return &Vpn{
+		setupVarsPath:      pivpnSetupVars,
+		tunnelFilePath:     filepath.Join(tunnelDir, name+".conf"),
+		piholeHostFilePath: DefaultPiholeHostFilePath,
+		lockFilePath:       filepath.Join(filepath.Dir(pivpnSetupVars), LockFileName),
+		configsDir:         configsDir,
+		keysDir:            KeysDir,
+		LockTimeout:        DefaultLockTimeout,
+	}
+}
+
+func (v *Vpn) readSetupVars() error {
+	setupVarsFile, err := os.Open(v.setupVarsPath)
+	if err != nil {
+		return err
+	}
 	defer func() { _ = setupVarsFile.Close() }()
 	pivpnConf, err := LoadConfig(setupVarsFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	vpn.Conf = *pivpnConf
+	v.Conf = *pivpnConf
+	return nil
+}
 
-	tunnelConfFile, err := os.DirFS(tunnelDir).Open(name + ".conf")
+// Reload reads the tunnel and its clients from disk, under the shared lock.
+func (v *Vpn) Reload() error {
+	lock, err := fsutil.LockFile(v.lockFilePath, false, v.LockTimeout)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer func() { _ = tunnelConfFile.Close() }()
-	tunnelConf, err := wireguard.ParseConfig(tunnelConfFile, name)
+	defer func() { _ = lock.Unlock() }()
+
+	return v.load()
+}
+
+// readTunnel reads the tunnel configuration, returning the file as read too.
+func (v *Vpn) readTunnel() (*wireguard.Config, []byte, error) {
+	data, err := os.ReadFile(v.tunnelFilePath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	conf, err := wireguard.ParseConfig(bytes.NewReader(data), strings.TrimSuffix(filepath.Base(v.tunnelFilePath), ".conf"))
+	return conf, data, err
+}
 
-	clientsFile, err := os.DirFS(configsDir).Open("clients.txt")
+// load reads the tunnel and its clients from disk, the lock must be held.
+func (v *Vpn) load() error {
+	tunnelConf, data, err := v.readTunnel()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer func(file fs.File) { _ = file.Close() }(clientsFile)
-	clients, err := ParseClientList(clientsFile)
+	name := tunnelConf.Name
+
+	v.Warnings, v.skipped = nil, nil
+	v.loaded = map[string][]byte{v.tunnelFilePath: data}
+	clients, err := v.loadClientList()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	clientMap := clients.AsMap()
+	if v.metadata, err = v.loadMetadata(); err != nil {
+		return err
+	}
 
-	vpn.Clients = make(ClientList, len(tunnelConf.Peers))
+	v.Clients = make(ClientList, 0, len(tunnelConf.Peers))
 
-	for i, peer := range tunnelConf.Peers {
-		c, err := func() (c *wireguard.Config, err error) {
-			file, err := os.Open(filepath.Join(configsDir, peer.Name+".conf"))
+	for _, peer := range tunnelConf.Peers {
+		c, err := func() (*wireguard.Config, error) {
+			file, err := os.Open(filepath.Join(v.configsDir, peer.Name+".conf"))
 			if err != nil {
-				return
+				return nil, err
 			}
-			defer func(file fs.File) { err = file.Close() }(file)
-
-			c, err = wireguard.ParseConfig(file, peer.Name)
+			defer func(file fs.File) { _ = file.Close() }(file)
 
-			return
+			return wireguard.ParseConfig(file, peer.Name)
 		}()
+		if err == nil && len(c.Peers) == 0 {
+			err = fmt.Errorf("client %s has no server peer", peer.Name)
+		}
 		if err != nil {
-			return nil, err
+			if !v.Tolerant {
+				return err
+			}
+			v.warn(peer.Name, err)
+			if v.skipped == nil {
+				v.skipped = make(map[string]ClientInfo)
+			}
+			v.skipped[peer.Name] = clientMap[peer.Name]
+			continue
 		}
 
 		client, ok := clientMap[peer.Name]
 		if !ok {
-			return nil, fmt.Errorf("client %s not found in clients.txt", peer.Name)
+			err = fmt.Errorf("client %s not found in clients.txt", peer.Name)
+			if !v.Tolerant {
+				return err
+			}
+			// kept without its creation date, clients.txt gets its entry back on the next change
+			v.warn(peer.Name, err)
 		}
 
-		vpn.Clients[i] = Client{*c, peer.Disabled, client.CreationDate}
+		loaded := Client{Config: *c, Disabled: peer.Disabled, CreationDate: client.CreationDate, Meta: v.metadata[peer.Name]}
+		if loaded.External() {
+			loaded.ExternalKey = peer.PublicKey
+		}
+		v.Clients = append(v.Clients, loaded)
+	}
+	for _, warning := range v.Warnings {
+		slog.Warn("tunnel loaded with problems", "tunnel", name, "err", warning)
 	}
 
-	vpn.Server = *tunnelConf
+	v.Server = *tunnelConf
+	v.synced = tunnelConf.Clone()
+	if v.IPAM != nil {
+		v.IPAM.Released = nil
+	}
 
-	return &vpn, nil
+	return nil
 }
 
-func (v *Vpn) SetReloadCmds(pihole, wg []string) {
-	v.ReloadCmds.Pihole = pihole
-	v.ReloadCmds.Wg = wg
+// loadClientList reads clients.txt, skipping its invalid lines if the vpn is tolerant.
+func (v *Vpn) loadClientList() (ClientInfoList, error) {
+	path := filepath.Join(v.configsDir, "clients.txt")
+	data, err := os.ReadFile(path)
+	if err != nil && !(v.Tolerant && errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	} else if err != nil {
+		v.warn("", err)
+		v.loaded[path] = nil
+		return nil, nil
+	}
+	v.loaded[path] = data
+
+	if !v.Tolerant {
+		return ParseClientList(bytes.NewReader(data))
+	}
+	clients, errs := parseClientLines(bytes.NewReader(data))
+	for _, err := range errs {
+		v.warn("", err)
+	}
+	return clients, nil
 }
 
-func (v *Vpn) Name() string {
-	return v.Server.Name
+func (v *Vpn) metadataFilePath() string {
+	return filepath.Join(v.configsDir, MetadataFileName)
 }
 
-func (v *Vpn) SyncTunnel() error {
-	err := os.WriteFile(v.tunnelFilePath, []byte(v.Server.Export()), 0640)
-	if err != nil {
-		return err
+// loadMetadata reads the metadata file, which may be missing. If the vpn is tolerant, an invalid file is reported and
+// left untouched.
+func (v *Vpn) loadMetadata() (MetadataList, error) {
+	file, err := os.Open(v.metadataFilePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return MetadataList{}, nil
+	} else if err != nil {
+		return nil, err
 	}
+	defer file.Close() //nolint:errcheck
 
-	err = exec.Command(v.ReloadCmds.Wg[0], v.ReloadCmds.Wg[1:]...).Run()
+	list, err := ParseMetadata(file)
 	if err != nil {
-		return err
+		err = fmt.Errorf("invalid %s: %w", MetadataFileName, err)
+		if !v.Tolerant {
+			return nil, err
+		}
+		v.warn("", err)
+		return nil, nil
 	}
-	return nil
+	return list, nil
 }
 
-func (v *Vpn) SyncClients() error {
-	// todo rewrite the clients .conf files
-	return os.WriteFile(filepath.Join(v.configsDir, "clients.txt"), []byte(v.Clients.ToClientInfoList().Export()), 0644)
+func (v *Vpn) warn(client string, err error) {
+	v.Warnings = append(v.Warnings, Warning{client, err})
 }
 
-func (v *Vpn) SyncPihole() error {
-	if _, err := os.Stat(DefaultPiholeHostFilePath); os.IsNotExist(err) {
-		return nil
+// clientInfos returns the clients.txt entries of the clients, keeping the ones of the skipped clients.
+func (v *Vpn) clientInfos() ClientInfoList {
+	if len(v.skipped) == 0 {
+		return v.Clients.ToClientInfoList()
 	}
-	var builder strings.Builder
-
-	_, _ = fmt.Fprintf(&builder, "%s %s.pivpn\n", v.Server.Interface.Addresses[0].Addr().String(), "pivpn")
-	for _, client := range v.Clients {
-		_, _ = fmt.Fprintf(&builder, "%s %s.pivpn\n", client.Interface.Addresses[0].Addr().String(), client.DNSName())
+	clients := v.Clients.ToClientInfoList().AsMap()
+	infos := make(ClientInfoList, 0, len(v.Server.Peers))
+	for _, peer := range v.Server.Peers {
+		if info, ok := clients[peer.Name]; ok {
+			infos = append(infos, info)
+		} else if info, ok := v.skipped[peer.Name]; ok && info.Name != "" {
+			infos = append(infos, info)
+		}
 	}
+	return infos
+}
 
-	err := os.WriteFile(DefaultPiholeHostFilePath, []byte(builder.String()), 0644)
-	if err != nil {
-		return err
+// checkUnchanged returns ErrConcurrentChange if the files pivpn writes changed since they were loaded, as pivpn
+// doesn't take the lock unless wrapped with flock(1).
+func (v *Vpn) checkUnchanged() error {
+	for path, loaded := range v.loaded {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if !bytes.Equal(data, loaded) {
+			return fmt.Errorf("%w: %s, wrap pivpn with flock %s", ErrConcurrentChange, path, v.lockFilePath)
+		}
 	}
+	return nil
+}
 
-	err = exec.Command(v.ReloadCmds.Pihole[0], v.ReloadCmds.Pihole[1:]...).Run()
+// lockAndLoad takes the exclusive lock and reloads the state from disk, as another process may have changed it since
+// the vpn was loaded.
+func (v *Vpn) lockAndLoad() (*fsutil.Lock, error) {
+	lock, err := fsutil.LockFile(v.lockFilePath, true, v.LockTimeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if err = v.load(); err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
 }
 
-func (v *Vpn) DisableClient(name string) error {
-	v.lock.Lock()
-	defer v.lock.Unlock()
+func (v *Vpn) SetReloadCmds(pihole, wg []string) {
+	v.ReloadCmds.Pihole = pihole
+	v.ReloadCmds.Wg = wg
+}
 
-	err := v.Server.DisablePeer(name)
-	if err != nil {
-		return err
-	}
+func (v *Vpn) SetIPAM(ipam *IPAM) {
+	v.IPAM = ipam
+}
 
-	for i, clients := range v.Clients {
-		if clients.Name == name {
-			v.Clients[i].Disabled = true
-		}
+func (v *Vpn) SetTolerant(tolerant bool) {
+	v.Tolerant = tolerant
+}
+
+func (v *Vpn) SetLockTimeout(timeout time.Duration) {
+	v.LockTimeout = timeout
+}
+
+func (v *Vpn) SetPeerApplier(applier wireguard.PeerApplier) {
+	v.PeerApplier = applier
+}
+
+func (v *Vpn) run(args []string, stdin []byte) error {
+	executor := v.Executor
+	if executor == nil {
+		executor = wireguard.ExecExecutor{}
 	}
+	return executor.Run(wireguard.Command{Args: args, Stdin: stdin})
+}
 
-	return v.SyncTunnel()
+// applyPeerChanges applies the changes to the running interface, returning false if the interface must be reloaded
+// instead.
+func (v *Vpn) applyPeerChanges(diff *wireguard.ConfigDiff) bool {
+	if v.PeerApplier == nil {
+		return false
+	}
+	updates, ok := wireguard.NewPeerUpdates(diff, &v.Server)
+	if !ok || updates.IsEmpty() {
+		return false
+	}
+	if err := v.PeerApplier.ApplyPeerUpdates(v.Name(), updates); err != nil {
+		slog.Warn("unable to apply peer changes, reloading the tunnel instead", "tunnel", v.Name(), "err", err)
+		return false
+	}
+	return true
 }
 
-func (v *Vpn) EnableClient(name string) error {
-	v.lock.Lock()
-	defer v.lock.Unlock()
+func (v *Vpn) Name() string {
+	return v.Server.Name
+}
 
-	err := v.Server.EnablePeer(name)
-	if err != nil {
-		return err
+func (v *Vpn) logChanges(diff *wireguard.ConfigDiff) {
+	logger := slog.With("tunnel", v.Name())
+	for _, change := range diff.Interface {
+		logger.Info("interface changed", "field", change.Field, "old", change.Old, "new", change.New)
+	}
+	for _, change := range diff.Peers {
+		peerLogger := logger.With("peer", change.Name, "key", change.PublicKey.String())
+		switch change.Type {
+		case wireguard.PeerAdded:
+			peerLogger.Info("peer added")
+		case wireguard.PeerRemoved:
+			peerLogger.Info("peer removed")
+		}
+		switch change.Toggle {
+		case wireguard.PeerEnabled:
+			peerLogger.Info("peer enabled")
+		case wireguard.PeerDisabled:
+			peerLogger.Info("peer disabled")
+		}
+		for _, f := range change.Fields {
+			peerLogger.Info("peer changed", "field", f.Field, "old", f.Old, "new", f.New)
+		}
 	}
+}
 
-	for i, clients := range v.Clients {
-		if clients.Name == name {
-			v.Clients[i].Disabled = false
+// reloadTunnel applies the tunnel changes since the last reload to the running interface.
+// Only peers changes can be applied without reloading it, force reloads it anyway.
+func (v *Vpn) reloadTunnel(force bool) error {
+	applied := false
+	if v.synced != nil {
+		diff := wireguard.Diff(v.synced, &v.Server)
+		if diff.IsEmpty() && !force {
+			return nil
+		}
+		v.logChanges(diff)
+		if !force {
+			applied = v.applyPeerChanges(diff)
 		}
 	}
+	if !applied {
+		if err := v.run(v.ReloadCmds.Wg, nil); err != nil {
+			return err
+		}
+	}
+	v.synced = v.Server.Clone()
+	return nil
+}
 
-	return v.SyncTunnel()
+func (v *Vpn) stageTunnel(tx *fsutil.Transaction) {
+	tx.WriteFile(v.tunnelFilePath, []byte(v.Server.Export()), 0640)
 }
 
-func (v *Vpn) RemoveClient(name string) error {
-	v.lock.Lock()
-	defer v.lock.Unlock()
+func (v *Vpn) stageClients(tx *fsutil.Transaction) {
+	// todo rewrite the clients .conf files
+	tx.WriteFile(filepath.Join(v.configsDir, "clients.txt"), []byte(v.clientInfos().Export()), 0644)
+	v.stageMetadata(tx)
+}
 
-	// remove peer from tunnel
-	err := v.Server.RemovePeer(name)
-	if err != nil {
-		return err
+// stageMetadata stages the metadata file, keeping the metadata of the skipped clients. It isn't created until a
+// client has metadata.
+func (v *Vpn) stageMetadata(tx *fsutil.Transaction) {
+	if v.metadata == nil {
+		return
+	}
+	list := make(MetadataList, len(v.Clients))
+	for _, client := range v.Clients {
+		list[client.Name] = client.Meta
+	}
+	for name := range v.skipped {
+		list[name] = v.metadata[name]
 	}
 
-	// update running config
-	err = v.SyncTunnel()
-	if err != nil {
-		return err
+	if _, err := os.Stat(v.metadataFilePath()); os.IsNotExist(err) && !slices.ContainsFunc(v.Clients, func(c Client) bool { return !c.Meta.IsZero() }) {
+		return
 	}
+	tx.WriteFile(v.metadataFilePath(), []byte(list.Export()), 0640)
+}
 
-	// remove client from client list if present
-	for i, c := range v.Clients {
-		if c.Name == name {
-			v.Clients = append(v.Clients[:i], v.Clients[i+1:]...)
-			break
+// piholeHosts returns the pihole hosts file of the tunnel.
+func (v *Vpn) piholeHosts() string {
+	var builder strings.Builder
+
+	// one line per address, so that pihole answers both A and AAAA queries
+	for _, address := range v.Server.Interface.Addresses {
+		_, _ = fmt.Fprintf(&builder, "%s %s.pivpn\n", address.Addr().String(), "pivpn")
+	}
+	for _, client := range v.Clients {
+		for _, address := range client.Interface.Addresses {
+			_, _ = fmt.Fprintf(&builder, "%s %s.pivpn\n", address.Addr().String(), client.DNSName())
+		}
+	}
+	for _, peer := range v.Server.Peers {
+		if _, ok := v.skipped[peer.Name]; !ok {
+			continue
+		}
+		for _, ip := range peer.AllowedIPs {
+			if ip.IsSingleIP() {
+				_, _ = fmt.Fprintf(&builder, "%s %s.pivpn\n", ip.Addr().String(), invalidDNSChars.ReplaceAllLiteralString(peer.Name, "-"))
+			}
 		}
 	}
+	return builder.String()
+}
+
+// stagePihole stages the pihole hosts file, if pihole is installed.
+func (v *Vpn) stagePihole(tx *fsutil.Transaction) {
+	if _, err := os.Stat(v.piholeHostFilePath); os.IsNotExist(err) {
+		return
+	}
+	tx.WriteFile(v.piholeHostFilePath, []byte(v.piholeHosts()), 0644)
+}
 
-	err = v.SyncClients()
+// mutate runs a mutation of the vpn as a transaction. The mutation changes the in-memory state and stages the files
+// specific to it, then the tunnel, clients.txt and pihole files are staged and committed before reloading the
+// running interface and pihole.
+//
+// The state is reloaded from disk under the lock first, so the mutation applies to the latest state.
+// If any step fails, the files and the in-memory state are rolled back, and the interface is reloaded again if it
+// already was.
+func (v *Vpn) mutate(mutation func(tx *fsutil.Transaction) error) error {
+	lock, err := v.lockAndLoad()
 	if err != nil {
 		return err
 	}
+	defer func() { _ = lock.Unlock() }()
+
+	server, clients := v.Server.Clone(), slices.Clone(v.Clients)
+	tx := &fsutil.Transaction{}
+	committed, reloaded := false, false
 
-	err = os.Remove(filepath.Join(v.configsDir, name+".conf"))
-	if err != nil && !os.IsNotExist(err) {
-		return IoError{err, name + ".conf"}
+	rollback := func(err error) error {
+		v.Server, v.Clients = *server, clients
+		if v.IPAM != nil {
+			// reloaded from disk on the next use
+			v.IPAM.Released = nil
+		}
+		if !committed {
+			return err
+		}
+		errs := []error{err, tx.Rollback()}
+		if reloaded {
+			errs = append(errs, v.reloadTunnel(false))
+		}
+		slog.Error("changes rolled back", "tunnel", v.Name(), "err", err)
+		return errors.Join(errs...)
 	}
 
-	err = os.Remove(filepath.Join(v.Conf.UserConfigPath, name+".conf"))
-	if err != nil && !os.IsNotExist(err) {
-		return IoError{err, name + ".conf"}
+	if err := mutation(tx); err != nil {
+		return rollback(err)
 	}
+	v.stageTunnel(tx)
+	v.stageClients(tx)
+	v.stagePihole(tx)
+	if err := v.checkUnchanged(); err != nil {
+		return rollback(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return rollback(err)
+	}
+	committed = true
 
-	for _, f := range []string{name + "_priv", name + "_psk", name + "_pub"} {
-		err = os.Remove(filepath.Join(v.keysDir, f))
-		if err != nil && !os.IsNotExist(err) {
-			return IoError{err, f}
+	if err := v.reloadTunnel(false); err != nil {
+		return rollback(err)
+	}
+	reloaded = true
+	if tx.Changed(v.piholeHostFilePath) {
+		if err := v.run(v.ReloadCmds.Pihole, nil); err != nil {
+			return rollback(err)
 		}
 	}
 
-	err = v.SyncPihole()
+	return nil
+}
+
+// syncLocked runs a sync under the exclusive lock, with the state reloaded from disk.
+func (v *Vpn) syncLocked(sync func() error) error {
+	lock, err := v.lockAndLoad()
 	if err != nil {
 		return err
 	}
+	defer func() { _ = lock.Unlock() }()
+	return sync()
+}
 
-	return nil
+func (v *Vpn) SyncTunnel() error {
+	return v.syncLocked(func() error {
+		tx := &fsutil.Transaction{}
+		v.stageTunnel(tx)
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if err := v.reloadTunnel(true); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		return nil
+	})
+}
+
+func (v *Vpn) SyncClients() error {
+	return v.syncLocked(func() error {
+		tx := &fsutil.Transaction{}
+		v.stageClients(tx)
+		return tx.Commit()
+	})
+}
+
+func (v *Vpn) SyncPihole() error {
+	return v.syncLocked(func() error {
+		if _, err := os.Stat(v.piholeHostFilePath); os.IsNotExist(err) {
+			return nil
+		}
+		tx := &fsutil.Transaction{}
+		v.stagePihole(tx)
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if err := v.run(v.ReloadCmds.Pihole, nil); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		return nil
+	})
+}
+
+func (v *Vpn) DisableClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		err := v.Server.DisablePeer(name)
+		if err != nil {
+			return err
+		}
+
+		for i, clients := range v.Clients {
+			if clients.Name == name {
+				v.Clients[i].Disabled = true
+			}
+		}
+		return nil
+	})
+}
+
+// EnableClient enables a disabled client, unless it has expired.
+func (v *Vpn) EnableClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		if client := v.Clients.Client(name); client != nil && client.Meta.Expired(time.Now()) {
+			return fmt.Errorf("%w: %s expired on %s, change its expiry first", ErrClientExpired, name, client.Meta.Expires.Local().Format(time.DateTime))
+		}
+		err := v.Server.EnablePeer(name)
+		if err != nil {
+			return err
+		}
+
+		for i, clients := range v.Clients {
+			if clients.Name == name {
+				v.Clients[i].Disabled = false
+			}
+		}
+		return nil
+	})
+}
+
+func (v *Vpn) RemoveClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		// remove peer from tunnel
+		err := v.Server.RemovePeer(name)
+		if err != nil {
+			return err
+		}
+
+		// remove client from client list if present
+		for i, c := range v.Clients {
+			if c.Name == name {
+				if err = v.releaseAddresses(tx, &c); err != nil {
+					return err
+				}
+				v.Clients = slices.Delete(slices.Clone(v.Clients), i, i+1)
+				break
+			}
+		}
+
+		tx.Remove(filepath.Join(v.configsDir, name+".conf"))
+		tx.Remove(filepath.Join(v.Conf.UserConfigPath, name+".conf"))
+		for _, f := range []string{name + "_priv", name + "_psk", name + "_pub"} {
+			tx.Remove(filepath.Join(v.keysDir, f))
+		}
+		return nil
+	})
 }
 
 var (
@@ -271,57 +712,93 @@ var (
 	ipv6All = netip.MustParsePrefix("::0/0")
 )
 
-func (v *Vpn) AddClient(name string) error {
-	// enforce peer name restrictions on addition, accept anything for all other options
-	if !clientNameRE.MatchString(name) {
-		return fmt.Errorf("invalid client name %q: name must only contains alphanumerical, period, @, underscore, and hyphen; and be between 1 and 15 characters", name)
+// releasedFilePath is where the released addresses are recorded for IPAM.Reuse.
+func (v *Vpn) releasedFilePath() string {
+	return filepath.Join(v.configsDir, "released.txt")
+}
+
+// ipam returns the address allocator, with the released addresses loaded if its policy needs them.
+func (v *Vpn) ipam() (*IPAM, error) {
+	if v.IPAM == nil {
+		v.IPAM = &IPAM{}
 	}
-	if !clientNameNonDigitRE.MatchString(name) {
-		return fmt.Errorf("invalid client name %q: client name must contain at least one digit", name)
+	if v.IPAM.Reuse != ReuseAvoidRecent || v.IPAM.Released != nil {
+		return v.IPAM, nil
 	}
-	if name == "server" {
-		return fmt.Errorf("invalid client name %q: client name must not match %q", name, "server")
+
+	file, err := os.Open(v.releasedFilePath())
+	if os.IsNotExist(err) {
+		v.IPAM.Released = make(map[netip.Addr]time.Time)
+		return v.IPAM, nil
+	} else if err != nil {
+		return nil, err
 	}
-	v.lock.Lock()
-	defer v.lock.Unlock()
+	defer file.Close() //nolint:errcheck
+	v.IPAM.Released, err = ParseReleased(file)
+	if err != nil {
+		return nil, err
+	}
+	return v.IPAM, nil
+}
 
-	for _, c := range v.Clients {
-		if c.Name == name {
-			return ErrClientExists
-		}
+// releaseAddresses records the addresses of a removed client, if the reuse policy needs them.
+func (v *Vpn) releaseAddresses(tx *fsutil.Transaction, client *Client) error {
+	ipam, err := v.ipam()
+	if err != nil {
+		return err
+	}
+	if ipam.Reuse != ReuseAvoidRecent {
+		return nil
 	}
 
-	// create keys
-	keys := NewKeys(name)
+	addrs := make([]netip.Addr, len(client.Interface.Addresses))
+	for i, address := range client.Interface.Addresses {
+		addrs[i] = address.Addr()
+	}
+	ipam.Release(addrs, time.Now())
+	tx.WriteFile(v.releasedFilePath(), []byte(ExportReleased(ipam.Released)), 0644)
+	return nil
+}
 
-	// find next usable IP
-	netblock := v.Server.Interface.Addresses[0]
+// allocateAddresses returns the addresses of a new client, one per address family of the server.
+func (v *Vpn) allocateAddresses(requested []netip.Addr) ([]netip.Prefix, error) {
+	ipam, err := v.ipam()
+	if err != nil {
+		return nil, err
+	}
 
-	ips := make(map[netip.Addr]bool, len(v.Clients))
-	for _, client := range v.Clients {
-		ips[client.Interface.Addresses[0].Addr()] = true
-	}
-	// get first address after the server's IP
-	ip := netblock.Addr().Next()
-	for {
-		// if IP is in map (aka is used by a client, increment and continue)
-		if _, ok := ips[ip]; ok {
-			ip = ip.Next()
-			continue
+	used := make(map[netip.Addr]bool, len(v.Clients)+len(v.Server.Peers))
+	for _, address := range v.Server.Interface.Addresses {
+		used[address.Addr()] = true
+	}
+	for _, peer := range v.Server.Peers {
+		for _, ip := range peer.AllowedIPs {
+			if ip.IsSingleIP() {
+				used[ip.Addr()] = true
+			}
 		}
-		if !netblock.Contains(ip) {
-			return errors.New("unable to add client: tunnel as no usable IP addresses left")
+	}
+	for _, client := range v.Clients {
+		for _, address := range client.Interface.Addresses {
+			used[address.Addr()] = true
 		}
-		break
 	}
 
-	// create client
-	client := Client{
-		wireguard.Config{
-			Name: name,
+	addresses, err := ipam.Allocate(v.Server.Interface.Addresses, used, requested, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to add client: %w", err)
+	}
+	return addresses, nil
+}
+
+// newClient returns the configuration of a client of the tunnel, routing everything through it.
+func (v *Vpn) newClient(keys *Keys, addresses []netip.Prefix, created time.Time) Client {
+	return Client{
+		Config: wireguard.Config{
+			Name: keys.Name,
 			Interface: wireguard.Interface{
 				PrivateKey: keys.PrivateKey,
-				Addresses:  []netip.Prefix{netip.PrefixFrom(ip, netblock.Bits())},
+				Addresses:  addresses,
 				DNS:        v.Conf.DNS[:],
 			},
 			Peers: []wireguard.Peer{
@@ -337,70 +814,252 @@ func (v *Vpn) AddClient(name string) error {
 				},
 			},
 		},
-		false,
-		time.Now(),
+		CreationDate: created,
 	}
+}
 
-	// save client
-	err := os.WriteFile(filepath.Join(v.configsDir, name+".conf"), []byte(client.Export()), 0640)
-	if err != nil {
-		return err
+// validateClientName enforces the peer name restrictions of pivpn, on addition and renaming only.
+func validateClientName(name string) error {
+	if !clientNameRE.MatchString(name) {
+		return fmt.Errorf("invalid client name %q: name must only contains alphanumerical, period, @, underscore, and hyphen; and be between 1 and 15 characters", name)
 	}
-
-	saveKey := func(keyB64, filename string) error {
-		err := os.WriteFile(filename, []byte(keyB64), 0640)
-		if err != nil {
-			return IoError{err, filename}
-		}
-		err = os.Chown(filename, 0, 0)
-		if err != nil {
-			return IoError{err, filename}
-		}
-		return nil
+	if !clientNameNonDigitRE.MatchString(name) {
+		return fmt.Errorf("invalid client name %q: client name must contain at least one digit", name)
+	}
+	if name == "server" {
+		return fmt.Errorf("invalid client name %q: client name must not match %q", name, "server")
 	}
-	if err = saveKey(keys.PrivateKey.String(), filepath.Join(v.keysDir, name+"_priv")); err != nil {
+	return nil
+}
+
+// AddClient creates a client, with the requested addresses if any. See IPAM.Allocate.
+func (v *Vpn) AddClient(name string, requested ...netip.Addr) error {
+	return v.AddClientWithMetadata(name, Metadata{}, requested...)
+}
+
+// AddClientWithMetadata creates a client with its metadata, with the requested addresses if any.
+func (v *Vpn) AddClientWithMetadata(name string, meta Metadata, requested ...netip.Addr) error {
+	// enforce peer name restrictions on addition, accept anything for all other options
+	if err := validateClientName(name); err != nil {
 		return err
 	}
-	if err = saveKey(keys.PrivateKey.Public().String(), filepath.Join(v.keysDir, name+"_pub")); err != nil {
+	if err := meta.Validate(); err != nil {
 		return err
 	}
-	if err = saveKey(keys.PresharedKey.String(), filepath.Join(v.keysDir, name+"_psk")); err != nil {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		return v.addClient(tx, name, meta, requested)
+	})
+}
+
+// addClient creates a client as part of a mutation, the name and metadata being validated already.
+func (v *Vpn) addClient(tx *fsutil.Transaction, name string, meta Metadata, requested []netip.Addr) error {
+	for _, c := range v.Clients {
+		if c.Name == name {
+			return ErrClientExists
+		}
+	}
+
+	// create keys
+	keys := NewKeys(name)
+
+	// find the next usable IP of each address family
+	addresses, err := v.allocateAddresses(requested)
+	if err != nil {
 		return err
 	}
 
-	v.Clients = append(v.Clients, client)
+	// create client
+	client := v.newClient(keys, addresses, time.Now())
+	client.Meta = meta
+
+	// save client and keys
+	tx.WriteFile(filepath.Join(v.configsDir, name+".conf"), []byte(client.Export()), 0640)
+	tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_priv"), []byte(keys.PrivateKey.String()), 0640, 0, 0)
+	tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_pub"), []byte(keys.PrivateKey.Public().String()), 0640, 0, 0)
+	tx.WriteFileOwned(filepath.Join(v.keysDir, name+"_psk"), []byte(keys.PresharedKey.String()), 0640, 0, 0)
 
-	err = v.SyncClients()
+	err = ensureDir(v.Conf.UserConfigPath, v.Conf.UserId, v.Conf.GroupId)
 	if err != nil {
 		return err
 	}
+	tx.WriteFile(filepath.Join(v.Conf.UserConfigPath, name+".conf"), []byte(client.Export()), 0640)
+
+	v.Clients = append(slices.Clone(v.Clients), client)
 
 	// add client to tunnel
 	clientPeer := client.ToPeer()
 	clientPeer.PresharedKey = keys.PresharedKey
 	v.Server.Peers = append(v.Server.Peers, clientPeer)
 
-	// save tunnel
-	err = v.SyncTunnel()
-	if err != nil {
+	return nil
+}
+
+// RenameClient renames a client, keeping its keys and addresses. The tunnel peer, clients.txt entry, pihole host,
+// config files and key files are renamed together.
+func (v *Vpn) RenameClient(name, newName string) error {
+	if err := validateClientName(newName); err != nil {
 		return err
 	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
 
-	err = v.SyncPihole()
-	if err != nil {
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", ErrClientNotFound, name)
+		}
+		for _, peer := range v.Server.Peers {
+			if peer.Name == newName {
+				return fmt.Errorf("%w: %s", ErrClientExists, newName)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(v.configsDir, newName+".conf")); err == nil {
+			return fmt.Errorf("%w: %s", ErrClientExists, filepath.Join(v.configsDir, newName+".conf"))
+		}
+
+		for i := range v.Server.Peers {
+			if v.Server.Peers[i].Name == name {
+				v.Server.Peers[i].Name = newName
+			}
+		}
+		v.Clients = slices.Clone(v.Clients)
+		v.Clients[idx].Name = newName
+
+		moves := [][2]string{
+			{filepath.Join(v.configsDir, name+".conf"), filepath.Join(v.configsDir, newName+".conf")},
+			{filepath.Join(v.Conf.UserConfigPath, name+".conf"), filepath.Join(v.Conf.UserConfigPath, newName+".conf")},
+		}
+		for _, suffix := range []string{"_priv", "_pub", "_psk"} {
+			moves = append(moves, [2]string{filepath.Join(v.keysDir, name+suffix), filepath.Join(v.keysDir, newName+suffix)})
+		}
+		for _, move := range moves {
+			if err := tx.Move(move[0], move[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RotateClientKeys replaces the keys of a client, or only its preshared key, keeping its name, addresses and creation
+// date. The previous configuration of the client stops working. An external client gets a full configuration, its
+// preshared key can't be rotated alone.
+func (v *Vpn) RotateClientKeys(name string, pskOnly bool) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", ErrClientNotFound, name)
+		}
+		peer := slices.IndexFunc(v.Server.Peers, func(p wireguard.Peer) bool { return p.Name == name })
+		if peer < 0 {
+			return fmt.Errorf("%w: %s", ErrClientNotFound, name)
+		}
+
+		keys := NewKeys(name)
+		if pskOnly {
+			if v.Clients[idx].External() {
+				return fmt.Errorf("%w: %s", ErrExternalKey, name)
+			}
+			keys.PrivateKey = v.Clients[idx].Interface.PrivateKey
+		}
+
+		v.Clients = slices.Clone(v.Clients)
+		client := &v.Clients[idx]
+		if client.External() {
+			// the stub becomes a usable configuration
+			rotated := v.newClient(keys, client.Interface.Addresses, client.CreationDate)
+			rotated.Disabled, rotated.Meta = client.Disabled, client.Meta
+			*client = rotated
+		}
+		client.Interface.PrivateKey = keys.PrivateKey
+		client.Peers = slices.Clone(client.Peers)
+		client.Peers[0].PresharedKey = keys.PresharedKey
+		v.Server.Peers[peer].PublicKey = *keys.PrivateKey.Public()
+		v.Server.Peers[peer].PresharedKey = keys.PresharedKey
+
+		tx.WriteFile(filepath.Join(v.configsDir, name+".conf"), []byte(client.Export()), 0640)
+		if !pskOnly {
+			tx.WriteFile(filepath.Join(v.keysDir, name+"_priv"), []byte(keys.PrivateKey.String()), 0640)
+			tx.WriteFile(filepath.Join(v.keysDir, name+"_pub"), []byte(keys.PrivateKey.Public().String()), 0640)
+		}
+		tx.WriteFile(filepath.Join(v.keysDir, name+"_psk"), []byte(keys.PresharedKey.String()), 0640)
+
+		err := ensureDir(v.Conf.UserConfigPath, v.Conf.UserId, v.Conf.GroupId)
+		if err != nil {
+			return err
+		}
+		tx.WriteFile(filepath.Join(v.Conf.UserConfigPath, name+".conf"), []byte(client.Export()), 0640)
+		return nil
+	})
+}
+
+// SetClientMetadata replaces the metadata of a client.
+func (v *Vpn) SetClientMetadata(name string, meta Metadata) error {
+	if err := meta.Validate(); err != nil {
 		return err
 	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
 
-	err = ensureDir(v.Conf.UserConfigPath, v.Conf.UserId, v.Conf.GroupId)
-	if err != nil {
-		return err
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", ErrClientNotFound, name)
+		}
+		v.Clients = slices.Clone(v.Clients)
+		v.Clients[idx].Meta = meta
+		return nil
+	})
+}
+
+// DisableExpiredClients disables the enabled clients which have expired at now, returning their names. Nothing is
+// written if none of the loaded clients has expired.
+func (v *Vpn) DisableExpiredClients(now time.Time) ([]string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !slices.ContainsFunc(v.Clients, func(c Client) bool { return !c.Disabled && c.Meta.Expired(now) }) {
+		return nil, nil
 	}
-	err = os.WriteFile(filepath.Join(v.Conf.UserConfigPath, name+".conf"), []byte(client.Export()), 0640)
+
+	var expired []string
+	err := v.mutate(func(tx *fsutil.Transaction) error {
+		expired = nil
+		for i, client := range v.Clients {
+			if client.Disabled || !client.Meta.Expired(now) {
+				continue
+			}
+			if err := v.Server.DisablePeer(client.Name); err != nil {
+				return err
+			}
+			if len(expired) == 0 {
+				v.Clients = slices.Clone(v.Clients)
+			}
+			v.Clients[i].Disabled = true
+			expired = append(expired, client.Name)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return expired, nil
+}
 
-	return nil
+// ExpiringClients returns the enabled clients expiring before now+within, soonest first.
+func (v *Vpn) ExpiringClients(now time.Time, within time.Duration) []Client {
+	return v.Clients.Expiring(now, within)
+}
+
+// Tunnel returns the tunnel and its clients as loaded.
+func (v *Vpn) Tunnel() Tunnel {
+	return Tunnel{Endpoint: v.Conf.Endpoint, Server: v.Server, Clients: v.Clients, Warnings: v.Warnings}
 }
 
 func ensureDir(path string, uid, gid int) error {
@@ -0,0 +1,357 @@
+package pivpn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+func testClient(name string, addresses ...string) Client {
+	var c Client
+	c.Name = name
+	for _, address := range addresses {
+		c.Interface.Addresses = append(c.Interface.Addresses, netip.MustParsePrefix(address))
+	}
+	c.Peers = []wireguard.Peer{{}}
+	return c
+}
+
+func TestVpnAllocateAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  []string
+		clients ClientList
+		want    []string
+		wantErr bool
+	}{
+		{
+			"ipv4",
+			[]string{"10.6.0.1/24"},
+			ClientList{testClient("a", "10.6.0.2/24"), testClient("b", "10.6.0.4/24")},
+			[]string{"10.6.0.3/24"},
+			false,
+		},
+		{
+			"dual stack",
+			[]string{"10.6.0.1/24", "fd11:5ee:bad:c0de::1/64"},
+			ClientList{testClient("a", "10.6.0.2/24", "fd11:5ee:bad:c0de::2/64"), testClient("b", "10.6.0.3/24")},
+			[]string{"10.6.0.4/24", "fd11:5ee:bad:c0de::3/64"},
+			false,
+		},
+		{
+			"one address per family",
+			[]string{"fd11:5ee:bad:c0de::1/64", "10.6.0.1/24", "fd00::1/64"},
+			nil,
+			[]string{"fd11:5ee:bad:c0de::2/64", "10.6.0.2/24"},
+			false,
+		},
+		{
+			"full",
+			[]string{"10.6.0.1/30"},
+			ClientList{testClient("a", "10.6.0.2/30"), testClient("b", "10.6.0.3/30")},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Vpn{Clients: tt.clients}
+			for _, address := range tt.server {
+				v.Server.Interface.Addresses = append(v.Server.Interface.Addresses, netip.MustParsePrefix(address))
+			}
+			got, err := v.allocateAddresses(nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allocateAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var want []netip.Prefix
+			for _, address := range tt.want {
+				want = append(want, netip.MustParsePrefix(address))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("allocateAddresses() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestClientToPeer(t *testing.T) {
+	c := testClient("a", "10.6.0.2/24", "fd11:5ee:bad:c0de::2/64")
+	want := []netip.Prefix{netip.MustParsePrefix("10.6.0.2/32"), netip.MustParsePrefix("fd11:5ee:bad:c0de::2/128")}
+	if got := c.ToPeer().AllowedIPs; !reflect.DeepEqual(got, want) {
+		t.Errorf("ToPeer().AllowedIPs = %v, want %v", got, want)
+	}
+}
+
+func TestVpnReloadTolerant(t *testing.T) {
+	v, dir := testInstall(t)
+	if err := os.WriteFile(filepath.Join(dir, "configs", "b2.conf"), []byte("[Interface]\nPrivateKey = invalid\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	clientsTxt, _ := os.ReadFile(filepath.Join(dir, "configs", "clients.txt"))
+	if err := os.WriteFile(filepath.Join(dir, "configs", "clients.txt"), append(clientsTxt, "invalid line\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Reload(); err == nil {
+		t.Fatal("Reload() error = nil, want an error when not tolerant")
+	}
+
+	v.SetTolerant(true)
+	if err := v.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if len(v.Clients) != 1 || v.Clients[0].Name != "a1" {
+		t.Errorf("Reload() clients = %v, want a1", v.Clients)
+	}
+	var clients []string
+	for _, w := range v.Warnings {
+		clients = append(clients, w.Client)
+	}
+	if want := []string{"", "b2"}; !reflect.DeepEqual(clients, want) {
+		t.Errorf("Reload() warnings = %v, want for clients %q", v.Warnings, want)
+	}
+
+	// the skipped client keeps its clients.txt entry, the invalid line is dropped
+	if err := v.SyncClients(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "configs", "clients.txt")); string(got) != string(clientsTxt) {
+		t.Errorf("SyncClients() clients.txt = %q, want %q", got, clientsTxt)
+	}
+}
+
+func TestVpnRenameClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		wantErr bool
+		errIs   error
+	}{
+		{"rename", "a1", "c3", false, nil},
+		{"missing client", "c3", "d4", true, ErrClientNotFound},
+		{"existing client", "a1", "b2", true, ErrClientExists},
+		{"invalid name", "a1", "server", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, dir := testInstall(t)
+			if err := os.WriteFile(v.piholeHostFilePath, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			before := readFiles(t, filepath.Join(dir, "keys"))
+
+			err := v.RenameClient(tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil || (tt.errIs != nil && !errors.Is(err, tt.errIs)) {
+					t.Fatalf("RenameClient() error = %v, want %v", err, tt.errIs)
+				}
+				if got := readFiles(t, filepath.Join(dir, "keys")); !maps.Equal(got, before) {
+					t.Errorf("RenameClient() changed the keys to %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RenameClient() error = %v", err)
+			}
+
+			if err = v.Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			if v.Clients.Client(tt.from) != nil || v.Clients.Client(tt.to) == nil {
+				t.Errorf("Reload() clients = %v, want %s renamed to %s", v.Clients, tt.from, tt.to)
+			}
+			for _, name := range []string{"_priv", "_pub", "_psk"} {
+				if got, want := readFiles(t, filepath.Join(dir, "keys"))[tt.to+name], before[tt.from+name]; got != want {
+					t.Errorf("key %s = %q, want %q", tt.to+name, got, want)
+				}
+			}
+			for _, path := range []string{filepath.Join(dir, "configs", tt.from+".conf"), filepath.Join(dir, "home", "configs", tt.from+".conf"), filepath.Join(dir, "keys", tt.from+"_priv")} {
+				if _, err = os.Stat(path); err == nil {
+					t.Errorf("%s still exists", path)
+				}
+			}
+			if _, err = os.Stat(filepath.Join(dir, "home", "configs", tt.to+".conf")); err != nil {
+				t.Errorf("user config: %v", err)
+			}
+			if hosts, _ := os.ReadFile(v.piholeHostFilePath); !strings.Contains(string(hosts), "10.6.0.2 "+tt.to+".pivpn") {
+				t.Errorf("hosts = %q, want %s", hosts, tt.to)
+			}
+		})
+	}
+}
+
+func TestVpnRotateClientKeys(t *testing.T) {
+	for _, pskOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pskOnly=%v", pskOnly), func(t *testing.T) {
+			v, dir := testInstall(t)
+			if err := v.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			before := *v.Clients.Client("a1")
+			keys := readFiles(t, filepath.Join(dir, "keys"))
+
+			if err := v.RotateClientKeys("a1", pskOnly); err != nil {
+				t.Fatalf("RotateClientKeys() error = %v", err)
+			}
+			if err := v.Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+
+			after := v.Clients.Client("a1")
+			if (after.Interface.PrivateKey == before.Interface.PrivateKey) != pskOnly {
+				t.Errorf("RotateClientKeys() private key changed = %v, want %v", after.Interface.PrivateKey != before.Interface.PrivateKey, !pskOnly)
+			}
+			if after.Peers[0].PresharedKey == before.Peers[0].PresharedKey {
+				t.Errorf("RotateClientKeys() kept the preshared key")
+			}
+			if !after.CreationDate.Equal(before.CreationDate) || !reflect.DeepEqual(after.Interface.Addresses, before.Interface.Addresses) {
+				t.Errorf("RotateClientKeys() client = %v, want the creation date and addresses of %v", after, before)
+			}
+			rotated := readFiles(t, filepath.Join(dir, "keys"))
+			if rotated["a1_pub"] != after.Interface.PrivateKey.Public().String() || rotated["a1_psk"] != after.Peers[0].PresharedKey.String() {
+				t.Errorf("RotateClientKeys() key files = %v, want the keys of the client", rotated)
+			}
+			for _, name := range []string{"b2_priv", "b2_pub", "b2_psk"} {
+				if rotated[name] != keys[name] {
+					t.Errorf("RotateClientKeys() changed %s", name)
+				}
+			}
+			if userConf, _ := os.ReadFile(filepath.Join(dir, "home", "configs", "a1.conf")); string(userConf) != after.Export() {
+				t.Errorf("RotateClientKeys() user config = %q, want %q", userConf, after.Export())
+			}
+		})
+	}
+
+	v, _ := testInstall(t)
+	if err := v.RotateClientKeys("c3", false); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("RotateClientKeys() error = %v, want %v", err, ErrClientNotFound)
+	}
+}
+
+func TestVpnClientExpiry(t *testing.T) {
+	v, dir := testInstall(t)
+	now := time.Now()
+	if err := v.SetClientMetadata("b2", Metadata{Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("SetClientMetadata() error = %v", err)
+	}
+	if err := v.SetClientMetadata("a1", Metadata{Expires: now.Add(-time.Hour)}); err != nil {
+		t.Fatalf("SetClientMetadata() error = %v", err)
+	}
+
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if c := v.Clients.Client("b2"); c == nil || !c.Meta.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Reload() b2 = %v, want its expiry", c)
+	}
+	expiring := v.ExpiringClients(now, 2*time.Hour)
+	if len(expiring) != 2 || expiring[0].Name != "a1" || expiring[1].Name != "b2" {
+		t.Errorf("ExpiringClients() = %v, want a1 and b2", expiring)
+	}
+
+	expired, err := v.DisableExpiredClients(now)
+	if err != nil || !reflect.DeepEqual(expired, []string{"a1"}) {
+		t.Fatalf("DisableExpiredClients() = %v, %v, want [a1]", expired, err)
+	}
+	if expired, err = v.DisableExpiredClients(now); err != nil || len(expired) > 0 {
+		t.Errorf("DisableExpiredClients() again = %v, %v, want none", expired, err)
+	}
+	if err = v.EnableClient("a1"); !errors.Is(err, ErrClientExpired) {
+		t.Errorf("EnableClient() error = %v, want %v", err, ErrClientExpired)
+	}
+	if err = v.SetClientMetadata("a1", Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.EnableClient("a1"); err != nil {
+		t.Errorf("EnableClient() error = %v", err)
+	}
+
+	// the clients without metadata are left out, and clients.txt stays as PiVPN writes it
+	data, _ := os.ReadFile(filepath.Join(dir, "configs", MetadataFileName))
+	if list, err := ParseMetadata(bytes.NewReader(data)); err != nil || len(list) != 1 {
+		t.Errorf("%s = %s, %v, want b2 only", MetadataFileName, data, err)
+	}
+	clientsTxt, _ := os.ReadFile(filepath.Join(dir, "configs", "clients.txt"))
+	if _, err = ParseClientList(bytes.NewReader(clientsTxt)); err != nil {
+		t.Errorf("clients.txt: %v", err)
+	}
+}
+
+// readTree returns the content of every file under dir.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == LockFileName {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		files[path] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestVpnRollback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating the keys needs to chown them to root")
+	}
+	v, dir := testInstall(t)
+	// without a peer applier, the failing reload of the tunnel fails the mutations
+	v.SetReloadCmds([]string{"true"}, []string{"false"})
+	if err := v.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := readTree(t, dir)
+
+	if err := v.AddClient("c3"); err == nil {
+		t.Errorf("AddClient() with a failing reload error = nil")
+	}
+	if after := readTree(t, dir); !maps.Equal(after, before) {
+		t.Errorf("AddClient() with a failing reload changed the files: %v", slices.Sorted(maps.Keys(after)))
+	}
+	if err := v.RemoveClient("a1"); err == nil {
+		t.Errorf("RemoveClient() with a failing reload error = nil")
+	}
+	if after := readTree(t, dir); !maps.Equal(after, before) {
+		t.Errorf("RemoveClient() with a failing reload changed the files: %v", slices.Sorted(maps.Keys(after)))
+	}
+	if len(v.Clients) != 2 || v.Clients.Client("c3") != nil || v.Clients.Client("a1") == nil {
+		t.Errorf("Clients after the rollbacks = %v, want a1 and b2", v.Clients)
+	}
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
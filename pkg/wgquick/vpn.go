@@ -0,0 +1,615 @@
+// Package wgquick manages the clients of a bare wg-quick tunnel, without PiVPN.
+//
+// wg-quick only knows about the tunnel configuration. The configurations of the clients, their clients.txt and their
+// metadata are kept in a directory of their own, in the PiVPN formats.
+package wgquick
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"magnax.ca/VPNManager/internal/fsutil"
+	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+const (
+	DefaultTunnelName = "wg0"
+	DefaultTunnelDir  = "/etc/wireguard/"
+	// DefaultClientsDir holds the clients dir of each tunnel, named after it.
+	DefaultClientsDir = "/etc/vpnmanager/clients"
+
+	// LockFileName is the lock file in the clients dir, taken by every read-modify-write of the files.
+	LockFileName = "vpnmanager.lock"
+)
+
+var (
+	clientNameRE = regexp.MustCompile(`^[a-zA-Z0-9.@_-]{1,32}$`)
+
+	ipv4All = netip.MustParsePrefix("0.0.0.0/0")
+	ipv6All = netip.MustParsePrefix("::0/0")
+)
+
+type Vpn struct {
+	tunnelFilePath string
+	clientsDir     string
+
+	// Endpoint and DNS are written in the configurations of new clients.
+	Endpoint wireguard.Endpoint
+	DNS      []netip.Addr
+	// ReloadCmd reloads the tunnel, e.g. `systemctl reload wg-quick@wg0`.
+	ReloadCmd []string
+	// IPAM allocates the addresses of new clients, it defaults to the lowest free address.
+	IPAM *pivpn.IPAM
+	// PeerApplier applies peer changes without reloading the interface, they are reloaded if it's nil.
+	PeerApplier wireguard.PeerApplier
+	// Executor runs the external commands, it defaults to wireguard.ExecExecutor.
+	Executor wireguard.Executor
+	// LockTimeout is how long to wait for other processes to release the lock file.
+	LockTimeout time.Duration
+
+	// Tolerant skips the peers without a valid client configuration instead of failing, as the ones added by hand.
+	// They are reported in Warnings and kept as is.
+	Tolerant bool
+	Warnings []pivpn.Warning
+	// infos and metadata are the clients.txt entries and metadata as loaded, kept for the skipped peers
+	infos    map[string]pivpn.ClientInfo
+	metadata pivpn.MetadataList
+
+	lock sync.Mutex
+
+	Server  wireguard.Config
+	Clients pivpn.ClientList
+
+	// synced is the tunnel configuration as last read from or written to disk
+	synced *wireguard.Config
+}
+
+// NewVpn returns the tunnel name of tunnelDir, whose clients are in clientsDir. The tunnel and its clients are only
+// read by Reload.
+func NewVpn(name, tunnelDir, clientsDir string, endpoint wireguard.Endpoint, dns []netip.Addr) *Vpn {
+	return &Vpn{
+		tunnelFilePath: filepath.Join(tunnelDir, name+".conf"),
+		clientsDir:     clientsDir,
+		Endpoint:       endpoint,
+		DNS:            dns,
+		LockTimeout:    pivpn.DefaultLockTimeout,
+	}
+}
+
+func (v *Vpn) SetReloadCmd(cmd []string) {
+	v.ReloadCmd = cmd
+}
+
+func (v *Vpn) SetIPAM(ipam *pivpn.IPAM) {
+	v.IPAM = ipam
+}
+
+func (v *Vpn) SetTolerant(tolerant bool) {
+	v.Tolerant = tolerant
+}
+
+func (v *Vpn) SetPeerApplier(applier wireguard.PeerApplier) {
+	v.PeerApplier = applier
+}
+
+func (v *Vpn) SetLockTimeout(timeout time.Duration) {
+	v.LockTimeout = timeout
+}
+
+func (v *Vpn) Name() string {
+	return v.Server.Name
+}
+
+// Tunnel returns the tunnel and its clients as loaded.
+func (v *Vpn) Tunnel() pivpn.Tunnel {
+	return pivpn.Tunnel{Endpoint: v.Endpoint, Server: v.Server, Clients: v.Clients, Warnings: v.Warnings}
+}
+
+func (v *Vpn) clientFilePath(name string) string {
+	return filepath.Join(v.clientsDir, name+".conf")
+}
+
+// lockFile takes the lock file of the clients dir, creating the dir if needed.
+func (v *Vpn) lockFile(exclusive bool) (*fsutil.Lock, error) {
+	if err := os.MkdirAll(v.clientsDir, 0700); err != nil {
+		return nil, err
+	}
+	return fsutil.LockFile(filepath.Join(v.clientsDir, LockFileName), exclusive, v.LockTimeout)
+}
+
+// Reload reads the tunnel and its clients from disk, under the shared lock.
+func (v *Vpn) Reload() error {
+	lock, err := v.lockFile(false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	return v.load()
+}
+
+// load reads the tunnel and its clients from disk, the lock must be held.
+func (v *Vpn) load() error {
+	tunnelConfFile, err := os.Open(v.tunnelFilePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tunnelConfFile.Close() }()
+	tunnelConf, err := wireguard.ParseConfig(tunnelConfFile, strings.TrimSuffix(filepath.Base(v.tunnelFilePath), ".conf"))
+	if err != nil {
+		return err
+	}
+
+	v.Warnings = nil
+	infos, err := v.loadClientList()
+	if err != nil {
+		return err
+	}
+	v.infos = infos.AsMap()
+	if v.metadata, err = v.loadMetadata(); err != nil {
+		return err
+	}
+
+	v.Clients = make(pivpn.ClientList, 0, len(tunnelConf.Peers))
+	for _, peer := range tunnelConf.Peers {
+		client, err := v.loadClient(&peer)
+		if err != nil {
+			if !v.Tolerant {
+				return err
+			}
+			v.Warnings = append(v.Warnings, pivpn.Warning{Client: peer.Name, Err: err})
+			continue
+		}
+		v.Clients = append(v.Clients, *client)
+	}
+	for _, warning := range v.Warnings {
+		slog.Warn("tunnel loaded with problems", "tunnel", tunnelConf.Name, "err", warning)
+	}
+
+	v.Server = *tunnelConf
+	v.synced = tunnelConf.Clone()
+	if v.IPAM != nil {
+		v.IPAM.Released = nil
+	}
+	return nil
+}
+
+// loadClient reads the configuration of the client of a tunnel peer.
+func (v *Vpn) loadClient(peer *wireguard.Peer) (*pivpn.Client, error) {
+	if peer.Name == "" {
+		return nil, fmt.Errorf("peer %s has no name, it isn't managed", peer.PublicKey.String())
+	}
+	file, err := os.Open(v.clientFilePath(peer.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	conf, err := wireguard.ParseConfig(file, peer.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Peers) == 0 {
+		return nil, fmt.Errorf("client %s has no server peer", peer.Name)
+	}
+	return &pivpn.Client{
+		Config:       *conf,
+		Disabled:     peer.Disabled,
+		CreationDate: v.infos[peer.Name].CreationDate,
+		Meta:         v.metadata[peer.Name],
+	}, nil
+}
+
+// loadClientList reads clients.txt, which is missing until the first client is created.
+func (v *Vpn) loadClientList() (pivpn.ClientInfoList, error) {
+	file, err := os.Open(filepath.Join(v.clientsDir, "clients.txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return pivpn.ParseClientList(file)
+}
+
+// loadMetadata reads the metadata file, which may be missing.
+func (v *Vpn) loadMetadata() (pivpn.MetadataList, error) {
+	file, err := os.Open(filepath.Join(v.clientsDir, pivpn.MetadataFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return pivpn.MetadataList{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	list, err := pivpn.ParseMetadata(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pivpn.MetadataFileName, err)
+	}
+	return list, nil
+}
+
+// clientFiles returns clients.txt and the metadata file of the clients, keeping the entries of the skipped peers.
+func (v *Vpn) clientFiles() (string, string) {
+	infos := v.Clients.ToClientInfoList()
+	metadata := make(pivpn.MetadataList, len(v.Clients))
+	for _, client := range v.Clients {
+		metadata[client.Name] = client.Meta
+	}
+	for _, peer := range v.Server.Peers {
+		if peer.Name == "" || v.Clients.Client(peer.Name) != nil {
+			continue
+		}
+		if info, ok := v.infos[peer.Name]; ok {
+			infos = append(infos, info)
+		}
+		if meta, ok := v.metadata[peer.Name]; ok {
+			metadata[peer.Name] = meta
+		}
+	}
+	return infos.Export(), metadata.Export()
+}
+
+func (v *Vpn) run(args []string) error {
+	executor := v.Executor
+	if executor == nil {
+		executor = wireguard.ExecExecutor{}
+	}
+	return executor.Run(wireguard.Command{Args: args})
+}
+
+// reloadTunnel applies the tunnel changes since the last reload to the running interface, through the PeerApplier if
+// only peers changed.
+func (v *Vpn) reloadTunnel() error {
+	diff := wireguard.Diff(v.synced, &v.Server)
+	if diff.IsEmpty() {
+		return nil
+	}
+	applied := false
+	if updates, ok := wireguard.NewPeerUpdates(diff, &v.Server); ok && !updates.IsEmpty() && v.PeerApplier != nil {
+		if err := v.PeerApplier.ApplyPeerUpdates(v.Name(), updates); err != nil {
+			slog.Warn("unable to apply peer changes, reloading the tunnel instead", "tunnel", v.Name(), "err", err)
+		} else {
+			applied = true
+		}
+	}
+	if !applied {
+		if err := v.run(v.ReloadCmd); err != nil {
+			return err
+		}
+	}
+	v.synced = v.Server.Clone()
+	return nil
+}
+
+// mutate runs a mutation of the vpn under the lock, on the state reloaded from disk. The mutation changes the
+// in-memory state and stages the client files specific to it. The tunnel, clients.txt and metadata files are then
+// written with them, and the tunnel is reloaded. If any step fails, the files and the in-memory state are rolled back.
+func (v *Vpn) mutate(mutation func(tx *fsutil.Transaction) error) error {
+	lock, err := v.lockFile(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lock.Unlock() }()
+	if err = v.load(); err != nil {
+		return err
+	}
+
+	server, clients := v.Server.Clone(), slices.Clone(v.Clients)
+	rollback := func(err error) error {
+		v.Server, v.Clients = *server, clients
+		if v.IPAM != nil {
+			v.IPAM.Released = nil
+		}
+		return err
+	}
+
+	tx := &fsutil.Transaction{}
+	if err = mutation(tx); err != nil {
+		return rollback(err)
+	}
+	infos, metadata := v.clientFiles()
+	tx.WriteFile(v.tunnelFilePath, []byte(v.Server.Export()), 0600)
+	tx.WriteFile(filepath.Join(v.clientsDir, "clients.txt"), []byte(infos), 0600)
+	tx.WriteFile(filepath.Join(v.clientsDir, pivpn.MetadataFileName), []byte(metadata), 0600)
+
+	err = tx.Commit()
+	if err == nil {
+		if err = v.reloadTunnel(); err != nil {
+			err = errors.Join(err, tx.Rollback())
+		}
+	}
+	if err != nil {
+		slog.Error("changes rolled back", "tunnel", v.Name(), "err", err)
+		return rollback(err)
+	}
+	return nil
+}
+
+// ipam returns the address allocator, with the released addresses loaded if its policy needs them.
+func (v *Vpn) ipam() (*pivpn.IPAM, error) {
+	if v.IPAM == nil {
+		v.IPAM = &pivpn.IPAM{}
+	}
+	if v.IPAM.Reuse != pivpn.ReuseAvoidRecent || v.IPAM.Released != nil {
+		return v.IPAM, nil
+	}
+
+	file, err := os.Open(filepath.Join(v.clientsDir, "released.txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		v.IPAM.Released = make(map[netip.Addr]time.Time)
+		return v.IPAM, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	if v.IPAM.Released, err = pivpn.ParseReleased(file); err != nil {
+		return nil, err
+	}
+	return v.IPAM, nil
+}
+
+// newClient returns the configuration of a client of the tunnel, routing everything through it.
+func (v *Vpn) newClient(keys *pivpn.Keys, addresses []netip.Prefix, created time.Time) pivpn.Client {
+	return pivpn.Client{
+		Config: wireguard.Config{
+			Name: keys.Name,
+			Interface: wireguard.Interface{
+				PrivateKey: keys.PrivateKey,
+				Addresses:  addresses,
+				DNS:        slices.Clone(v.DNS),
+			},
+			Peers: []wireguard.Peer{
+				{
+					PublicKey:           *v.Server.Interface.PrivateKey.Public(),
+					PresharedKey:        keys.PresharedKey,
+					AllowedIPs:          []netip.Prefix{ipv4All, ipv6All},
+					Endpoint:            v.Endpoint,
+					PersistentKeepalive: 25,
+				},
+			},
+		},
+		CreationDate: created,
+	}
+}
+
+func validateClientName(name string) error {
+	if !clientNameRE.MatchString(name) {
+		return fmt.Errorf("invalid client name %q: name must only contains alphanumerical, period, @, underscore, and hyphen; and be between 1 and 32 characters", name)
+	}
+	return nil
+}
+
+// AddClientWithMetadata creates a client with its metadata, with the requested addresses if any.
+func (v *Vpn) AddClientWithMetadata(name string, meta pivpn.Metadata, requested ...netip.Addr) error {
+	if err := validateClientName(name); err != nil {
+		return err
+	}
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		for _, peer := range v.Server.Peers {
+			if peer.Name == name {
+				return fmt.Errorf("%w: %s", pivpn.ErrClientExists, name)
+			}
+		}
+
+		ipam, err := v.ipam()
+		if err != nil {
+			return err
+		}
+		used := make(map[netip.Addr]bool)
+		for _, address := range v.Server.Interface.Addresses {
+			used[address.Addr()] = true
+		}
+		for _, peer := range v.Server.Peers {
+			for _, ip := range peer.AllowedIPs {
+				if ip.IsSingleIP() {
+					used[ip.Addr()] = true
+				}
+			}
+		}
+		addresses, err := ipam.Allocate(v.Server.Interface.Addresses, used, requested, time.Now())
+		if err != nil {
+			return fmt.Errorf("unable to add client: %w", err)
+		}
+
+		client := v.newClient(pivpn.NewKeys(name), addresses, time.Now())
+		client.Meta = meta
+		tx.WriteFile(v.clientFilePath(name), []byte(client.Export()), 0600)
+		v.Clients = append(slices.Clone(v.Clients), client)
+		v.Server.Peers = append(v.Server.Peers, client.ToPeer())
+		return nil
+	})
+}
+
+// RemoveClient removes a client, recording its addresses if the reuse policy needs them.
+func (v *Vpn) RemoveClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		if err := v.Server.RemovePeer(name); err != nil {
+			return err
+		}
+		if client := v.Clients.Client(name); client != nil {
+			ipam, err := v.ipam()
+			if err != nil {
+				return err
+			}
+			if ipam.Reuse == pivpn.ReuseAvoidRecent {
+				var addrs []netip.Addr
+				for _, address := range client.Interface.Addresses {
+					addrs = append(addrs, address.Addr())
+				}
+				ipam.Release(addrs, time.Now())
+				tx.WriteFile(filepath.Join(v.clientsDir, "released.txt"), []byte(pivpn.ExportReleased(ipam.Released)), 0600)
+			}
+		}
+		v.Clients = slices.DeleteFunc(slices.Clone(v.Clients), func(c pivpn.Client) bool { return c.Name == name })
+		tx.Remove(v.clientFilePath(name))
+		return nil
+	})
+}
+
+// setDisabled disables or enables a client, the lock must be held.
+func (v *Vpn) setDisabled(name string, disabled bool) error {
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c pivpn.Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+		}
+		if !disabled && v.Clients[idx].Meta.Expired(time.Now()) {
+			return fmt.Errorf("%w: %s expired on %s, change its expiry first", pivpn.ErrClientExpired, name, v.Clients[idx].Meta.Expires.Local().Format(time.DateTime))
+		}
+		var err error
+		if disabled {
+			err = v.Server.DisablePeer(name)
+		} else {
+			err = v.Server.EnablePeer(name)
+		}
+		if err != nil {
+			return err
+		}
+		v.Clients = slices.Clone(v.Clients)
+		v.Clients[idx].Disabled = disabled
+		return nil
+	})
+}
+
+func (v *Vpn) DisableClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.setDisabled(name, true)
+}
+
+// EnableClient enables a disabled client, unless it has expired.
+func (v *Vpn) EnableClient(name string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.setDisabled(name, false)
+}
+
+// RenameClient renames a client, keeping its keys and addresses.
+func (v *Vpn) RenameClient(name, newName string) error {
+	if err := validateClientName(newName); err != nil {
+		return err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c pivpn.Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+		}
+		for _, peer := range v.Server.Peers {
+			if peer.Name == newName {
+				return fmt.Errorf("%w: %s", pivpn.ErrClientExists, newName)
+			}
+		}
+		for i := range v.Server.Peers {
+			if v.Server.Peers[i].Name == name {
+				v.Server.Peers[i].Name = newName
+			}
+		}
+		v.Clients = slices.Clone(v.Clients)
+		v.Clients[idx].Name = newName
+		tx.Remove(v.clientFilePath(name))
+		tx.WriteFile(v.clientFilePath(newName), []byte(v.Clients[idx].Export()), 0600)
+		return nil
+	})
+}
+
+// RotateClientKeys replaces the keys of a client, or only its preshared key, keeping its name, addresses and creation
+// date.
+func (v *Vpn) RotateClientKeys(name string, pskOnly bool) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c pivpn.Client) bool { return c.Name == name })
+		peer := slices.IndexFunc(v.Server.Peers, func(p wireguard.Peer) bool { return p.Name == name })
+		if idx < 0 || peer < 0 {
+			return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+		}
+
+		keys := pivpn.NewKeys(name)
+		if pskOnly {
+			keys.PrivateKey = v.Clients[idx].Interface.PrivateKey
+		}
+		v.Clients = slices.Clone(v.Clients)
+		client := &v.Clients[idx]
+		client.Interface.PrivateKey = keys.PrivateKey
+		client.Peers = slices.Clone(client.Peers)
+		client.Peers[0].PresharedKey = keys.PresharedKey
+		v.Server.Peers[peer].PublicKey = *keys.PublicKey()
+		v.Server.Peers[peer].PresharedKey = keys.PresharedKey
+		tx.WriteFile(v.clientFilePath(name), []byte(client.Export()), 0600)
+		return nil
+	})
+}
+
+// SetClientMetadata replaces the metadata of a client.
+func (v *Vpn) SetClientMetadata(name string, meta pivpn.Metadata) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.mutate(func(tx *fsutil.Transaction) error {
+		idx := slices.IndexFunc(v.Clients, func(c pivpn.Client) bool { return c.Name == name })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", pivpn.ErrClientNotFound, name)
+		}
+		v.Clients = slices.Clone(v.Clients)
+		v.Clients[idx].Meta = meta
+		return nil
+	})
+}
+
+// DisableExpiredClients disables the enabled clients which have expired at now, returning their names. Nothing is
+// written if none of the loaded clients has expired.
+func (v *Vpn) DisableExpiredClients(now time.Time) ([]string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !slices.ContainsFunc(v.Clients, func(c pivpn.Client) bool { return !c.Disabled && c.Meta.Expired(now) }) {
+		return nil, nil
+	}
+
+	var expired []string
+	err := v.mutate(func(tx *fsutil.Transaction) error {
+		expired = nil
+		v.Clients = slices.Clone(v.Clients)
+		for i, client := range v.Clients {
+			if client.Disabled || !client.Meta.Expired(now) {
+				continue
+			}
+			if err := v.Server.DisablePeer(client.Name); err != nil {
+				return err
+			}
+			v.Clients[i].Disabled = true
+			expired = append(expired, client.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
@@ -0,0 +1,128 @@
+package wgquick
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"magnax.ca/VPNManager/pkg/pivpn"
+	"magnax.ca/VPNManager/pkg/wireguard"
+)
+
+// testTunnel writes a wg-quick tunnel with a peer added by hand, and returns a tolerant vpn of it.
+func testTunnel(t *testing.T) (*Vpn, string) {
+	t.Helper()
+	dir := t.TempDir()
+	serverKey, _ := wireguard.NewPrivateKey()
+	handKey, _ := wireguard.NewPrivateKey()
+	tunnel := "[Interface]\nPrivateKey = " + serverKey.String() + "\nAddress = 10.8.0.1/24\nListenPort = 51820\n\n" +
+		"[Peer]\nPublicKey = " + handKey.Public().String() + "\nAllowedIPs = 10.8.0.2/32\n"
+	if err := os.WriteFile(filepath.Join(dir, "wg1.conf"), []byte(tunnel), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewVpn("wg1", dir, filepath.Join(dir, "clients"), wireguard.Endpoint{Host: "vpn.example.com", Port: 51820}, nil)
+	v.SetReloadCmd([]string{"true"})
+	v.SetTolerant(true)
+	return v, dir
+}
+
+func TestVpn(t *testing.T) {
+	v, dir := testTunnel(t)
+	if err := v.Reload(); err != nil || len(v.Clients) != 0 || len(v.Warnings) != 1 {
+		t.Fatalf("Reload() = %v, %v, want a warning for the hand-added peer", v.Warnings, err)
+	}
+
+	meta := pivpn.Metadata{Owner: "Alice", Tags: []string{"Laptop"}, Expires: time.Now().Add(-time.Hour)}
+	if err := v.AddClientWithMetadata("alice1", meta); err != nil {
+		t.Fatalf("AddClientWithMetadata() error = %v", err)
+	}
+	if err := v.AddClientWithMetadata("alice1", pivpn.Metadata{}); !errors.Is(err, pivpn.ErrClientExists) {
+		t.Errorf("AddClientWithMetadata() twice error = %v, want %v", err, pivpn.ErrClientExists)
+	}
+	if err := v.AddClientWithMetadata("bob2", pivpn.Metadata{}, netip.MustParseAddr("10.8.0.10")); err != nil {
+		t.Fatalf("AddClientWithMetadata() error = %v", err)
+	}
+	if expired, err := v.DisableExpiredClients(time.Now()); err != nil || len(expired) != 1 || expired[0] != "alice1" {
+		t.Errorf("DisableExpiredClients() = %v, %v, want alice1", expired, err)
+	}
+	if err := v.EnableClient("alice1"); !errors.Is(err, pivpn.ErrClientExpired) {
+		t.Errorf("EnableClient() error = %v, want %v", err, pivpn.ErrClientExpired)
+	}
+	if err := v.RenameClient("bob2", "carol3"); err != nil {
+		t.Fatalf("RenameClient() error = %v", err)
+	}
+
+	// a new vpn reads everything back from the files
+	reloaded := NewVpn("wg1", dir, filepath.Join(dir, "clients"), v.Endpoint, nil)
+	reloaded.SetReloadCmd([]string{"true"})
+	if err := reloaded.Reload(); err == nil {
+		t.Errorf("Reload() of an intolerant vpn with a hand-added peer error = nil")
+	}
+	reloaded.SetTolerant(true)
+	if err := reloaded.Reload(); err != nil || len(reloaded.Clients) != 2 || len(reloaded.Server.Peers) != 3 {
+		t.Fatalf("Reload() = %v, %v, want 2 clients and 3 peers", reloaded.Clients, err)
+	}
+	alice, carol := reloaded.Clients.Client("alice1"), reloaded.Clients.Client("carol3")
+	if alice == nil || !alice.Disabled || alice.Meta.Owner != "Alice" || !alice.Meta.HasTag("laptop") || alice.CreationDate.IsZero() {
+		t.Errorf("Reload() alice1 = %+v, want the disabled client with its metadata", alice)
+	}
+	if alice != nil && (alice.Interface.Addresses[0].Addr() != netip.MustParseAddr("10.8.0.3") || alice.Peers[0].Endpoint != v.Endpoint) {
+		t.Errorf("Reload() alice1 = %v, want 10.8.0.3 connecting to %v", alice.Config, v.Endpoint)
+	}
+	if carol == nil || carol.Interface.Addresses[0].Addr() != netip.MustParseAddr("10.8.0.10") {
+		t.Errorf("Reload() carol3 = %v, want bob2 renamed", carol)
+	}
+
+	if err := reloaded.RotateClientKeys("carol3", false); err != nil {
+		t.Fatalf("RotateClientKeys() error = %v", err)
+	}
+	if rotated := reloaded.Clients.Client("carol3"); carol == nil || rotated.PublicKey() == carol.PublicKey() {
+		t.Errorf("RotateClientKeys() kept the key of carol3")
+	}
+	if err := reloaded.RemoveClient("carol3"); err != nil {
+		t.Fatalf("RemoveClient() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clients", "carol3.conf")); !os.IsNotExist(err) {
+		t.Errorf("RemoveClient() kept the configuration, stat error = %v", err)
+	}
+	if err := reloaded.Reload(); err != nil || len(reloaded.Clients) != 1 || len(reloaded.Server.Peers) != 2 {
+		t.Errorf("Reload() after RemoveClient() = %v, %v, want alice1 and the hand-added peer", reloaded.Server.Peers, err)
+	}
+}
+
+func TestVpnRollback(t *testing.T) {
+	v, dir := testTunnel(t)
+	tunnel, _ := os.ReadFile(filepath.Join(dir, "wg1.conf"))
+	v.SetReloadCmd([]string{"false"})
+
+	if err := v.AddClientWithMetadata("alice1", pivpn.Metadata{}); err == nil {
+		t.Fatalf("AddClientWithMetadata() with a failing reload error = nil")
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, "wg1.conf")); string(after) != string(tunnel) || len(v.Clients) != 0 {
+		t.Errorf("AddClientWithMetadata() with a failing reload changed the tunnel")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clients", "alice1.conf")); !os.IsNotExist(err) {
+		t.Errorf("AddClientWithMetadata() with a failing reload kept the configuration, stat error = %v", err)
+	}
+}
+
+func TestVpnLockTimeout(t *testing.T) {
+	v, dir := testTunnel(t)
+	lock, err := v.lockFile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lock.Unlock() }()
+
+	v.SetLockTimeout(100 * time.Millisecond)
+	if err := v.AddClientWithMetadata("alice1", pivpn.Metadata{}); !errors.Is(err, pivpn.ErrLockTimeout) {
+		t.Errorf("AddClientWithMetadata() while locked error = %v, want %v", err, pivpn.ErrLockTimeout)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clients", "alice1.conf")); !os.IsNotExist(err) {
+		t.Errorf("AddClientWithMetadata() while locked wrote the configuration, stat error = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Command is a command line and the data fed to its standard input, if any.
+type Command struct {
+	Args  []string
+	Stdin []byte
+}
+
+func (c Command) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Executor runs commands. It can be replaced to record or to fake the commands.
+type Executor interface {
+	Run(cmd Command) error
+}
+
+// ExecExecutor runs the commands as processes.
+type ExecExecutor struct{}
+
+func (ExecExecutor) Run(cmd Command) error {
+	c := exec.Command(cmd.Args[0], cmd.Args[1:]...)
+	if cmd.Stdin != nil {
+		c.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c *Config) peerByKey(key Key) *Peer {
+	for i := range c.Peers {
+		if c.Peers[i].PublicKey == key {
+			return &c.Peers[i]
+		}
+	}
+	return nil
+}
+
+// PeerApplier applies peer updates to a running interface.
+type PeerApplier interface {
+	ApplyPeerUpdates(iface string, updates *PeerUpdates) error
+}
+
+// PeerUpdates are the peer changes to apply to a running interface, the removals being applied first.
+type PeerUpdates struct {
+	Remove []Key
+	Set    []Peer
+}
+
+func (u *PeerUpdates) IsEmpty() bool {
+	return len(u.Remove) == 0 && len(u.Set) == 0
+}
+
+// peerRuntimeFields are the peer fields which can be changed on a running interface, or which don't matter to it.
+var peerRuntimeFields = map[string]bool{
+	"Name":                true,
+	"PublicKey":           true,
+	"PresharedKey":        true,
+	"AllowedIPs":          true,
+	"Endpoint":            true,
+	"PersistentKeepalive": true,
+}
+
+// NewPeerUpdates returns the updates applying the peer changes of diff to a running interface, conf being the new
+// configuration.
+//
+// It returns false if some changes can't be applied that way, such as changes to the interface itself, in which case
+// the interface must be reloaded instead.
+func NewPeerUpdates(diff *ConfigDiff, conf *Config) (*PeerUpdates, bool) {
+	if len(diff.Interface) > 0 {
+		return nil, false
+	}
+
+	updates := &PeerUpdates{}
+	for _, change := range diff.Peers {
+		if change.Type == PeerRemoved {
+			updates.Remove = append(updates.Remove, change.PublicKey)
+			continue
+		}
+
+		peer := conf.peerByKey(change.PublicKey)
+		if peer == nil {
+			return nil, false
+		}
+
+		needsSet := change.Type == PeerAdded || change.Toggle == PeerEnabled
+		for _, f := range change.Fields {
+			if !peerRuntimeFields[f.Field] {
+				return nil, false
+			}
+			switch f.Field {
+			case "Name":
+			case "PublicKey":
+				oldKey, err := ParseKeyBase64(f.Old)
+				if err != nil {
+					return nil, false
+				}
+				updates.Remove = append(updates.Remove, *oldKey)
+				needsSet = true
+			default:
+				needsSet = true
+			}
+		}
+
+		if change.Toggle == PeerDisabled && change.Type != PeerAdded {
+			updates.Remove = append(updates.Remove, peer.PublicKey)
+		} else if needsSet && !peer.Disabled {
+			updates.Set = append(updates.Set, *peer)
+		}
+	}
+
+	return updates, true
+}
+
+func wgSetPeer(iface string, peer *Peer) Command {
+	cmd := Command{Args: []string{"set", iface, "peer", peer.PublicKey.String()}}
+
+	if peer.PresharedKey.IsZero() {
+		cmd.Args = append(cmd.Args, "preshared-key", "/dev/null")
+	} else {
+		cmd.Args = append(cmd.Args, "preshared-key", "/dev/stdin")
+		cmd.Stdin = []byte(peer.PresharedKey.String())
+	}
+
+	allowedIPs := make([]string, len(peer.AllowedIPs))
+	for i, ip := range peer.AllowedIPs {
+		allowedIPs[i] = ip.String()
+	}
+	cmd.Args = append(cmd.Args, "allowed-ips", strings.Join(allowedIPs, ","))
+
+	if !peer.Endpoint.IsEmpty() {
+		cmd.Args = append(cmd.Args, "endpoint", peer.Endpoint.String())
+	}
+
+	keepalive := "off"
+	if peer.PersistentKeepalive > 0 {
+		keepalive = strconv.Itoa(int(peer.PersistentKeepalive))
+	}
+	cmd.Args = append(cmd.Args, "persistent-keepalive", keepalive)
+
+	return cmd
+}
+
+// WgSetCommands returns the `wg set` arguments applying the updates.
+func (u *PeerUpdates) WgSetCommands(iface string) []Command {
+	cmds := make([]Command, 0, len(u.Remove)+len(u.Set))
+	for _, key := range u.Remove {
+		cmds = append(cmds, Command{Args: []string{"set", iface, "peer", key.String(), "remove"}})
+	}
+	for _, peer := range u.Set {
+		cmds = append(cmds, wgSetPeer(iface, &peer))
+	}
+	return cmds
+}
+
+// WgSet applies peer updates by running `wg set`.
+//
+// Cmd is the `wg` command, with its arguments if any. It defaults to `wg`.
+// Executor runs the commands, it defaults to ExecExecutor.
+type WgSet struct {
+	Cmd      []string
+	Executor Executor
+}
+
+func (w WgSet) ApplyPeerUpdates(iface string, updates *PeerUpdates) error {
+	wg, executor := w.Cmd, w.Executor
+	if len(wg) == 0 {
+		wg = []string{"wg"}
+	}
+	if executor == nil {
+		executor = ExecExecutor{}
+	}
+	for _, cmd := range updates.WgSetCommands(iface) {
+		cmd.Args = append(slices.Clone(wg), cmd.Args...)
+		if err := executor.Run(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package wireguard
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPeerUpdatesWgSetCommands(t *testing.T) {
+	peerKey3, _ := ParseKeyBase64(testPeerKey3)
+
+	tests := []struct {
+		name   string
+		edit   func(*Config)
+		want   []Command
+		wantOk bool
+	}{
+		{
+			"add",
+			func(c *Config) {
+				c.Peers = append(c.Peers, Peer{
+					Name:       "tablet",
+					PublicKey:  *peerKey3,
+					AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.6.0.4/32")},
+				})
+			},
+			[]Command{
+				{Args: []string{"set", "wg0", "peer", testPeerKey3, "preshared-key", "/dev/null", "allowed-ips", "10.6.0.4/32", "persistent-keepalive", "off"}},
+			},
+			true,
+		},
+		{
+			"remove and disable",
+			func(c *Config) {
+				c.Peers[0].Disabled = true
+				c.Peers = c.Peers[:1]
+			},
+			[]Command{
+				{Args: []string{"set", "wg0", "peer", testPeerKey1, "remove"}},
+				{Args: []string{"set", "wg0", "peer", testPeerKey2, "remove"}},
+			},
+			true,
+		},
+		{
+			"enable",
+			func(c *Config) { c.Peers[1].Disabled = false },
+			[]Command{
+				{
+					Args:  []string{"set", "wg0", "peer", testPeerKey2, "preshared-key", "/dev/stdin", "allowed-ips", "10.6.0.3/32", "persistent-keepalive", "off"},
+					Stdin: []byte(testPSK),
+				},
+			},
+			true,
+		},
+		{
+			"rename only",
+			func(c *Config) { c.Peers[0].Name = "phone2" },
+			[]Command{},
+			true,
+		},
+		{
+			"rotate key",
+			func(c *Config) { c.Peers[0].PublicKey = *peerKey3 },
+			[]Command{
+				{Args: []string{"set", "wg0", "peer", testPeerKey1, "remove"}},
+				{
+					Args:  []string{"set", "wg0", "peer", testPeerKey3, "preshared-key", "/dev/stdin", "allowed-ips", "10.6.0.2/32", "persistent-keepalive", "off"},
+					Stdin: []byte(testPSK),
+				},
+			},
+			true,
+		},
+		{
+			"interface change",
+			func(c *Config) { c.Interface.ListenPort = 51821 },
+			nil,
+			false,
+		},
+		{
+			"unknown peer key",
+			func(c *Config) { c.Peers[0].Unknown = []KeyValue{{"H1", "1"}} },
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := ParseConfig(strings.NewReader(testPiVPNConfig), "wg0")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			new := old.Clone()
+			tt.edit(new)
+			updates, ok := NewPeerUpdates(Diff(old, new), new)
+			if ok != tt.wantOk {
+				t.Fatalf("NewPeerUpdates() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if got := updates.WgSetCommands("wg0"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WgSetCommands() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/netip"
+	"slices"
 	"strings"
 
 	"golang.org/x/crypto/curve25519"
@@ -36,6 +37,9 @@ type Config struct {
 	Name      string    `msg:"name"`
 	Interface Interface `msg:"interface"`
 	Peers     []Peer    `msg:"peers"`
+
+	// layout is the original text of the parsed file, if any. See Config.Export.
+	layout *section `msg:"-"`
 }
 
 type Interface struct {
@@ -45,11 +49,19 @@ type Interface struct {
 	MTU        uint16         `msg:"mtu"`
 	DNS        []netip.Addr   `msg:"dns,omitempty"`
 	DNSSearch  []string       `msg:"dns_search,omitempty"`
-	PreUp      string         `msg:"pre_up,omitempty"`
-	PostUp     string         `msg:"post_up,omitempty"`
-	PreDown    string         `msg:"pre_down,omitempty"`
-	PostDown   string         `msg:"post_down,omitempty"`
-	Table      string         `msg:"table,omitempty"`
+
+	// The hooks were single strings under pre_up etc., older versions skip these lists instead of failing to decode.
+	PreUp    []string `msg:"pre_ups,omitempty"`
+	PostUp   []string `msg:"post_ups,omitempty"`
+	PreDown  []string `msg:"pre_downs,omitempty"`
+	PostDown []string `msg:"post_downs,omitempty"`
+
+	Table      string `msg:"table,omitempty"`
+	FwMark     uint32 `msg:"fwmark,omitempty"`
+	SaveConfig bool   `msg:"save_config,omitempty"`
+
+	// Unknown holds the keys that are not understood by this package, in file order.
+	Unknown []KeyValue `msg:"unknown,omitempty"`
 }
 
 type Peer struct {
@@ -61,6 +73,17 @@ type Peer struct {
 	AllowedIPs          []netip.Prefix `msg:"ips"`
 	Endpoint            Endpoint       `msg:"endpoint,omitempty"`
 	PersistentKeepalive uint16         `msg:"keepalive,omitempty"`
+
+	// Unknown holds the keys that are not understood by this package, in file order.
+	Unknown []KeyValue `msg:"unknown,omitempty"`
+
+	// layout is the original text of the parsed peer, if any. See Config.Export.
+	layout *section `msg:"-"`
+}
+
+type KeyValue struct {
+	Key   string `msg:"key"`
+	Value string `msg:"value"`
 }
 
 func (e *Endpoint) String() string {
@@ -155,6 +178,25 @@ func (c *Config) DeduplicateNetworkEntries() {
 	}
 }
 
+// Clone returns a deep copy of the configuration.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Interface.Addresses = slices.Clone(c.Interface.Addresses)
+	clone.Interface.DNS = slices.Clone(c.Interface.DNS)
+	clone.Interface.DNSSearch = slices.Clone(c.Interface.DNSSearch)
+	clone.Interface.PreUp = slices.Clone(c.Interface.PreUp)
+	clone.Interface.PostUp = slices.Clone(c.Interface.PostUp)
+	clone.Interface.PreDown = slices.Clone(c.Interface.PreDown)
+	clone.Interface.PostDown = slices.Clone(c.Interface.PostDown)
+	clone.Interface.Unknown = slices.Clone(c.Interface.Unknown)
+	clone.Peers = slices.Clone(c.Peers)
+	for i := range clone.Peers {
+		clone.Peers[i].AllowedIPs = slices.Clone(c.Peers[i].AllowedIPs)
+		clone.Peers[i].Unknown = slices.Clone(c.Peers[i].Unknown)
+	}
+	return &clone
+}
+
 func (c *Config) Redact() {
 	c.Interface.PrivateKey = Key{}
 	for i := range c.Peers {
@@ -0,0 +1,217 @@
+package wireguard
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (f FieldChange) String() string {
+	return fmt.Sprintf("%s %q -> %q", f.Field, f.Old, f.New)
+}
+
+type PeerChangeType int
+
+const (
+	PeerModified PeerChangeType = iota
+	PeerAdded
+	PeerRemoved
+)
+
+func (t PeerChangeType) String() string {
+	switch t {
+	case PeerAdded:
+		return "added"
+	case PeerRemoved:
+		return "removed"
+	default:
+		return "modified"
+	}
+}
+
+type PeerToggle int
+
+const (
+	NotToggled PeerToggle = iota
+	PeerEnabled
+	PeerDisabled
+)
+
+type PeerChange struct {
+	Type PeerChangeType
+	// Name and PublicKey identify the peer, they are the new values unless the peer was removed.
+	Name      string
+	PublicKey Key
+
+	Toggle PeerToggle
+	Fields []FieldChange
+}
+
+func (p PeerChange) String() string {
+	name := p.Name
+	if name == "" {
+		name = p.PublicKey.String()
+	}
+
+	parts := make([]string, 0, len(p.Fields)+1)
+	switch p.Toggle {
+	case PeerEnabled:
+		parts = append(parts, "enabled")
+	case PeerDisabled:
+		parts = append(parts, "disabled")
+	}
+	if p.Type != PeerModified || len(p.Fields) == 0 {
+		parts = append([]string{p.Type.String()}, parts...)
+	}
+	for _, f := range p.Fields {
+		parts = append(parts, f.String())
+	}
+
+	return fmt.Sprintf("peer %s: %s", name, strings.Join(parts, ", "))
+}
+
+// ConfigDiff is the set of changes between two configurations, as returned by Diff.
+type ConfigDiff struct {
+	Interface []FieldChange
+	Peers     []PeerChange
+}
+
+func (d *ConfigDiff) IsEmpty() bool {
+	return len(d.Interface) == 0 && len(d.Peers) == 0
+}
+
+// Lines returns a human-readable description of every change.
+func (d *ConfigDiff) Lines() []string {
+	lines := make([]string, 0, len(d.Interface)+len(d.Peers))
+	for _, f := range d.Interface {
+		lines = append(lines, "interface: "+f.String())
+	}
+	for _, p := range d.Peers {
+		lines = append(lines, p.String())
+	}
+	return lines
+}
+
+func (d *ConfigDiff) String() string {
+	return strings.Join(d.Lines(), "\n")
+}
+
+func diffFields(old, new []field) []FieldChange {
+	oldValues, newValues := groupFields(old), groupFields(new)
+
+	var keys []string
+	names := make(map[string]string)
+	for _, f := range slices.Concat(old, new) {
+		key := strings.ToLower(f.key)
+		if _, ok := names[key]; !ok {
+			keys = append(keys, key)
+			names[key] = f.key
+		}
+	}
+
+	var changes []FieldChange
+	for _, key := range keys {
+		if slices.Equal(oldValues[key], newValues[key]) {
+			continue
+		}
+		change := FieldChange{
+			Field: names[key],
+			Old:   strings.Join(oldValues[key], "; "),
+			New:   strings.Join(newValues[key], "; "),
+		}
+		if key == "privatekey" || key == "presharedkey" {
+			if change.Old != "" {
+				change.Old = redacted
+			}
+			if change.New != "" {
+				change.New = redacted
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func diffPeer(old, new *Peer) PeerChange {
+	change := PeerChange{
+		Type:      PeerModified,
+		Name:      new.Name,
+		PublicKey: new.PublicKey,
+		Fields:    diffFields(old.fields(), new.fields()),
+	}
+	if old.Name != new.Name {
+		change.Fields = append([]FieldChange{{"Name", old.Name, new.Name}}, change.Fields...)
+	}
+	if old.Disabled && !new.Disabled {
+		change.Toggle = PeerEnabled
+	} else if !old.Disabled && new.Disabled {
+		change.Toggle = PeerDisabled
+	}
+	return change
+}
+
+// Diff returns the changes needed to go from the old configuration to the new one.
+//
+// Peers are matched by name, then by public key for the unnamed or renamed ones.
+// The values of private and preshared keys are redacted.
+func Diff(old, new *Config) *ConfigDiff {
+	diff := &ConfigDiff{
+		Interface: diffFields(old.Interface.fields(), new.Interface.fields()),
+	}
+
+	matches := make([]int, len(new.Peers))
+	matched := make([]bool, len(old.Peers))
+	for i, peer := range new.Peers {
+		matches[i] = -1
+		if peer.Name == "" {
+			continue
+		}
+		for j, oldPeer := range old.Peers {
+			if !matched[j] && oldPeer.Name == peer.Name {
+				matches[i], matched[j] = j, true
+				break
+			}
+		}
+	}
+	for i, peer := range new.Peers {
+		if matches[i] >= 0 {
+			continue
+		}
+		for j, oldPeer := range old.Peers {
+			if !matched[j] && oldPeer.PublicKey == peer.PublicKey {
+				matches[i], matched[j] = j, true
+				break
+			}
+		}
+	}
+
+	for i, peer := range new.Peers {
+		if matches[i] < 0 {
+			change := PeerChange{Type: PeerAdded, Name: peer.Name, PublicKey: peer.PublicKey}
+			if peer.Disabled {
+				change.Toggle = PeerDisabled
+			}
+			diff.Peers = append(diff.Peers, change)
+			continue
+		}
+		change := diffPeer(&old.Peers[matches[i]], &peer)
+		if change.Toggle != NotToggled || len(change.Fields) > 0 {
+			diff.Peers = append(diff.Peers, change)
+		}
+	}
+	for j, peer := range old.Peers {
+		if !matched[j] {
+			diff.Peers = append(diff.Peers, PeerChange{Type: PeerRemoved, Name: peer.Name, PublicKey: peer.PublicKey})
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,88 @@
+package wireguard
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	peerKey1, _ := ParseKeyBase64(testPeerKey1)
+	peerKey2, _ := ParseKeyBase64(testPeerKey2)
+	peerKey3, _ := ParseKeyBase64(testPeerKey3)
+
+	tests := []struct {
+		name string
+		edit func(*Config)
+		want *ConfigDiff
+	}{
+		{
+			"no changes",
+			func(c *Config) {},
+			&ConfigDiff{},
+		},
+		{
+			"interface fields",
+			func(c *Config) {
+				c.Interface.ListenPort = 51821
+				c.Interface.PrivateKey = *peerKey3
+			},
+			&ConfigDiff{
+				Interface: []FieldChange{
+					{"PrivateKey", redacted, redacted},
+					{"ListenPort", "51820", "51821"},
+				},
+			},
+		},
+		{
+			"toggles",
+			func(c *Config) {
+				c.Peers[0].Disabled = true
+				c.Peers[1].Disabled = false
+			},
+			&ConfigDiff{
+				Peers: []PeerChange{
+					{Type: PeerModified, Name: "phone", PublicKey: *peerKey1, Toggle: PeerDisabled},
+					{Type: PeerModified, Name: "laptop", PublicKey: *peerKey2, Toggle: PeerEnabled},
+				},
+			},
+		},
+		{
+			"added, removed and renamed",
+			func(c *Config) {
+				c.Peers[0].Name = "phone2"
+				c.Peers[0].AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.6.0.5/32")}
+				c.Peers[1] = Peer{Name: "tablet", PublicKey: *peerKey3}
+			},
+			&ConfigDiff{
+				Peers: []PeerChange{
+					{
+						Type:      PeerModified,
+						Name:      "phone2",
+						PublicKey: *peerKey1,
+						Fields: []FieldChange{
+							{"Name", "phone", "phone2"},
+							{"AllowedIPs", "10.6.0.2/32", "10.6.0.5/32"},
+						},
+					},
+					{Type: PeerAdded, Name: "tablet", PublicKey: *peerKey3},
+					{Type: PeerRemoved, Name: "laptop", PublicKey: *peerKey2},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := ParseConfig(strings.NewReader(testPiVPNConfig), "wg0")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			new := old.Clone()
+			tt.edit(new)
+			if got := Diff(old, new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,122 +2,162 @@ package wireguard
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-func (p *Peer) Export() string {
-	var builder strings.Builder
+func joinPrefixes[T fmt.Stringer](values []T) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = v.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+func (i *Interface) fields() []field {
+	fields := []field{{"PrivateKey", i.PrivateKey.String()}}
+
+	if i.ListenPort > 0 {
+		fields = append(fields, field{"ListenPort", strconv.Itoa(int(i.ListenPort))})
+	}
+
+	if len(i.Addresses) > 0 {
+		fields = append(fields, field{"Address", joinPrefixes(i.Addresses)})
+	}
 
-	insertDisabledPrefix := func() func() {
-		if p.Disabled {
-			return func() {
-				builder.WriteString("#[disabled] ")
-			}
+	if len(i.DNS)+len(i.DNSSearch) > 0 {
+		addrStrings := make([]string, 0, len(i.DNS)+len(i.DNSSearch))
+		for _, address := range i.DNS {
+			addrStrings = append(addrStrings, address.String())
 		}
-		return func() {}
-	}()
+		addrStrings = append(addrStrings, i.DNSSearch...)
+		fields = append(fields, field{"DNS", strings.Join(addrStrings, ", ")})
+	}
 
-	if p.Name != "" {
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "### begin %s ###\n", p.Name)
+	if i.MTU > 0 {
+		fields = append(fields, field{"MTU", strconv.Itoa(int(i.MTU))})
 	}
 
-	insertDisabledPrefix()
-	builder.WriteString("[Peer]\n")
+	for _, cmd := range i.PreUp {
+		fields = append(fields, field{"PreUp", cmd})
+	}
+	for _, cmd := range i.PostUp {
+		fields = append(fields, field{"PostUp", cmd})
+	}
+	for _, cmd := range i.PreDown {
+		fields = append(fields, field{"PreDown", cmd})
+	}
+	for _, cmd := range i.PostDown {
+		fields = append(fields, field{"PostDown", cmd})
+	}
+	if i.Table != "" {
+		fields = append(fields, field{"Table", i.Table})
+	}
+	if i.FwMark > 0 {
+		fields = append(fields, field{"FwMark", strconv.FormatUint(uint64(i.FwMark), 10)})
+	}
+	if i.SaveConfig {
+		fields = append(fields, field{"SaveConfig", "true"})
+	}
+
+	for _, kv := range i.Unknown {
+		fields = append(fields, field{kv.Key, kv.Value})
+	}
+
+	return fields
+}
 
-	insertDisabledPrefix()
-	_, _ = fmt.Fprintf(&builder, "PublicKey = %s\n", p.PublicKey.String())
+func (p *Peer) fields() []field {
+	fields := []field{{"PublicKey", p.PublicKey.String()}}
 
 	if !p.PresharedKey.IsZero() {
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "PresharedKey = %s\n", p.PresharedKey.String())
+		fields = append(fields, field{"PresharedKey", p.PresharedKey.String()})
 	}
 
 	if len(p.AllowedIPs) > 0 {
-		addrStrings := make([]string, len(p.AllowedIPs))
-		for i, address := range p.AllowedIPs {
-			addrStrings[i] = address.String()
-		}
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "AllowedIPs = %s\n", strings.Join(addrStrings[:], ", "))
+		fields = append(fields, field{"AllowedIPs", joinPrefixes(p.AllowedIPs)})
 	}
 
 	if !p.Endpoint.IsEmpty() {
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "Endpoint = %s\n", p.Endpoint.String())
+		fields = append(fields, field{"Endpoint", p.Endpoint.String()})
 	}
 
 	if p.PersistentKeepalive > 0 {
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		fields = append(fields, field{"PersistentKeepalive", strconv.Itoa(int(p.PersistentKeepalive))})
 	}
 
-	if p.Name != "" {
-		insertDisabledPrefix()
-		_, _ = fmt.Fprintf(&builder, "### end %s ###", p.Name)
+	for _, kv := range p.Unknown {
+		fields = append(fields, field{kv.Key, kv.Value})
 	}
-	return builder.String()
-}
 
-func (p *Peer) MarshalText() ([]byte, error) {
-	return []byte(p.Export()), nil
+	return fields
 }
 
-func (c *Config) Export() string {
-	var builder strings.Builder
-
-	builder.WriteString("[Interface]\n")
+// Export returns the peer in the wg-quick format.
+//
+// If the peer was parsed from a file, its original text is kept except for the values that changed since.
+func (p *Peer) Export() string {
+	if p.layout != nil {
+		return strings.Join(p.layout.render(p.fields(), p.Name, p.Disabled), "\n")
+	}
 
-	_, _ = fmt.Fprintf(&builder, "PrivateKey = %s\n", c.Interface.PrivateKey.String())
+	var builder strings.Builder
 
-	if c.Interface.ListenPort > 0 {
-		_, _ = fmt.Fprintf(&builder, "ListenPort = %d\n", c.Interface.ListenPort)
+	prefix := ""
+	if p.Disabled {
+		prefix = disabledPrefix
 	}
 
-	if len(c.Interface.Addresses) > 0 {
-		addrStrings := make([]string, len(c.Interface.Addresses))
-		for i, address := range c.Interface.Addresses {
-			addrStrings[i] = address.String()
-		}
-		_, _ = fmt.Fprintf(&builder, "Address = %s\n", strings.Join(addrStrings[:], ", "))
+	if p.Name != "" {
+		_, _ = fmt.Fprintf(&builder, "%s### begin %s ###\n", prefix, p.Name)
 	}
 
-	if len(c.Interface.DNS)+len(c.Interface.DNSSearch) > 0 {
-		addrStrings := make([]string, 0, len(c.Interface.DNS)+len(c.Interface.DNSSearch))
-		for _, address := range c.Interface.DNS {
-			addrStrings = append(addrStrings, address.String())
-		}
-		addrStrings = append(addrStrings, c.Interface.DNSSearch...)
-		_, _ = fmt.Fprintf(&builder, "DNS = %s\n", strings.Join(addrStrings[:], ", "))
-	}
+	builder.WriteString(prefix)
+	builder.WriteString("[Peer]\n")
 
-	if c.Interface.MTU > 0 {
-		_, _ = fmt.Fprintf(&builder, "MTU = %d\n", c.Interface.MTU)
+	for _, f := range p.fields() {
+		_, _ = fmt.Fprintf(&builder, "%s%s\n", prefix, f.String())
 	}
 
-	if len(c.Interface.PreUp) > 0 {
-		_, _ = fmt.Fprintf(&builder, "PreUp = %s\n", c.Interface.PreUp)
-	}
-	if len(c.Interface.PostUp) > 0 {
-		_, _ = fmt.Fprintf(&builder, "PostUp = %s\n", c.Interface.PostUp)
-	}
-	if len(c.Interface.PreDown) > 0 {
-		_, _ = fmt.Fprintf(&builder, "PreDown = %s\n", c.Interface.PreDown)
-	}
-	if len(c.Interface.PostDown) > 0 {
-		_, _ = fmt.Fprintf(&builder, "PostDown = %s\n", c.Interface.PostDown)
-	}
-	if c.Interface.Table != "" {
-		_, _ = fmt.Fprintf(&builder, "Table = %s\n", c.Interface.Table)
+	if p.Name != "" {
+		_, _ = fmt.Fprintf(&builder, "%s### end %s ###", prefix, p.Name)
 	}
+	return builder.String()
+}
 
-	builder.WriteString("\n")
+func (p *Peer) MarshalText() ([]byte, error) {
+	return []byte(p.Export()), nil
+}
+
+// Export returns the configuration in the wg-quick format.
+//
+// If the configuration was parsed from a file, exporting it without changes returns the original text.
+// Otherwise, only the lines of the changed values and peers are rewritten.
+func (c *Config) Export() string {
+	var builder strings.Builder
+
+	if c.layout != nil {
+		for _, line := range c.layout.render(c.Interface.fields(), "", false) {
+			builder.WriteString(line)
+			builder.WriteString("\n")
+		}
+	} else {
+		builder.WriteString("[Interface]\n")
+		for _, f := range c.Interface.fields() {
+			builder.WriteString(f.String())
+			builder.WriteString("\n")
+		}
+		builder.WriteString("\n")
+	}
 
 	for _, peer := range c.Peers {
 		builder.WriteString(peer.Export())
 		builder.WriteString("\n")
 	}
 
+	if c.layout != nil && !c.layout.finalNewline {
+		return strings.TrimSuffix(builder.String(), "\n")
+	}
 	return builder.String()
 }
 
@@ -0,0 +1,150 @@
+package wireguard
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const disabledPrefix = "#[disabled] "
+
+type lineKind int
+
+const (
+	lineOther lineKind = iota // blank lines and comments
+	lineKey
+	lineSection
+	lineBegin
+	lineEnd
+)
+
+// rawLine is a single line of a wg-quick file, as it was read.
+type rawLine struct {
+	num    int    // line number, starting at 1
+	prefix string // the `#[disabled] ` marker of a disabled peer, if any
+	text   string // the line, without the prefix
+	kind   lineKind
+	key    string // the lower-cased key or section header
+	name   string // the peer name of begin and end markers
+}
+
+// field is a key = value line, as it would be exported.
+type field struct {
+	key   string
+	value string
+}
+
+func (f field) String() string {
+	return fmt.Sprintf("%s = %s", f.key, f.value)
+}
+
+func groupFields(fields []field) map[string][]string {
+	m := make(map[string][]string, len(fields))
+	for _, f := range fields {
+		key := strings.ToLower(f.key)
+		m[key] = append(m[key], f.value)
+	}
+	return m
+}
+
+// section is the original text of the interface or of a peer, along with the values it held when it was parsed.
+//
+// The interface section also holds the lines preceding it.
+type section struct {
+	lines  []rawLine
+	fields []field
+
+	// name and disabled are the peer's state when parsed
+	name     string
+	disabled bool
+
+	// finalNewline is set on the interface section if the file ended with a newline
+	finalNewline bool
+}
+
+func (s *section) header() int {
+	for i, l := range s.lines {
+		if l.kind == lineSection || l.kind == lineBegin {
+			return i
+		}
+	}
+	return -1
+}
+
+// render returns the lines of the section updated with the current values.
+//
+// Lines whose key still holds the same values are kept verbatim, along with comments and blank lines.
+// Changed keys are rewritten in place of their first occurrence and new keys are added after the last key of the section.
+func (s *section) render(cur []field, name string, disabled bool) []string {
+	orig, now := groupFields(s.fields), groupFields(cur)
+
+	header, last := s.header(), s.header()
+	present := make(map[string]bool)
+	for i, l := range s.lines {
+		switch l.kind {
+		case lineKey:
+			present[l.key] = true
+			last = i
+		case lineSection:
+			last = i
+		}
+	}
+
+	newPrefix := ""
+	if disabled {
+		newPrefix = disabledPrefix
+	}
+	prefix := func(i int, l rawLine) string {
+		if disabled == s.disabled {
+			return l.prefix
+		}
+		if disabled && i >= header && strings.TrimSpace(l.text) != "" {
+			return disabledPrefix
+		}
+		return ""
+	}
+
+	out := make([]string, 0, len(s.lines))
+	written := make(map[string]bool)
+	for i, l := range s.lines {
+		if i == header && s.name == "" && name != "" {
+			out = append(out, fmt.Sprintf("%s### begin %s ###", newPrefix, name))
+		}
+
+		switch {
+		case l.kind == lineKey && !slices.Equal(orig[l.key], now[l.key]):
+			if written[l.key] {
+				break
+			}
+			written[l.key] = true
+			for _, f := range cur {
+				if strings.ToLower(f.key) == l.key {
+					out = append(out, prefix(i, l)+f.String())
+				}
+			}
+		case l.kind == lineBegin && name != s.name:
+			if name != "" {
+				out = append(out, fmt.Sprintf("%s### begin %s ###", prefix(i, l), name))
+			}
+		case l.kind == lineEnd && name != s.name:
+			if name != "" {
+				out = append(out, fmt.Sprintf("%s### end %s ###", prefix(i, l), name))
+			}
+		default:
+			out = append(out, prefix(i, l)+l.text)
+		}
+
+		if i == last {
+			for _, f := range cur {
+				if !present[strings.ToLower(f.key)] {
+					out = append(out, newPrefix+f.String())
+				}
+			}
+			if s.name == "" && name != "" {
+				out = append(out, fmt.Sprintf("%s### end %s ###", newPrefix, name))
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,162 @@
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MobileConfigIdentifier prefixes the identifiers of the exported Apple configuration profiles.
+const MobileConfigIdentifier = "ca.magnax.vpnmanager"
+
+// mobileConfigUUIDNamespace namespaces the payload UUIDs of the exported Apple configuration profiles.
+var mobileConfigUUIDNamespace = uuid.MustParse("2d8c3e0e-5b1f-4f6a-8c7a-7f0e2b9c4d61")
+
+type MobileConfigPlatform string
+
+const (
+	MobileConfigIOS   MobileConfigPlatform = "ios"
+	MobileConfigMacOS MobileConfigPlatform = "macos"
+)
+
+// MobileConfigOptions are the options of Config.ExportMobileConfig.
+type MobileConfigOptions struct {
+	// Platform selects the WireGuard app the profile is for, it defaults to MobileConfigIOS.
+	Platform MobileConfigPlatform
+	// OnDemand connects the tunnel whenever the device has network access, except on the TrustedSSIDs.
+	OnDemand     bool
+	TrustedSSIDs []string
+}
+
+type plistWriter struct {
+	strings.Builder
+	depth int
+}
+
+func (p *plistWriter) line(format string, args ...any) {
+	p.WriteString(strings.Repeat("\t", p.depth))
+	_, _ = fmt.Fprintf(p, format, args...)
+	p.WriteString("\n")
+}
+
+func (p *plistWriter) open(tag string) {
+	p.line("<%s>", tag)
+	p.depth++
+}
+
+func (p *plistWriter) close(tag string) {
+	p.depth--
+	p.line("</%s>", tag)
+}
+
+func (p *plistWriter) key(key string) {
+	p.line("<key>%s</key>", plistEscape(key))
+}
+
+func (p *plistWriter) string(key, value string) {
+	p.key(key)
+	p.line("<string>%s</string>", plistEscape(value))
+}
+
+func (p *plistWriter) integer(key string, value int) {
+	p.key(key)
+	p.line("<integer>%d</integer>", value)
+}
+
+func (p *plistWriter) bool(key string, value bool) {
+	p.key(key)
+	if value {
+		p.line("<true/>")
+	} else {
+		p.line("<false/>")
+	}
+}
+
+// plistEscaper escapes the text of the plist, keeping the newlines of the wg-quick configuration readable.
+var plistEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func plistEscape(s string) string {
+	return plistEscaper.Replace(s)
+}
+
+// ExportMobileConfig returns the configuration as an Apple configuration profile (.mobileconfig) for the WireGuard app
+// on iOS or macOS, to be installed by hand or pushed by an MDM.
+//
+// The payload UUIDs are derived from the tunnel and configuration names, so installing the profile of a client again
+// replaces it.
+func (c *Config) ExportMobileConfig(tunnel string, opts MobileConfigOptions) string {
+	platform := opts.Platform
+	if platform == "" {
+		platform = MobileConfigIOS
+	}
+	identifier := fmt.Sprintf("%s.%s.%s", MobileConfigIdentifier, tunnel, c.Name)
+	profileUUID := uuid.NewSHA1(mobileConfigUUIDNamespace, []byte(tunnel+"/"+c.Name))
+	vpnUUID := uuid.NewSHA1(profileUUID, []byte("vpn"))
+
+	remote := ""
+	for _, peer := range c.Peers {
+		if !peer.Endpoint.IsEmpty() {
+			remote = peer.Endpoint.String()
+			break
+		}
+	}
+
+	var p plistWriter
+	p.line(`<?xml version="1.0" encoding="UTF-8"?>`)
+	p.line(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">`)
+	p.line(`<plist version="1.0">`)
+	p.open("dict")
+	p.string("PayloadDisplayName", fmt.Sprintf("WireGuard %s (%s)", tunnel, c.Name))
+	p.string("PayloadType", "Configuration")
+	p.integer("PayloadVersion", 1)
+	p.string("PayloadIdentifier", identifier)
+	p.string("PayloadUUID", strings.ToUpper(profileUUID.String()))
+	p.key("PayloadContent")
+	p.open("array")
+	p.open("dict")
+	p.string("PayloadDisplayName", "VPN")
+	p.string("PayloadType", "com.apple.vpn.managed")
+	p.integer("PayloadVersion", 1)
+	p.string("PayloadIdentifier", identifier+".vpn")
+	p.string("PayloadUUID", strings.ToUpper(vpnUUID.String()))
+	p.string("UserDefinedName", tunnel)
+	p.string("VPNType", "VPN")
+	p.string("VPNSubType", "com.wireguard."+string(platform))
+	p.key("VendorConfig")
+	p.open("dict")
+	p.string("WgQuickConfig", c.Export())
+	p.close("dict")
+	p.key("VPN")
+	p.open("dict")
+	p.string("RemoteAddress", remote)
+	p.string("AuthenticationMethod", "Password")
+	p.close("dict")
+	if opts.OnDemand {
+		p.bool("OnDemandEnabled", true)
+		p.key("OnDemandRules")
+		p.open("array")
+		if len(opts.TrustedSSIDs) > 0 {
+			p.open("dict")
+			p.string("Action", "Disconnect")
+			p.string("InterfaceTypeMatch", "WiFi")
+			p.key("SSIDMatch")
+			p.open("array")
+			for _, ssid := range opts.TrustedSSIDs {
+				p.line("<string>%s</string>", plistEscape(ssid))
+			}
+			p.close("array")
+			p.close("dict")
+		}
+		p.open("dict")
+		p.string("Action", "Connect")
+		p.close("dict")
+		p.close("array")
+	}
+	p.close("dict")
+	p.close("array")
+	p.close("dict")
+	p.line("</plist>")
+
+	return p.String()
+}
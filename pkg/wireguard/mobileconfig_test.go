@@ -0,0 +1,81 @@
+package wireguard
+
+import (
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestConfigExportMobileConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     MobileConfigOptions
+		contains []string
+		excludes []string
+	}{
+		{
+			"ios",
+			MobileConfigOptions{},
+			[]string{
+				"<string>com.wireguard.ios</string>",
+				"<key>PayloadIdentifier</key>\n\t<string>ca.magnax.vpnmanager.wg0.phone</string>",
+				"<key>RemoteAddress</key>\n\t\t\t\t<string>vpn.example.com:51820</string>",
+				"PrivateKey = " + testServerKey,
+			},
+			[]string{"OnDemandEnabled"},
+		},
+		{
+			"macos on demand",
+			MobileConfigOptions{Platform: MobileConfigMacOS, OnDemand: true, TrustedSSIDs: []string{"Home & Co"}},
+			[]string{
+				"<string>com.wireguard.macos</string>",
+				"<key>OnDemandEnabled</key>\n\t\t\t<true/>",
+				"<string>Disconnect</string>",
+				"<string>Home &amp; Co</string>",
+				"<string>Connect</string>",
+			},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(testClientConfig), "phone")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			got := conf.ExportMobileConfig("wg0", tt.opts)
+
+			decoder := xml.NewDecoder(strings.NewReader(got))
+			for {
+				if _, err := decoder.Token(); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("ExportMobileConfig() is not valid XML: %v", err)
+				}
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(got, s) {
+					t.Errorf("ExportMobileConfig() = %s, want it to contain %q", got, s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(got, s) {
+					t.Errorf("ExportMobileConfig() = %s, want it not to contain %q", got, s)
+				}
+			}
+
+			uuids := regexp.MustCompile(`[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}`).FindAllString(got, -1)
+			if len(uuids) != 2 || uuids[0] == uuids[1] {
+				t.Errorf("ExportMobileConfig() payload UUIDs = %v, want 2 distinct", uuids)
+			}
+			if again := conf.ExportMobileConfig("wg0", tt.opts); again != got {
+				t.Errorf("ExportMobileConfig() is not stable")
+			}
+			if other := conf.ExportMobileConfig("wg1", tt.opts); strings.Contains(other, uuids[0]) {
+				t.Errorf("ExportMobileConfig() payload UUID %s is shared between tunnels", uuids[0])
+			}
+		})
+	}
+}
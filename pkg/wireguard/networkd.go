@@ -0,0 +1,184 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultNetworkdTable is the routing table and firewall mark used to route everything through the tunnel, like
+// wg-quick does when a peer allows a default route and Table is unset.
+const DefaultNetworkdTable = 51820
+
+var (
+	ErrInvalidInterfaceName = errors.New("invalid interface name")
+
+	// interfaceNameRE are the names wg-quick accepts, Linux limits them to IFNAMSIZ-1 bytes.
+	interfaceNameRE = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+)
+
+// ValidateInterfaceName returns an error if name can't name the interface of an exported configuration.
+func ValidateInterfaceName(name string) error {
+	if !interfaceNameRE.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("%w %q: it must have 1 to 15 letters, digits or _=+.-", ErrInvalidInterfaceName, name)
+	}
+	return nil
+}
+
+type unitWriter struct {
+	strings.Builder
+}
+
+func (u *unitWriter) section(name string) {
+	if u.Len() > 0 {
+		u.WriteString("\n")
+	}
+	_, _ = fmt.Fprintf(u, "[%s]\n", name)
+}
+
+func (u *unitWriter) set(key string, value any) {
+	_, _ = fmt.Fprintf(u, "%s=%v\n", key, value)
+}
+
+// hasDefaultRoute returns whether a peer allows 0.0.0.0/0 or ::/0.
+func (c *Config) hasDefaultRoute() bool {
+	for _, peer := range c.Peers {
+		for _, ip := range peer.AllowedIPs {
+			if ip.Bits() == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// networkdTable returns the table in which default routes are added, and whether a fwmark rule is needed for them.
+func (c *Config) networkdTable() (string, bool) {
+	switch c.Interface.Table {
+	case "", "auto":
+		if c.hasDefaultRoute() {
+			return strconv.Itoa(DefaultNetworkdTable), true
+		}
+		return "", false
+	default:
+		return c.Interface.Table, false
+	}
+}
+
+// ExportNetdev returns the configuration as a systemd-networkd .netdev unit creating the iface interface.
+//
+// As networkd reads the private key from the unit, it must only be readable by root and the systemd-network group.
+func (c *Config) ExportNetdev(iface string) string {
+	var u unitWriter
+
+	u.section("NetDev")
+	u.set("Name", iface)
+	u.set("Kind", "wireguard")
+	if c.Interface.MTU > 0 {
+		u.set("MTUBytes", c.Interface.MTU)
+	}
+
+	u.section("WireGuard")
+	u.set("PrivateKey", c.Interface.PrivateKey.String())
+	if c.Interface.ListenPort > 0 {
+		u.set("ListenPort", c.Interface.ListenPort)
+	}
+	if c.Interface.FwMark > 0 {
+		u.set("FirewallMark", c.Interface.FwMark)
+	} else if _, rule := c.networkdTable(); rule {
+		u.set("FirewallMark", DefaultNetworkdTable)
+	}
+
+	for _, peer := range c.Peers {
+		if peer.Disabled {
+			continue
+		}
+		u.section("WireGuardPeer")
+		u.set("PublicKey", peer.PublicKey.String())
+		if !peer.PresharedKey.IsZero() {
+			u.set("PresharedKey", peer.PresharedKey.String())
+		}
+		for _, ip := range peer.AllowedIPs {
+			u.set("AllowedIPs", ip.String())
+		}
+		if !peer.Endpoint.IsEmpty() {
+			u.set("Endpoint", peer.Endpoint.String())
+		}
+		if peer.PersistentKeepalive > 0 {
+			u.set("PersistentKeepalive", peer.PersistentKeepalive)
+		}
+	}
+
+	return u.String()
+}
+
+// ExportNetwork returns the configuration as a systemd-networkd .network unit for the iface interface.
+//
+// The routes are derived from the allowed IPs of the peers, the same way wg-quick adds them: default routes go to a
+// dedicated table selected by a fwmark rule, unless Table is set. The wg-quick hooks have no networkd equivalent and
+// are not exported.
+func (c *Config) ExportNetwork(iface string) string {
+	var u unitWriter
+
+	u.section("Match")
+	u.set("Name", iface)
+
+	u.section("Network")
+	for _, address := range c.Interface.Addresses {
+		u.set("Address", address.String())
+	}
+	for _, dns := range c.Interface.DNS {
+		u.set("DNS", dns.String())
+	}
+	if len(c.Interface.DNS) > 0 {
+		// resolve every name through the tunnel, like wg-quick does with resolvconf
+		domains := append([]string{"~."}, c.Interface.DNSSearch...)
+		u.set("Domains", strings.Join(domains, " "))
+	} else if len(c.Interface.DNSSearch) > 0 {
+		u.set("Domains", strings.Join(c.Interface.DNSSearch, " "))
+	}
+
+	if c.Interface.Table == "off" {
+		return u.String()
+	}
+
+	table, rule := c.networkdTable()
+	seen := make(map[netip.Prefix]bool)
+	for _, peer := range c.Peers {
+		if peer.Disabled {
+			continue
+		}
+		for _, ip := range peer.AllowedIPs {
+			ip = ip.Masked()
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+
+			u.section("Route")
+			u.set("Destination", ip.String())
+			if table != "" && (ip.Bits() == 0 || !rule) {
+				u.set("Table", table)
+			}
+		}
+	}
+
+	if rule {
+		mark := strconv.Itoa(DefaultNetworkdTable)
+		if c.Interface.FwMark > 0 {
+			mark = strconv.FormatUint(uint64(c.Interface.FwMark), 10)
+		}
+		for _, family := range []string{"ipv4", "ipv6"} {
+			u.section("RoutingPolicyRule")
+			u.set("Family", family)
+			u.set("FirewallMark", mark)
+			u.set("InvertRule", "yes")
+			u.set("Table", table)
+		}
+	}
+
+	return u.String()
+}
@@ -0,0 +1,176 @@
+package wireguard
+
+import (
+	"strings"
+	"testing"
+)
+
+const testClientConfig = `[Interface]
+PrivateKey = ` + testServerKey + `
+Address = 10.6.0.2/24
+DNS = 10.6.0.1, lan
+MTU = 1420
+
+[Peer]
+PublicKey = ` + testPeerKey1 + `
+PresharedKey = ` + testPSK + `
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/0, ::0/0
+PersistentKeepalive = 25
+`
+
+func TestConfigExportNetworkd(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantNetdev  string
+		wantNetwork string
+	}{
+		{
+			"full tunnel",
+			testClientConfig,
+			`[NetDev]
+Name=wg0
+Kind=wireguard
+MTUBytes=1420
+
+[WireGuard]
+PrivateKey=` + testServerKey + `
+FirewallMark=51820
+
+[WireGuardPeer]
+PublicKey=` + testPeerKey1 + `
+PresharedKey=` + testPSK + `
+AllowedIPs=0.0.0.0/0
+AllowedIPs=::/0
+Endpoint=vpn.example.com:51820
+PersistentKeepalive=25
+`,
+			`[Match]
+Name=wg0
+
+[Network]
+Address=10.6.0.2/24
+DNS=10.6.0.1
+Domains=~. lan
+
+[Route]
+Destination=0.0.0.0/0
+Table=51820
+
+[Route]
+Destination=::/0
+Table=51820
+
+[RoutingPolicyRule]
+Family=ipv4
+FirewallMark=51820
+InvertRule=yes
+Table=51820
+
+[RoutingPolicyRule]
+Family=ipv6
+FirewallMark=51820
+InvertRule=yes
+Table=51820
+`,
+		},
+		{
+			"split tunnel",
+			strings.NewReplacer("AllowedIPs = 0.0.0.0/0, ::0/0", "AllowedIPs = 10.6.0.0/24, 192.168.1.1/24", "DNS = 10.6.0.1, lan\n", "").Replace(testClientConfig),
+			`[NetDev]
+Name=wg0
+Kind=wireguard
+MTUBytes=1420
+
+[WireGuard]
+PrivateKey=` + testServerKey + `
+
+[WireGuardPeer]
+PublicKey=` + testPeerKey1 + `
+PresharedKey=` + testPSK + `
+AllowedIPs=10.6.0.0/24
+AllowedIPs=192.168.1.1/24
+Endpoint=vpn.example.com:51820
+PersistentKeepalive=25
+`,
+			`[Match]
+Name=wg0
+
+[Network]
+Address=10.6.0.2/24
+
+[Route]
+Destination=10.6.0.0/24
+
+[Route]
+Destination=192.168.1.0/24
+`,
+		},
+		{
+			"table off",
+			strings.Replace(testClientConfig, "MTU = 1420", "Table = off", 1),
+			`[NetDev]
+Name=wg0
+Kind=wireguard
+
+[WireGuard]
+PrivateKey=` + testServerKey + `
+
+[WireGuardPeer]
+PublicKey=` + testPeerKey1 + `
+PresharedKey=` + testPSK + `
+AllowedIPs=0.0.0.0/0
+AllowedIPs=::/0
+Endpoint=vpn.example.com:51820
+PersistentKeepalive=25
+`,
+			`[Match]
+Name=wg0
+
+[Network]
+Address=10.6.0.2/24
+DNS=10.6.0.1
+Domains=~. lan
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(tt.input), "client")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if got := conf.ExportNetdev("wg0"); got != tt.wantNetdev {
+				t.Errorf("ExportNetdev() = %q, want %q", got, tt.wantNetdev)
+			}
+			if got := conf.ExportNetwork("wg0"); got != tt.wantNetwork {
+				t.Errorf("ExportNetwork() = %q, want %q", got, tt.wantNetwork)
+			}
+		})
+	}
+}
+
+func TestValidateInterfaceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"wg0", false},
+		{"wg-home.lan_1+=", false},
+		{"0123456789abcde", false},
+		{"0123456789abcdef", true},
+		{"raspberrypi.home.lan", true},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"wg/0", true},
+		{"wg 0", true},
+		{"wg:0", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateInterfaceName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateInterfaceName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package wireguard
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// nmUUIDNamespace namespaces the UUIDs of the exported NetworkManager connections.
+var nmUUIDNamespace = uuid.MustParse("6b0c5ef5-3c38-4c5e-9e57-5d4f3f4c1d8a")
+
+// nmList joins the values in the NetworkManager keyfile list format.
+func nmList[T any](values []T, str func(T) string) string {
+	var builder strings.Builder
+	for _, v := range values {
+		builder.WriteString(str(v))
+		builder.WriteString(";")
+	}
+	return builder.String()
+}
+
+// nmIPSection writes the ipv4 or ipv6 section of the connection, for the addresses and dns servers of the family.
+func (c *Config) nmIPSection(u *unitWriter, family string, is func(netip.Addr) bool, search []string) {
+	u.section(family)
+
+	var addresses []netip.Prefix
+	for _, address := range c.Interface.Addresses {
+		if is(address.Addr()) {
+			addresses = append(addresses, address)
+		}
+	}
+	var dns []netip.Addr
+	for _, addr := range c.Interface.DNS {
+		if is(addr) {
+			dns = append(dns, addr)
+		}
+	}
+
+	if len(addresses) == 0 {
+		u.set("method", "disabled")
+		return
+	}
+	u.set("method", "manual")
+	for i, address := range addresses {
+		u.set("address"+strconv.Itoa(i+1), address.String())
+	}
+	if len(dns) > 0 {
+		u.set("dns", nmList(dns, netip.Addr.String))
+		// resolve every name through the tunnel, like wg-quick does with resolvconf
+		u.set("dns-priority", -50)
+		search = append(search, "~")
+	}
+	if len(search) > 0 {
+		u.set("dns-search", nmList(search, func(s string) string { return s }))
+	}
+	if c.Interface.Table != "" && c.Interface.Table != "auto" && c.Interface.Table != "off" {
+		u.set("route-table", c.Interface.Table)
+	}
+}
+
+// ExportNMConnection returns the configuration as a NetworkManager keyfile (.nmconnection) creating the iface
+// interface.
+//
+// The UUID of the connection is derived from the private key, so importing the file again replaces the connection.
+// As the keyfile holds the private key, it must only be readable by root. The wg-quick hooks have no NetworkManager
+// equivalent and are not exported.
+func (c *Config) ExportNMConnection(iface string, autoconnect bool) string {
+	var u unitWriter
+
+	id := c.Name
+	if id == "" {
+		id = iface
+	}
+
+	u.section("connection")
+	u.set("id", id)
+	u.set("uuid", uuid.NewSHA1(nmUUIDNamespace, c.Interface.PrivateKey.Public()[:]).String())
+	u.set("type", "wireguard")
+	u.set("interface-name", iface)
+	u.set("autoconnect", autoconnect)
+
+	u.section("wireguard")
+	u.set("private-key", c.Interface.PrivateKey.String())
+	if c.Interface.ListenPort > 0 {
+		u.set("listen-port", c.Interface.ListenPort)
+	}
+	if c.Interface.FwMark > 0 {
+		u.set("fwmark", c.Interface.FwMark)
+	}
+	if c.Interface.MTU > 0 {
+		u.set("mtu", c.Interface.MTU)
+	}
+	if c.Interface.Table == "off" {
+		u.set("peer-routes", false)
+	}
+
+	for _, peer := range c.Peers {
+		if peer.Disabled {
+			continue
+		}
+		u.section("wireguard-peer." + peer.PublicKey.String())
+		if !peer.Endpoint.IsEmpty() {
+			u.set("endpoint", peer.Endpoint.String())
+		}
+		if !peer.PresharedKey.IsZero() {
+			u.set("preshared-key", peer.PresharedKey.String())
+			u.set("preshared-key-flags", 0)
+		}
+		if peer.PersistentKeepalive > 0 {
+			u.set("persistent-keepalive", peer.PersistentKeepalive)
+		}
+		u.set("allowed-ips", nmList(peer.AllowedIPs, netip.Prefix.String))
+	}
+
+	// the search domains go with the first family having addresses
+	search4, search6 := c.Interface.DNSSearch, []string(nil)
+	if !c.hasAddress(netip.Addr.Is4) {
+		search4, search6 = nil, c.Interface.DNSSearch
+	}
+	c.nmIPSection(&u, "ipv4", netip.Addr.Is4, search4)
+	c.nmIPSection(&u, "ipv6", netip.Addr.Is6, search6)
+
+	return u.String()
+}
+
+func (c *Config) hasAddress(is func(netip.Addr) bool) bool {
+	for _, address := range c.Interface.Addresses {
+		if is(address.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package wireguard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigExportNMConnection(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(strings.Replace(testClientConfig, "Address = 10.6.0.2/24", "Address = 10.6.0.2/24, fd11:5ee:bad:c0de::2/64", 1)), "phone")
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	got := conf.ExportNMConnection("wg0", true)
+
+	uuidLine := strings.Split(got, "\n")[2]
+	if !strings.HasPrefix(uuidLine, "uuid=") {
+		t.Fatalf("ExportNMConnection() line 3 = %q, want the uuid", uuidLine)
+	}
+	if again := conf.ExportNMConnection("wg0", true); again != got {
+		t.Errorf("ExportNMConnection() is not stable, got %q then %q", got, again)
+	}
+
+	want := `[connection]
+id=phone
+` + uuidLine + `
+type=wireguard
+interface-name=wg0
+autoconnect=true
+
+[wireguard]
+private-key=` + testServerKey + `
+mtu=1420
+
+[wireguard-peer.` + testPeerKey1 + `]
+endpoint=vpn.example.com:51820
+preshared-key=` + testPSK + `
+preshared-key-flags=0
+persistent-keepalive=25
+allowed-ips=0.0.0.0/0;::/0;
+
+[ipv4]
+method=manual
+address1=10.6.0.2/24
+dns=10.6.0.1;
+dns-priority=-50
+dns-search=lan;~;
+
+[ipv6]
+method=manual
+address1=fd11:5ee:bad:c0de::2/64
+`
+	if got != want {
+		t.Errorf("ExportNMConnection() = %q, want %q", got, want)
+	}
+}
@@ -7,13 +7,13 @@ package wireguard
  */
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -39,6 +39,11 @@ func parseIPCidr(s string) (netip.Prefix, error) {
 	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
 
+// ParseEndpoint parses a host:port endpoint, with the IPv6 addresses in brackets.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	return parseEndpoint(s)
+}
+
 func parseEndpoint(s string) (*Endpoint, error) {
 	i := strings.LastIndexByte(s, ':')
 	if i < 0 {
@@ -122,6 +127,28 @@ func parseTable(s string) (string, error) {
 	}
 }
 
+func parseFwMark(s string) (uint32, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, &ParseError{"Invalid fwmark", s}
+	}
+	return uint32(m), nil
+}
+
+func parseSaveConfig(s string) (bool, error) {
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, &ParseError{"Invalid SaveConfig", s}
+	}
+}
+
 func ParseKeyBase64(s string) (*Key, error) {
 	k, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -155,114 +182,293 @@ const (
 	inPeer
 )
 
-func (c *Config) maybeAddPeer(p *Peer) {
-	if p != nil {
-		c.Peers = append(c.Peers, *p)
-	}
-}
-
 var (
-	beginRegex             = regexp.MustCompile(`^## begin ([a-zA-Z0-9.@_-]+) ###\s*$`)
-	beginWithDisabledRegex = regexp.MustCompile(`^(\[disabled] #)?## begin ([a-zA-Z0-9.@_-]+) ###\s*$`)
-	endRegex               = regexp.MustCompile(`^## end ([a-zA-Z0-9.@_-]+) ###\s*$`)
+	beginRegex = regexp.MustCompile(`^## begin ([a-zA-Z0-9.@_-]+) ###\s*$`)
+	endRegex   = regexp.MustCompile(`^## end ([a-zA-Z0-9.@_-]+) ###\s*$`)
 )
 
-func parsePeer(scanner *bufio.Scanner) (*Peer, error) {
-	peer := Peer{}
-	disabled := false
-	seenPeer := false
-	// invariants: line will never be empty on first go
-	for {
-		line := scanner.Text()
-		if disabled {
-			_, line, _ = strings.Cut(line, "[disabled] ")
+func parseLine(num int, raw string) rawLine {
+	l := rawLine{num: num, text: raw}
+
+	if before, after, ok := strings.Cut(raw, "#"); ok && strings.TrimSpace(before) == "" && strings.HasPrefix(after, "[disabled]") {
+		n := len(raw) - len(after) + len("[disabled]")
+		if strings.HasPrefix(raw[n:], " ") {
+			n++
+		}
+		l.prefix, l.text = raw[:n], raw[n:]
+	}
+
+	line, lineAfter, _ := strings.Cut(l.text, "#")
+	line = strings.TrimSpace(line)
+	lineLower := strings.ToLower(line)
+
+	switch {
+	case len(line) == 0:
+		if matches := beginRegex.FindStringSubmatch(lineAfter); matches != nil {
+			l.kind, l.name = lineBegin, matches[1]
+		} else if matches := endRegex.FindStringSubmatch(lineAfter); matches != nil {
+			l.kind, l.name = lineEnd, matches[1]
 		}
-		line, lineAfter, _ := strings.Cut(line, "#")
-		if line == "" && strings.HasPrefix(lineAfter, "[disabled]") {
-			// this can only hit on the first go, as the [disabled] prefix gets removed on subsequent runs
-			disabled = true
-			peer.Disabled = true
-			// reparse the first line while removing the disabled prefix
-			continue
+	case lineLower == "[interface]" || lineLower == "[peer]":
+		l.kind, l.key = lineSection, lineLower
+	default:
+		l.kind = lineKey
+		if key, _, ok := strings.Cut(lineLower, "="); ok {
+			l.key = strings.TrimSpace(key)
 		}
-		line = strings.TrimSpace(line)
-		lineLower := strings.ToLower(line)
+	}
 
-		if matches := beginRegex.FindStringSubmatch(lineAfter); matches != nil && matches[1] != "" {
-			if peer.Name != "" {
-				return nil, &ParseError{"Duplicate begin line", lineAfter}
-			}
-			peer.Name = matches[1]
-		} else if lineLower == "[interface]" {
-			break
-		} else if lineLower == "[peer]" {
-			if seenPeer {
-				break
-			}
-			seenPeer = true
-		} else if endRegex.MatchString(lineAfter) {
-			// exit but don't move the scanner up
+	return l
+}
+
+// keyValue returns the key, with its original case, and the value of a key = value line.
+func (l *rawLine) keyValue() (string, string, error) {
+	line, _, _ := strings.Cut(l.text, "#")
+	line = strings.TrimSpace(line)
+	key, val, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", "", &ParseError{"Server key is missing an equals separator", line}
+	}
+	key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+	if len(val) == 0 {
+		return "", "", &ParseError{"Key must have a value", line}
+	}
+	return key, val, nil
+}
+
+type parser struct {
+	conf  *Config
+	state parserState
+
+	iface         *section
+	sawPrivateKey bool
+
+	peer          *Peer
+	sawPeerHeader bool
+	sawEnd        bool
+}
+
+// current returns the section receiving the lines being parsed.
+func (p *parser) current() *section {
+	if p.peer != nil {
+		return p.peer.layout
+	}
+	return p.iface
+}
+
+// takeComments removes the comments directly preceding a new section from the current one, so they stay with the
+// section they describe.
+func (p *parser) takeComments() []rawLine {
+	s := p.current()
+	i := len(s.lines)
+	for i > 0 {
+		l := s.lines[i-1]
+		if l.kind != lineOther || l.prefix != "" || strings.TrimSpace(l.text) == "" {
 			break
-		} else if len(line) == 0 {
-			// continue
+		}
+		i--
+	}
+	taken := slices.Clone(s.lines[i:])
+	s.lines = s.lines[:i]
+	return taken
+}
+
+func (p *parser) flushPeer() {
+	if p.peer == nil {
+		return
+	}
+	p.peer.layout.fields = p.peer.fields()
+	p.peer.layout.name = p.peer.Name
+	p.peer.layout.disabled = p.peer.Disabled
+	p.conf.Peers = append(p.conf.Peers, *p.peer)
+	p.peer = nil
+}
+
+func (p *parser) startPeer(l rawLine) {
+	comments := p.takeComments()
+	p.flushPeer()
+	p.peer = &Peer{
+		Name:     l.name,
+		Disabled: l.prefix != "",
+		layout:   &section{lines: append(comments, l)},
+	}
+	p.sawPeerHeader = l.kind == lineSection
+	p.sawEnd = false
+	p.state = inPeer
+}
+
+func (p *parser) parse(l rawLine) error {
+	switch l.kind {
+	case lineBegin:
+		p.startPeer(l)
+		return nil
+	case lineEnd:
+		if p.peer == nil {
+			l.kind = lineOther
+		} else {
+			p.sawEnd = true
+		}
+	case lineSection:
+		if l.key == "[interface]" {
+			comments := p.takeComments()
+			p.flushPeer()
+			p.iface.lines = append(p.iface.lines, comments...)
+			p.state = inInterface
+		} else if p.peer != nil && p.peer.Name != "" && !p.sawPeerHeader && !p.sawEnd {
+			// the [Peer] header following a begin marker
+			p.sawPeerHeader = true
 		} else {
-			equals := strings.IndexByte(line, '=')
-			if equals < 0 {
-				return nil, &ParseError{"Server key is missing an equals separator", line}
+			p.startPeer(l)
+			return nil
+		}
+	case lineKey:
+		if p.state == notInSection {
+			// at this point, if we haven't seen a section, it's a malformed file
+			return &ParseError{"line must occur in a section", strings.TrimSpace(l.text)}
+		}
+		key, val, err := l.keyValue()
+		if err != nil {
+			return err
+		}
+		if p.state == inInterface {
+			err = p.parseInterfaceKey(key, val)
+		} else {
+			err = p.parsePeerKey(key, val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s := p.current()
+	s.lines = append(s.lines, l)
+	return nil
+}
+
+func (p *parser) parseInterfaceKey(key, val string) error {
+	iface := &p.conf.Interface
+
+	switch strings.ToLower(key) {
+	case "privatekey":
+		k, err := ParseKeyBase64(val)
+		if err != nil {
+			return err
+		}
+		iface.PrivateKey = *k
+		p.sawPrivateKey = true
+	case "listenport":
+		port, err := parsePort(val)
+		if err != nil {
+			return err
+		}
+		iface.ListenPort = port
+	case "mtu":
+		m, err := parseMTU(val)
+		if err != nil {
+			return err
+		}
+		iface.MTU = m
+	case "address":
+		addresses, err := splitList(val)
+		if err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			a, err := parseIPCidr(address)
+			if err != nil {
+				return err
 			}
-			key, val := strings.TrimSpace(lineLower[:equals]), strings.TrimSpace(line[equals+1:])
-			if len(val) == 0 {
-				return nil, &ParseError{"Key must have a value", line}
+			iface.Addresses = append(iface.Addresses, a)
+		}
+	case "dns":
+		addresses, err := splitList(val)
+		if err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			a, err := netip.ParseAddr(address)
+			if err != nil {
+				iface.DNSSearch = append(iface.DNSSearch, address)
+			} else {
+				iface.DNS = append(iface.DNS, a)
 			}
+		}
+	case "preup":
+		iface.PreUp = append(iface.PreUp, val)
+	case "postup":
+		iface.PostUp = append(iface.PostUp, val)
+	case "predown":
+		iface.PreDown = append(iface.PreDown, val)
+	case "postdown":
+		iface.PostDown = append(iface.PostDown, val)
+	case "table":
+		table, err := parseTable(val)
+		if err != nil {
+			return err
+		}
+		iface.Table = table
+	case "fwmark":
+		mark, err := parseFwMark(val)
+		if err != nil {
+			return err
+		}
+		iface.FwMark = mark
+	case "saveconfig":
+		save, err := parseSaveConfig(val)
+		if err != nil {
+			return err
+		}
+		iface.SaveConfig = save
+	default:
+		iface.Unknown = append(iface.Unknown, KeyValue{key, val})
+	}
+	return nil
+}
+
+func (p *parser) parsePeerKey(key, val string) error {
+	peer := p.peer
 
-			switch key {
-			case "publickey":
-				k, err := ParseKeyBase64(val)
-				if err != nil {
-					return nil, err
-				}
-				peer.PublicKey = *k
-			case "presharedkey":
-				k, err := ParseKeyBase64(val)
-				if err != nil {
-					return nil, err
-				}
-				peer.PresharedKey = *k
-			case "allowedips":
-				addresses, err := splitList(val)
-				if err != nil {
-					return nil, err
-				}
-				for _, address := range addresses {
-					a, err := parseIPCidr(address)
-					if err != nil {
-						return nil, err
-					}
-					peer.AllowedIPs = append(peer.AllowedIPs, a)
-				}
-			case "persistentkeepalive":
-				p, err := parsePersistentKeepalive(val)
-				if err != nil {
-					return nil, err
-				}
-				peer.PersistentKeepalive = p
-			case "endpoint":
-				e, err := parseEndpoint(val)
-				if err != nil {
-					return nil, err
-				}
-				peer.Endpoint = *e
-			default:
-				return nil, &ParseError{"Invalid key for [Peer] section", key}
+	switch strings.ToLower(key) {
+	case "publickey":
+		k, err := ParseKeyBase64(val)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = *k
+	case "presharedkey":
+		k, err := ParseKeyBase64(val)
+		if err != nil {
+			return err
+		}
+		peer.PresharedKey = *k
+	case "allowedips":
+		addresses, err := splitList(val)
+		if err != nil {
+			return err
+		}
+		for _, address := range addresses {
+			a, err := parseIPCidr(address)
+			if err != nil {
+				return err
 			}
+			peer.AllowedIPs = append(peer.AllowedIPs, a)
 		}
-
-		if !scanner.Scan() {
-			break
+	case "persistentkeepalive":
+		keepalive, err := parsePersistentKeepalive(val)
+		if err != nil {
+			return err
+		}
+		peer.PersistentKeepalive = keepalive
+	case "endpoint":
+		e, err := parseEndpoint(val)
+		if err != nil {
+			return err
 		}
+		peer.Endpoint = *e
+	default:
+		peer.Unknown = append(peer.Unknown, KeyValue{key, val})
 	}
-
-	return &peer, nil
+	return nil
 }
 
 func ParseConfig(input io.Reader, name string) (*Config, error) {
@@ -278,126 +484,40 @@ func (c *Config) UnmarshalText(text []byte) error {
 	return c.UnmarshalReader(bytes.NewBuffer(text))
 }
 
+// UnmarshalReader parses a wg-quick configuration file.
+//
+// The original text of the file is kept alongside the parsed values, see Config.Export.
 func (c *Config) UnmarshalReader(input io.Reader) error {
-	var peer *Peer
-	state := notInSection
-	scanner := bufio.NewScanner(input)
-	sawPrivateKey := false
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		line, lineAfter, _ := strings.Cut(line, "#")
-		line = strings.TrimSpace(line)
-		lineLower := strings.ToLower(line)
-
-		if lineLower == "[interface]" {
-			// in case there was a peer before the interface section
-			c.maybeAddPeer(peer)
-			state = inInterface
-			continue
-		}
-		if lineLower == "[peer]" || beginWithDisabledRegex.MatchString(lineAfter) {
-			peer, err := parsePeer(scanner)
-			if err != nil {
-				return err
-			}
-			c.maybeAddPeer(peer)
-			state = inPeer
-			continue
-		}
-
-		if len(line) == 0 {
-			continue
-		}
-
-		if state == notInSection {
-			// at this point, if we haven't seen a section, it's a malformed file
-			return &ParseError{"line must occur in a section", line}
-		}
-		equals := strings.IndexByte(line, '=')
-		if equals < 0 {
-			return &ParseError{"Server key is missing an equals separator", line}
-		}
-		key, val := strings.TrimSpace(lineLower[:equals]), strings.TrimSpace(line[equals+1:])
-		if len(val) == 0 {
-			return &ParseError{"Key must have a value", line}
-		}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	text := string(data)
 
-		if state == inInterface {
-			switch key {
-			case "privatekey":
-				k, err := ParseKeyBase64(val)
-				if err != nil {
-					return err
-				}
-				c.Interface.PrivateKey = *k
-				sawPrivateKey = true
-			case "listenport":
-				p, err := parsePort(val)
-				if err != nil {
-					return err
-				}
-				c.Interface.ListenPort = p
-			case "mtu":
-				m, err := parseMTU(val)
-				if err != nil {
-					return err
-				}
-				c.Interface.MTU = m
-			case "address":
-				addresses, err := splitList(val)
-				if err != nil {
-					return err
-				}
-				for _, address := range addresses {
-					a, err := parseIPCidr(address)
-					if err != nil {
-						return err
-					}
-					c.Interface.Addresses = append(c.Interface.Addresses, a)
-				}
-			case "dns":
-				addresses, err := splitList(val)
-				if err != nil {
-					return err
-				}
-				for _, address := range addresses {
-					a, err := netip.ParseAddr(address)
-					if err != nil {
-						c.Interface.DNSSearch = append(c.Interface.DNSSearch, address)
-					} else {
-						c.Interface.DNS = append(c.Interface.DNS, a)
-					}
-				}
-			case "preup":
-				c.Interface.PreUp = val
-			case "postup":
-				c.Interface.PostUp = val
-			case "predown":
-				c.Interface.PreDown = val
-			case "postdown":
-				c.Interface.PostDown = val
-			case "table":
-				table, err := parseTable(val)
-				if err != nil {
-					return err
-				}
-				c.Interface.Table = table
-			default:
-				return &ParseError{"Invalid key for [Interface] section", key}
+	p := parser{
+		conf:  c,
+		iface: &section{finalNewline: strings.HasSuffix(text, "\n")},
+	}
+	if len(text) > 0 {
+		for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if err := p.parse(parseLine(i+1, line)); err != nil {
+				return err
 			}
 		}
 	}
-	c.maybeAddPeer(peer)
+	p.flushPeer()
 
-	if !sawPrivateKey {
+	if !p.sawPrivateKey {
 		return &ParseError{"An interface must have a private key", "[none specified]"}
 	}
-	for _, p := range c.Peers {
-		if p.PublicKey.IsZero() {
+	for _, peer := range c.Peers {
+		if peer.PublicKey.IsZero() {
 			return &ParseError{"All peers must have public keys", "[none specified]"}
 		}
 	}
 
+	p.iface.fields = c.Interface.fields()
+	c.layout = p.iface
+
 	return nil
 }
@@ -0,0 +1,235 @@
+package wireguard
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	testServerKey = "AJnD7lXD49GOws6TkzJvr1pnLDnsozrAX0g4+Kyz6FY="
+	testPeerKey1  = "wTL82V/TU0/aawFtrt77bhCsstGStJOxm1ZwJLplKxM="
+	testPeerKey2  = "bjJ9kfI4wIhgG3FoBgVS1UiCQ4hPp/Q+kqvqMwaQaMg="
+	testPeerKey3  = "Kri2wiMrqX6JVxLxzC4gJGAC9O9vWnar75hVoOA38ng="
+	testPSK       = "qRuTRPXpBVg25Ou2hrywz8Mrp4ZzCCI1R7tQ7H6OAOs="
+)
+
+const testPiVPNConfig = `[Interface]
+PrivateKey = ` + testServerKey + `
+Address = 10.6.0.1/24
+MTU = 1420
+ListenPort = 51820
+
+### begin phone ###
+[Peer]
+PublicKey = ` + testPeerKey1 + `
+PresharedKey = ` + testPSK + `
+AllowedIPs = 10.6.0.2/32
+### end phone ###
+#[disabled] ### begin laptop ###
+#[disabled] [Peer]
+#[disabled] PublicKey = ` + testPeerKey2 + `
+#[disabled] PresharedKey = ` + testPSK + `
+#[disabled] AllowedIPs = 10.6.0.3/32
+#[disabled] ### end laptop ###
+`
+
+const testHandEditedConfig = `# managed by hand, see the wiki
+[Interface]
+PrivateKey=` + testServerKey + `
+Address = 10.6.0.1/24,fd00::1/64
+ListenPort = 51820 # the default port
+FwMark = 0x1234
+SaveConfig = false
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostUp = iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+Jc = 4
+
+# site router
+[Peer]
+PublicKey = ` + testPeerKey1 + `
+AllowedIPs = 10.6.0.2/32, 192.168.10.0/24
+Endpoint = [2001:db8::1]:51820
+PersistentKeepalive = off
+H1 = 1234
+
+[peer]
+publickey = ` + testPeerKey2 + `
+allowedips = 10.6.0.3/32`
+
+func TestConfigExportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"pivpn", testPiVPNConfig},
+		{"hand edited", testHandEditedConfig},
+		{"crlf", strings.ReplaceAll(testPiVPNConfig, "\n", "\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(tt.input), "wg0")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if got := conf.Export(); got != tt.input {
+				t.Errorf("Export() = %q, want %q", got, tt.input)
+			}
+		})
+	}
+}
+
+func TestParseConfigValues(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testHandEditedConfig), "wg0")
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if len(conf.Interface.PostUp) != 2 || len(conf.Interface.PostDown) != 1 {
+		t.Errorf("PostUp = %q, PostDown = %q, want 2 and 1 commands", conf.Interface.PostUp, conf.Interface.PostDown)
+	}
+	if conf.Interface.FwMark != 0x1234 {
+		t.Errorf("FwMark = %#x, want 0x1234", conf.Interface.FwMark)
+	}
+	if len(conf.Interface.Unknown) != 1 || conf.Interface.Unknown[0] != (KeyValue{"Jc", "4"}) {
+		t.Errorf("Interface.Unknown = %v, want [{Jc 4}]", conf.Interface.Unknown)
+	}
+	if len(conf.Peers) != 2 {
+		t.Fatalf("len(Peers) = %d, want 2", len(conf.Peers))
+	}
+	if len(conf.Peers[0].Unknown) != 1 || conf.Peers[0].Unknown[0] != (KeyValue{"H1", "1234"}) {
+		t.Errorf("Peers[0].Unknown = %v, want [{H1 1234}]", conf.Peers[0].Unknown)
+	}
+}
+
+func TestConfigExportEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		edit  func(*Config) error
+		want  string
+	}{
+		{
+			"disable peer",
+			testPiVPNConfig,
+			func(c *Config) error { return c.DisablePeer("phone") },
+			strings.Replace(testPiVPNConfig, `### begin phone ###
+[Peer]
+PublicKey = `+testPeerKey1+`
+PresharedKey = `+testPSK+`
+AllowedIPs = 10.6.0.2/32
+### end phone ###`, `#[disabled] ### begin phone ###
+#[disabled] [Peer]
+#[disabled] PublicKey = `+testPeerKey1+`
+#[disabled] PresharedKey = `+testPSK+`
+#[disabled] AllowedIPs = 10.6.0.2/32
+#[disabled] ### end phone ###`, 1),
+		},
+		{
+			"enable peer",
+			testPiVPNConfig,
+			func(c *Config) error { return c.EnablePeer("laptop") },
+			strings.ReplaceAll(testPiVPNConfig, "#[disabled] ", ""),
+		},
+		{
+			"remove peer",
+			testHandEditedConfig,
+			func(c *Config) error {
+				c.Peers = c.Peers[1:]
+				return nil
+			},
+			strings.Replace(testHandEditedConfig, `# site router
+[Peer]
+PublicKey = `+testPeerKey1+`
+AllowedIPs = 10.6.0.2/32, 192.168.10.0/24
+Endpoint = [2001:db8::1]:51820
+PersistentKeepalive = off
+H1 = 1234
+
+`, "", 1),
+		},
+		{
+			"add peer",
+			testPiVPNConfig,
+			func(c *Config) error {
+				key, _ := ParseKeyBase64(testPeerKey3)
+				return c.AddPeer(Peer{
+					Name:       "tablet",
+					PublicKey:  *key,
+					AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.6.0.4/32")},
+				})
+			},
+			testPiVPNConfig + `### begin tablet ###
+[Peer]
+PublicKey = ` + testPeerKey3 + `
+AllowedIPs = 10.6.0.4/32
+### end tablet ###
+`,
+		},
+		{
+			"change hooks and keepalive",
+			testHandEditedConfig,
+			func(c *Config) error {
+				c.Interface.PostUp = c.Interface.PostUp[:1]
+				c.Interface.PostDown = nil
+				c.Peers[0].PersistentKeepalive = 25
+				c.Peers[1].PersistentKeepalive = 25
+				return nil
+			},
+			strings.NewReplacer(
+				"PostUp = iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE\n", "",
+				"PostDown = iptables -D FORWARD -i %i -j ACCEPT\n", "",
+				"PersistentKeepalive = off", "PersistentKeepalive = 25",
+				"allowedips = 10.6.0.3/32", "allowedips = 10.6.0.3/32\nPersistentKeepalive = 25",
+			).Replace(testHandEditedConfig),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(tt.input), "wg0")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if err := tt.edit(conf); err != nil {
+				t.Fatalf("edit error = %v", err)
+			}
+			if got := conf.Export(); got != tt.want {
+				t.Errorf("Export() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceMsgpHooks(t *testing.T) {
+	// an interface from an older version, with a single hook string
+	old := msgp.AppendMapHeader(nil, 2)
+	old = msgp.AppendString(old, "listen_port")
+	old = msgp.AppendUint16(old, 51820)
+	old = msgp.AppendString(old, "pre_up")
+	old = msgp.AppendString(old, "iptables -A FORWARD -i wg0 -j ACCEPT")
+	var iface Interface
+	if _, err := iface.UnmarshalMsg(old); err != nil || iface.ListenPort != 51820 || iface.PreUp != nil {
+		t.Errorf("UnmarshalMsg() of an older interface = %+v, %v, want the hook skipped", iface, err)
+	}
+
+	// the older versions decode pre_up as a string, the lists must be under other keys
+	iface = Interface{PreUp: []string{"true"}, PostUp: []string{"true"}, PreDown: []string{"true"}, PostDown: []string{"true"}}
+	data, err := iface.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _, err := msgp.ReadMapStrIntfBytes(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"pre_up", "post_up", "pre_down", "post_down"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("MarshalMsg() has %s, which older versions decode as a string", key)
+		}
+		if _, ok := fields[key+"s"]; !ok {
+			t.Errorf("MarshalMsg() has no %ss", key)
+		}
+	}
+}
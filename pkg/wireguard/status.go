@@ -0,0 +1,200 @@
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OnlineThreshold is how recent the latest handshake of a peer must be for it to be considered online.
+// WireGuard renews the handshake every 2 minutes and rejects sessions older than 3 minutes.
+const OnlineThreshold = 3 * time.Minute
+
+// DeviceStatus is the live state of a WireGuard interface.
+type DeviceStatus struct {
+	PrivateKey Key
+	PublicKey  Key
+	ListenPort uint16
+	FwMark     uint32
+	Peers      []PeerStatus
+}
+
+type PeerStatus struct {
+	PublicKey           Key
+	PresharedKey        Key
+	Endpoint            Endpoint
+	AllowedIPs          []netip.Prefix
+	LatestHandshake     time.Time
+	RxBytes             uint64
+	TxBytes             uint64
+	PersistentKeepalive uint16
+}
+
+func (s *DeviceStatus) Peer(key Key) *PeerStatus {
+	for i := range s.Peers {
+		if s.Peers[i].PublicKey == key {
+			return &s.Peers[i]
+		}
+	}
+	return nil
+}
+
+func (p *PeerStatus) IsOnline(now time.Time) bool {
+	return !p.LatestHandshake.IsZero() && now.Sub(p.LatestHandshake) < OnlineThreshold
+}
+
+// StatusSource provides the live state of WireGuard interfaces.
+type StatusSource interface {
+	DeviceStatus(iface string) (*DeviceStatus, error)
+}
+
+// WgShow reads the state of an interface from the output of `wg show <iface> dump`.
+//
+// Cmd is the `wg` command, with its arguments if any. It defaults to `wg`.
+type WgShow struct {
+	Cmd []string
+}
+
+func (w WgShow) DeviceStatus(iface string) (*DeviceStatus, error) {
+	cmd := w.Cmd
+	if len(cmd) == 0 {
+		cmd = []string{"wg"}
+	}
+	var stderr bytes.Buffer
+	c := exec.Command(cmd[0], append(cmd[1:], "show", iface, "dump")...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show %s dump: %w: %s", iface, err, strings.TrimSpace(stderr.String()))
+	}
+	return ParseDump(bytes.NewReader(out))
+}
+
+// DumpFile reads the state of an interface from a file in the `wg show <iface> dump` format.
+type DumpFile string
+
+func (d DumpFile) DeviceStatus(_ string) (*DeviceStatus, error) {
+	file, err := os.Open(string(d))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+	return ParseDump(file)
+}
+
+func parseDumpKey(s string) (Key, error) {
+	if s == "(none)" {
+		return Key{}, nil
+	}
+	k, err := ParseKeyBase64(s)
+	if err != nil {
+		return Key{}, err
+	}
+	return *k, nil
+}
+
+func parseDumpPeer(fields []string) (*PeerStatus, error) {
+	var peer PeerStatus
+	var err error
+
+	if peer.PublicKey, err = parseDumpKey(fields[0]); err != nil {
+		return nil, err
+	}
+	if peer.PresharedKey, err = parseDumpKey(fields[1]); err != nil {
+		return nil, err
+	}
+	if fields[2] != "(none)" {
+		e, err := parseEndpoint(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		peer.Endpoint = *e
+	}
+	if fields[3] != "(none)" {
+		for address := range strings.SplitSeq(fields[3], ",") {
+			a, err := parseIPCidr(address)
+			if err != nil {
+				return nil, err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, a)
+		}
+	}
+	handshake, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, &ParseError{"Invalid latest handshake", fields[4]}
+	}
+	if handshake > 0 {
+		peer.LatestHandshake = time.Unix(handshake, 0)
+	}
+	if peer.RxBytes, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+		return nil, &ParseError{"Invalid transfer rx", fields[5]}
+	}
+	if peer.TxBytes, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return nil, &ParseError{"Invalid transfer tx", fields[6]}
+	}
+	if peer.PersistentKeepalive, err = parsePersistentKeepalive(fields[7]); err != nil {
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+// ParseDump parses the output of `wg show <iface> dump`.
+//
+// The first line describes the interface: private key, public key, listen port and fwmark.
+// Each following line describes a peer: public key, preshared key, endpoint, allowed ips, latest handshake,
+// bytes received, bytes sent and persistent keepalive.
+func ParseDump(input io.Reader) (*DeviceStatus, error) {
+	scanner := bufio.NewScanner(input)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, &ParseError{"Empty dump", ""}
+	}
+	fields := strings.Split(scanner.Text(), "\t")
+	if len(fields) != 4 {
+		return nil, &ParseError{fmt.Sprintf("expected 4 fields for the interface, got %d", len(fields)), scanner.Text()}
+	}
+
+	var status DeviceStatus
+	var err error
+	if status.PrivateKey, err = parseDumpKey(fields[0]); err != nil {
+		return nil, err
+	}
+	if status.PublicKey, err = parseDumpKey(fields[1]); err != nil {
+		return nil, err
+	}
+	if status.ListenPort, err = parsePort(fields[2]); err != nil {
+		return nil, err
+	}
+	if status.FwMark, err = parseFwMark(fields[3]); err != nil {
+		return nil, err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, &ParseError{fmt.Sprintf("expected 8 fields for a peer, got %d", len(fields)), line}
+		}
+		peer, err := parseDumpPeer(fields)
+		if err != nil {
+			return nil, err
+		}
+		status.Peers = append(status.Peers, *peer)
+	}
+
+	return &status, scanner.Err()
+}
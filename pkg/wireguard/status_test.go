@@ -0,0 +1,46 @@
+package wireguard
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDumpFile(t *testing.T) {
+	status, err := DumpFile("testdata/wg0.dump").DeviceStatus("wg0")
+	if err != nil {
+		t.Fatalf("DeviceStatus() error = %v", err)
+	}
+	if status.ListenPort != 51820 || status.FwMark != 0 {
+		t.Errorf("ListenPort, FwMark = %d, %d, want 51820, 0", status.ListenPort, status.FwMark)
+	}
+	if len(status.Peers) != 2 {
+		t.Fatalf("len(Peers) = %d, want 2", len(status.Peers))
+	}
+
+	peerKey1, _ := ParseKeyBase64(testPeerKey1)
+	psk, _ := ParseKeyBase64(testPSK)
+	want := PeerStatus{
+		PublicKey:       *peerKey1,
+		PresharedKey:    *psk,
+		Endpoint:        Endpoint{"203.0.113.7", 41234},
+		AllowedIPs:      []netip.Prefix{netip.MustParsePrefix("10.6.0.2/32")},
+		LatestHandshake: time.Unix(1760000000, 0),
+		RxBytes:         123456,
+		TxBytes:         7890123,
+	}
+	if got := status.Peer(*peerKey1); got == nil || !reflect.DeepEqual(*got, want) {
+		t.Errorf("Peer() = %+v, want %+v", got, want)
+	}
+
+	idle := status.Peers[1]
+	if !idle.LatestHandshake.IsZero() || !idle.Endpoint.IsEmpty() || idle.PersistentKeepalive != 25 || len(idle.AllowedIPs) != 2 {
+		t.Errorf("Peers[1] = %+v, want no handshake, no endpoint, keepalive 25 and 2 allowed ips", idle)
+	}
+
+	now := time.Unix(1760000000, 0).Add(time.Minute)
+	if !status.Peers[0].IsOnline(now) || status.Peers[1].IsOnline(now) {
+		t.Errorf("IsOnline() = %v, %v, want true, false", status.Peers[0].IsOnline(now), status.Peers[1].IsOnline(now))
+	}
+}
@@ -0,0 +1,236 @@
+package wireguard
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUAPIDir     = "/var/run/wireguard"
+	DefaultUAPITimeout = 5 * time.Second
+)
+
+// UAPIError is an error returned by a WireGuard implementation over its UAPI socket.
+type UAPIError struct {
+	Errno int
+}
+
+func (e *UAPIError) Error() string {
+	return fmt.Sprintf("uapi: operation failed with errno %d", e.Errno)
+}
+
+func (k Key) HexString() string {
+	return hex.EncodeToString(k[:])
+}
+
+func parseKeyHex(s string) (Key, error) {
+	var key Key
+	k, err := hex.DecodeString(s)
+	if err != nil {
+		return key, &ParseError{fmt.Sprintf("Invalid key: %v", err), s}
+	}
+	if len(k) != KeyLength {
+		return key, &ParseError{"Keys must decode to exactly 32 bytes", s}
+	}
+	copy(key[:], k)
+	return key, nil
+}
+
+// UAPIClient talks to userspace WireGuard implementations, such as wireguard-go or boringtun, using the cross-platform
+// UAPI over their unix sockets. See https://www.wireguard.com/xplatform/.
+//
+// It reads the state of interfaces and applies peer updates without the `wg` tool.
+type UAPIClient struct {
+	// Dir holds the `<iface>.sock` sockets, it defaults to DefaultUAPIDir.
+	Dir string
+	// Timeout bounds each operation, it defaults to DefaultUAPITimeout.
+	Timeout time.Duration
+}
+
+func (u *UAPIClient) dial(iface string) (net.Conn, error) {
+	dir, timeout := u.Dir, u.Timeout
+	if dir == "" {
+		dir = DefaultUAPIDir
+	}
+	if timeout == 0 {
+		timeout = DefaultUAPITimeout
+	}
+
+	conn, err := net.DialTimeout("unix", filepath.Join(dir, iface+".sock"), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readUAPIResponse reads key=value lines up to the empty line ending a response, returning the errno.
+func readUAPIResponse(scanner *bufio.Scanner, line func(key, val string) error) error {
+	for scanner.Scan() {
+		text := scanner.Text()
+		if text == "" {
+			return nil
+		}
+		key, val, ok := strings.Cut(text, "=")
+		if !ok {
+			return &ParseError{"UAPI line is missing an equals separator", text}
+		}
+		if key == "errno" {
+			errno, err := strconv.Atoi(val)
+			if err != nil {
+				return &ParseError{"Invalid errno", val}
+			}
+			if errno != 0 {
+				return &UAPIError{errno}
+			}
+			continue
+		}
+		if err := line(key, val); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return &ParseError{"UAPI response ended unexpectedly", ""}
+}
+
+func (u *UAPIClient) DeviceStatus(iface string) (*DeviceStatus, error) {
+	conn, err := u.dial(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = fmt.Fprint(conn, "get=1\n\n"); err != nil {
+		return nil, err
+	}
+
+	var status DeviceStatus
+	var peer *PeerStatus
+	var handshakeSec, handshakeNsec int64
+	flushPeer := func() {
+		if peer == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			peer.LatestHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		status.Peers = append(status.Peers, *peer)
+		peer, handshakeSec, handshakeNsec = nil, 0, 0
+	}
+
+	err = readUAPIResponse(bufio.NewScanner(conn), func(key, val string) error {
+		var err error
+		if key == "public_key" {
+			flushPeer()
+			peer = &PeerStatus{}
+			peer.PublicKey, err = parseKeyHex(val)
+			return err
+		}
+
+		if peer == nil {
+			switch key {
+			case "private_key":
+				status.PrivateKey, err = parseKeyHex(val)
+				status.PublicKey = *status.PrivateKey.Public()
+			case "listen_port":
+				status.ListenPort, err = parsePort(val)
+			case "fwmark":
+				status.FwMark, err = parseFwMark(val)
+			}
+			return err
+		}
+
+		switch key {
+		case "preshared_key":
+			peer.PresharedKey, err = parseKeyHex(val)
+		case "endpoint":
+			var e *Endpoint
+			if e, err = parseEndpoint(val); err == nil {
+				peer.Endpoint = *e
+			}
+		case "persistent_keepalive_interval":
+			peer.PersistentKeepalive, err = parsePersistentKeepalive(val)
+		case "last_handshake_time_sec":
+			handshakeSec, err = strconv.ParseInt(val, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, err = strconv.ParseInt(val, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, err = strconv.ParseUint(val, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, err = strconv.ParseUint(val, 10, 64)
+		case "allowed_ip":
+			var ip netip.Prefix
+			if ip, err = parseIPCidr(val); err == nil {
+				peer.AllowedIPs = append(peer.AllowedIPs, ip)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	flushPeer()
+
+	return &status, nil
+}
+
+// uapiEndpoint resolves the endpoint, as the UAPI only accepts IP addresses.
+func uapiEndpoint(e *Endpoint) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", e.String())
+	if err != nil {
+		return "", err
+	}
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String(), nil
+}
+
+func (u *UAPIClient) ApplyPeerUpdates(iface string, updates *PeerUpdates) error {
+	var builder strings.Builder
+
+	builder.WriteString("set=1\n")
+	for _, key := range updates.Remove {
+		_, _ = fmt.Fprintf(&builder, "public_key=%s\nremove=true\n", key.HexString())
+	}
+	for _, peer := range updates.Set {
+		_, _ = fmt.Fprintf(&builder, "public_key=%s\n", peer.PublicKey.HexString())
+		_, _ = fmt.Fprintf(&builder, "preshared_key=%s\n", peer.PresharedKey.HexString())
+		if !peer.Endpoint.IsEmpty() {
+			endpoint, err := uapiEndpoint(&peer.Endpoint)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(&builder, "endpoint=%s\n", endpoint)
+		}
+		_, _ = fmt.Fprintf(&builder, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+		builder.WriteString("replace_allowed_ips=true\n")
+		for _, ip := range peer.AllowedIPs {
+			_, _ = fmt.Fprintf(&builder, "allowed_ip=%s\n", ip.String())
+		}
+	}
+	builder.WriteString("\n")
+
+	conn, err := u.dial(iface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = conn.Write([]byte(builder.String())); err != nil {
+		return err
+	}
+	return readUAPIResponse(bufio.NewScanner(conn), func(key, val string) error {
+		return nil
+	})
+}
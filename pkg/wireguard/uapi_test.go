@@ -0,0 +1,182 @@
+package wireguard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUAPI is an in-process UAPI server answering get requests with its device and recording set requests.
+type fakeUAPI struct {
+	device string
+	errno  int
+	sets   chan string
+}
+
+func startFakeUAPI(t *testing.T, iface string, f *fakeUAPI) *UAPIClient {
+	dir := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(dir, iface+".sock"))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	f.sets = make(chan string, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn)
+		}
+	}()
+
+	return &UAPIClient{Dir: dir, Timeout: time.Second}
+}
+
+func (f *fakeUAPI) serve(conn net.Conn) {
+	defer conn.Close() //nolint:errcheck
+	var request strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && scanner.Text() != "" {
+		request.WriteString(scanner.Text() + "\n")
+	}
+
+	switch op := request.String(); {
+	case op == "get=1\n":
+		_, _ = fmt.Fprintf(conn, "%serrno=%d\n\n", f.device, f.errno)
+	case strings.HasPrefix(op, "set=1\n"):
+		f.sets <- op
+		_, _ = fmt.Fprintf(conn, "errno=%d\n\n", f.errno)
+	default:
+		_, _ = fmt.Fprint(conn, "errno=22\n\n")
+	}
+}
+
+func hexKey(t *testing.T, s string) string {
+	k, err := ParseKeyBase64(s)
+	if err != nil {
+		t.Fatalf("ParseKeyBase64() error = %v", err)
+	}
+	return k.HexString()
+}
+
+func TestUAPIClientDeviceStatus(t *testing.T) {
+	serverKey, _ := ParseKeyBase64(testServerKey)
+	client := startFakeUAPI(t, "wg0", &fakeUAPI{device: "private_key=" + hexKey(t, testServerKey) + `
+listen_port=51820
+fwmark=0
+public_key=` + hexKey(t, testPeerKey1) + `
+preshared_key=` + hexKey(t, testPSK) + `
+endpoint=198.51.100.7:40123
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=500
+rx_bytes=1024
+tx_bytes=2048
+persistent_keepalive_interval=25
+allowed_ip=10.6.0.2/32
+allowed_ip=fd00::2/128
+protocol_version=1
+public_key=` + hexKey(t, testPeerKey2) + `
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+rx_bytes=0
+tx_bytes=0
+persistent_keepalive_interval=0
+allowed_ip=10.6.0.3/32
+`})
+
+	status, err := client.DeviceStatus("wg0")
+	if err != nil {
+		t.Fatalf("DeviceStatus() error = %v", err)
+	}
+	if status.PublicKey != *serverKey.Public() || status.ListenPort != 51820 {
+		t.Errorf("DeviceStatus() interface = %v %d, want %v 51820", status.PublicKey, status.ListenPort, serverKey.Public())
+	}
+	if len(status.Peers) != 2 {
+		t.Fatalf("len(Peers) = %d, want 2", len(status.Peers))
+	}
+
+	peer := status.Peers[0]
+	if peer.PublicKey.String() != testPeerKey1 || peer.PresharedKey.String() != testPSK {
+		t.Errorf("Peers[0] keys = %v %v", peer.PublicKey, peer.PresharedKey)
+	}
+	if peer.Endpoint.String() != "198.51.100.7:40123" {
+		t.Errorf("Peers[0].Endpoint = %v, want 198.51.100.7:40123", peer.Endpoint)
+	}
+	if !peer.LatestHandshake.Equal(time.Unix(1700000000, 500)) {
+		t.Errorf("Peers[0].LatestHandshake = %v", peer.LatestHandshake)
+	}
+	if peer.RxBytes != 1024 || peer.TxBytes != 2048 || peer.PersistentKeepalive != 25 {
+		t.Errorf("Peers[0] counters = %d %d %d, want 1024 2048 25", peer.RxBytes, peer.TxBytes, peer.PersistentKeepalive)
+	}
+	if len(peer.AllowedIPs) != 2 {
+		t.Errorf("Peers[0].AllowedIPs = %v, want 2 prefixes", peer.AllowedIPs)
+	}
+
+	peer = status.Peers[1]
+	if !peer.PresharedKey.IsZero() || !peer.LatestHandshake.IsZero() {
+		t.Errorf("Peers[1] = %+v, want no preshared key nor handshake", peer)
+	}
+}
+
+func TestUAPIClientDeviceStatusErrno(t *testing.T) {
+	client := startFakeUAPI(t, "wg0", &fakeUAPI{errno: 19})
+	_, err := client.DeviceStatus("wg0")
+	var uapiErr *UAPIError
+	if !errors.As(err, &uapiErr) || uapiErr.Errno != 19 {
+		t.Errorf("DeviceStatus() error = %v, want errno 19", err)
+	}
+}
+
+func TestUAPIClientApplyPeerUpdates(t *testing.T) {
+	peerKey1, _ := ParseKeyBase64(testPeerKey1)
+	peerKey2, _ := ParseKeyBase64(testPeerKey2)
+	psk, _ := ParseKeyBase64(testPSK)
+
+	fake := &fakeUAPI{}
+	client := startFakeUAPI(t, "wg0", fake)
+	err := client.ApplyPeerUpdates("wg0", &PeerUpdates{
+		Remove: []Key{*peerKey1},
+		Set: []Peer{{
+			PublicKey:           *peerKey2,
+			PresharedKey:        *psk,
+			AllowedIPs:          []netip.Prefix{netip.MustParsePrefix("10.6.0.3/32"), netip.MustParsePrefix("fd00::3/128")},
+			Endpoint:            Endpoint{Host: "192.0.2.1", Port: 51820},
+			PersistentKeepalive: 25,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("ApplyPeerUpdates() error = %v", err)
+	}
+
+	want := `set=1
+public_key=` + hexKey(t, testPeerKey1) + `
+remove=true
+public_key=` + hexKey(t, testPeerKey2) + `
+preshared_key=` + hexKey(t, testPSK) + `
+endpoint=192.0.2.1:51820
+persistent_keepalive_interval=25
+replace_allowed_ips=true
+allowed_ip=10.6.0.3/32
+allowed_ip=fd00::3/128
+`
+	if got := <-fake.sets; got != want {
+		t.Errorf("ApplyPeerUpdates() sent %q, want %q", got, want)
+	}
+
+	fake.errno = 1
+	err = client.ApplyPeerUpdates("wg0", &PeerUpdates{Remove: []Key{*peerKey1}})
+	var uapiErr *UAPIError
+	if !errors.As(err, &uapiErr) || uapiErr.Errno != 1 {
+		t.Errorf("ApplyPeerUpdates() error = %v, want errno 1", err)
+	}
+}
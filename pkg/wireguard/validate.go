@@ -0,0 +1,138 @@
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ValidationError struct {
+	// Line is the line of the problem in the parsed file, or 0 if unknown.
+	Line     int
+	Why      string
+	Offender string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %q", e.Line, e.Why, e.Offender)
+	}
+	return fmt.Sprintf("%s: %q", e.Why, e.Offender)
+}
+
+// ValidationErrors are all the problems found by Config.Validate.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// lineOf returns the line number of the first occurrence of key, or of the section header if key is absent.
+func (s *section) lineOf(key string) int {
+	if s == nil {
+		return 0
+	}
+	for _, l := range s.lines {
+		if l.kind == lineKey && l.key == key {
+			return l.num
+		}
+	}
+	if header := s.header(); header >= 0 {
+		return s.lines[header].num
+	}
+	return 0
+}
+
+func (p *Peer) displayName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.PublicKey.String()
+}
+
+// Validate checks the semantics of the configuration, which ParseConfig doesn't.
+//
+// It reports missing keys, duplicate peer names, public keys and preshared keys, overlapping AllowedIPs between
+// peers and peer addresses outside the interface's subnets. All the problems are returned at once as
+// ValidationErrors, with the line numbers of the parsed file if there is one.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	report := func(line int, why, offender string) {
+		errs = append(errs, &ValidationError{line, why, offender})
+	}
+
+	if c.Interface.PrivateKey.IsZero() {
+		report(c.layout.lineOf("privatekey"), "An interface must have a private key", "[none specified]")
+	}
+
+	names := make(map[string]*Peer, len(c.Peers))
+	publicKeys := make(map[Key]*Peer, len(c.Peers))
+	presharedKeys := make(map[Key]*Peer, len(c.Peers))
+	for i := range c.Peers {
+		peer := &c.Peers[i]
+
+		if peer.Name != "" {
+			if other, ok := names[peer.Name]; ok {
+				report(peer.layout.lineOf(""), fmt.Sprintf("Duplicate peer name (first on line %d)", other.layout.lineOf("")), peer.Name)
+			} else {
+				names[peer.Name] = peer
+			}
+		}
+
+		if peer.PublicKey.IsZero() {
+			report(peer.layout.lineOf("publickey"), "All peers must have public keys", peer.displayName())
+		} else if other, ok := publicKeys[peer.PublicKey]; ok {
+			report(peer.layout.lineOf("publickey"), fmt.Sprintf("Public key already used by peer %s", other.displayName()), peer.displayName())
+		} else {
+			publicKeys[peer.PublicKey] = peer
+		}
+
+		if !peer.PresharedKey.IsZero() {
+			if other, ok := presharedKeys[peer.PresharedKey]; ok {
+				report(peer.layout.lineOf("presharedkey"), fmt.Sprintf("Preshared key already used by peer %s", other.displayName()), peer.displayName())
+			} else {
+				presharedKeys[peer.PresharedKey] = peer
+			}
+		}
+
+		for _, ip := range peer.AllowedIPs {
+			for _, other := range c.Peers[:i] {
+				for _, otherIP := range other.AllowedIPs {
+					if ip.Overlaps(otherIP) {
+						report(peer.layout.lineOf("allowedips"), fmt.Sprintf("AllowedIPs %s overlaps with %s of peer %s", ip, otherIP, other.displayName()), peer.displayName())
+					}
+				}
+			}
+
+			if !ip.IsSingleIP() || len(c.Interface.Addresses) == 0 {
+				continue
+			}
+			inSubnet := false
+			for _, address := range c.Interface.Addresses {
+				if address.Masked().Contains(ip.Addr()) {
+					inSubnet = true
+					break
+				}
+			}
+			if !inSubnet {
+				report(peer.layout.lineOf("allowedips"), fmt.Sprintf("Peer address %s is outside of the interface subnets", ip), peer.displayName())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
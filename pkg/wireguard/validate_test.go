@@ -0,0 +1,69 @@
+package wireguard
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPSK2 = "NWsodyahAeOkKEDopEx+s6yVsI69YRC4jUhddr/KT3A="
+
+// testValidConfig is testPiVPNConfig without the preshared key shared by its peers.
+var testValidConfig = strings.Replace(testPiVPNConfig, "#[disabled] PresharedKey = "+testPSK, "#[disabled] PresharedKey = "+testPSK2, 1)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []int
+	}{
+		{"valid", testValidConfig, nil},
+		{"valid routed subnet", testHandEditedConfig, nil},
+		{
+			"duplicates and overlaps",
+			testValidConfig + `### begin phone ###
+[Peer]
+PublicKey = ` + testPeerKey1 + `
+PresharedKey = ` + testPSK + `
+AllowedIPs = 10.6.0.0/30
+### end phone ###
+`,
+			// name, public key, preshared key, overlap with both peers
+			[]int{19, 21, 22, 23, 23},
+		},
+		{
+			"shared preshared key",
+			testPiVPNConfig,
+			[]int{16},
+		},
+		{
+			"outside subnet",
+			testValidConfig + `[Peer]
+PublicKey = ` + testPeerKey3 + `
+AllowedIPs = 10.7.0.2/32
+`,
+			[]int{21},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := ParseConfig(strings.NewReader(tt.input), "wg0")
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			err = conf.Validate()
+			var lines []int
+			if errs, ok := errors.AsType[ValidationErrors](err); ok {
+				for _, e := range errs {
+					lines = append(lines, e.Line)
+				}
+			} else if err != nil {
+				t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+			}
+			if !reflect.DeepEqual(lines, tt.want) {
+				t.Errorf("Validate() lines = %v, want %v\n%v", lines, tt.want, err)
+			}
+		})
+	}
+}